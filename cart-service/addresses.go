@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"pkg-iae/clients"
+	"pkg-iae/models"
+	"pkg-iae/web"
+)
+
+// resolveCheckoutAddresses turns the addresses of a checkout request into the
+// copies the order keeps. Each address is an entry of the user's address book
+// given by ID, or given inline; without either the user's default address of
+// that type is used, and billing falls back to shipping. Problems with the
+// request are returned as field errors, failures to reach the User Service as an error.
+func (a *App) resolveCheckoutAddresses(ctx context.Context, userID int, checkout CheckoutRequest) (*models.Address, *models.Address, web.FieldErrors, error) {
+	errs := web.FieldErrors{}
+
+	shipping, err := a.resolveAddress(ctx, userID, "shipping_address", models.ADDRESS_SHIPPING,
+		checkout.ShippingAddressID, checkout.ShippingAddress, errs)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	billing, err := a.resolveAddress(ctx, userID, "billing_address", models.ADDRESS_BILLING,
+		checkout.BillingAddressID, checkout.BillingAddress, errs)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if len(errs) > 0 {
+		return nil, nil, errs, nil
+	}
+	if shipping == nil {
+		errs.Add("shipping_address", "is required, since the user has no default shipping address")
+		return nil, nil, errs, nil
+	}
+	if billing == nil {
+		billing = shipping
+	}
+	return shipping, billing, nil, nil
+}
+
+// resolveAddress resolves one address of a checkout request, returning nil when
+// none was given and the user has no default of the type
+func (a *App) resolveAddress(ctx context.Context, userID int, field, addressType string, id *int, inline *models.Address, errs web.FieldErrors) (*models.Address, error) {
+	switch {
+	case id != nil && inline != nil:
+		errs.Add(field, "must not be given together with "+field+"_id")
+		return nil, nil
+
+	case id != nil:
+		address, err := a.Users.GetAddress(ctx, userID, *id)
+		if errors.Is(err, clients.ErrNotFound) {
+			errs.Add(field+"_id", "is not in the user's address book")
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &address.Address, nil
+
+	case inline != nil:
+		inline.Normalize()
+		inline.Validate(field, errs)
+		return inline, nil
+	}
+
+	addresses, err := a.Users.GetAddresses(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, address := range addresses {
+		if address.Type == addressType && address.IsDefault {
+			return &address.Address, nil
+		}
+	}
+	return nil, nil
+}
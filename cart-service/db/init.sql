@@ -18,11 +18,64 @@ CREATE TABLE IF NOT EXISTS cart_items (
     FOREIGN KEY (cart_id) REFERENCES carts(id) ON DELETE CASCADE
 );
 
+-- The product variant in the cart; NULL for items added before products had variants
+ALTER TABLE cart_items ADD COLUMN IF NOT EXISTS variant_id INTEGER;
+
+-- Create checkout sagas table
+CREATE TABLE IF NOT EXISTS checkout_sagas (
+    id SERIAL PRIMARY KEY,
+    cart_id INTEGER NOT NULL, -- No foreign key: the cart is deleted by the clear_cart step
+    user_id INTEGER NOT NULL,
+    session_id VARCHAR(255) NOT NULL,
+    status VARCHAR(20) NOT NULL, -- running, compensating, completed, failed
+    items JSONB NOT NULL, -- Cart lines captured when the checkout started
+    shipping_address JSONB, -- Copies of the addresses resolved when the checkout started
+    billing_address JSONB,
+    payment_method VARCHAR(50),
+    order_id INTEGER,
+    order_response JSONB,
+    error TEXT,
+    next_attempt_at TIMESTAMP NOT NULL,
+    locked_until TIMESTAMP, -- Lease held by the worker currently driving the saga
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
+
+-- Create checkout saga steps table
+CREATE TABLE IF NOT EXISTS checkout_saga_steps (
+    saga_id INTEGER NOT NULL,
+    name VARCHAR(50) NOT NULL,
+    position INTEGER NOT NULL,
+    status VARCHAR(20) NOT NULL, -- pending, completed, failed, compensated
+    attempts INTEGER NOT NULL DEFAULT 0,
+    error TEXT,
+    updated_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (saga_id, name),
+    FOREIGN KEY (saga_id) REFERENCES checkout_sagas(id) ON DELETE CASCADE
+);
+
+-- Create idempotency keys table for replaying responses to retried requests
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    scope VARCHAR(100) NOT NULL,
+    key VARCHAR(255) NOT NULL,
+    request_hash CHAR(64) NOT NULL,
+    status VARCHAR(20) NOT NULL, -- in_progress, completed
+    response_code INTEGER,
+    response_body BYTEA,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (scope, key)
+);
+
 -- Create indexes for faster lookups
 CREATE INDEX IF NOT EXISTS idx_carts_user_id ON carts(user_id);
 CREATE INDEX IF NOT EXISTS idx_carts_session_id ON carts(session_id);
 CREATE INDEX IF NOT EXISTS idx_cart_items_cart_id ON cart_items(cart_id);
 CREATE INDEX IF NOT EXISTS idx_cart_items_product_id ON cart_items(product_id);
+CREATE INDEX IF NOT EXISTS idx_checkout_sagas_pending ON checkout_sagas(next_attempt_at) WHERE status IN ('running', 'compensating');
+-- Only one checkout can be in flight for a cart
+CREATE UNIQUE INDEX IF NOT EXISTS idx_checkout_sagas_active_cart ON checkout_sagas(cart_id) WHERE status IN ('running', 'compensating');
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at ON idempotency_keys(expires_at);
 
 -- Insert sample data
 INSERT INTO carts (user_id, session_id, created_at, updated_at, expires_at)
@@ -30,8 +83,8 @@ VALUES
     (1, 'session-user1', NOW(), NOW(), NOW() + INTERVAL '7 days'),
     (NULL, 'session-guest1', NOW(), NOW(), NOW() + INTERVAL '7 days');
 
-INSERT INTO cart_items (cart_id, product_id, quantity, added_at)
+INSERT INTO cart_items (cart_id, product_id, variant_id, quantity, added_at)
 VALUES
-    (1, 1, 2, NOW()),  -- User 1 has 2 of Product 1 in cart
-    (1, 3, 1, NOW()),  -- User 1 has 1 of Product 3 in cart
-    (2, 2, 1, NOW());  -- Guest cart has 1 of Product 2
\ No newline at end of file
+    (1, 1, 1, 2, NOW()),  -- User 1 has 2 of Product 1 in cart
+    (1, 3, 3, 1, NOW()),  -- User 1 has 1 of Product 3 in cart
+    (2, 2, 2, 1, NOW());  -- Guest cart has 1 of Product 2
\ No newline at end of file
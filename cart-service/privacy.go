@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+	"net/http"
+	"pkg-iae/auth"
+	"pkg-iae/web"
+	"strconv"
+)
+
+// UserExport is the part of a user's data export held by the Cart Service
+type UserExport struct {
+	Carts     []Cart         `json:"carts"`
+	Checkouts []CheckoutSaga `json:"checkouts"`
+}
+
+// exportUserData returns everything the Cart Service holds about a user
+func (a *App) exportUserData(w http.ResponseWriter, r *http.Request) {
+	userID := web.ParseInt(mux.Vars(r)["user_id"])
+
+	if !auth.AuthorizeUser(w, r, userID, auth.PERM_PRIVACY_MANAGE) {
+		return
+	}
+
+	export := UserExport{Carts: []Cart{}, Checkouts: []CheckoutSaga{}}
+
+	cartIDs, err := a.userRowIDs(r.Context(), "SELECT id FROM carts WHERE user_id = $1 ORDER BY id", userID)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for _, cartID := range cartIDs {
+		cart, err := a.fetchCartWithItems(r.Context(), cartID)
+		if err == pgx.ErrNoRows {
+			continue // Deleted meanwhile
+		}
+		if err != nil {
+			web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		export.Carts = append(export.Carts, cart)
+	}
+
+	sagaIDs, err := a.userRowIDs(r.Context(), "SELECT id FROM checkout_sagas WHERE user_id = $1 ORDER BY id", userID)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for _, sagaID := range sagaIDs {
+		saga, err := a.fetchCheckoutSaga(sagaID)
+		if err != nil {
+			web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		export.Checkouts = append(export.Checkouts, saga)
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, export)
+}
+
+// userRowIDs runs a query selecting the IDs of a user's rows
+func (a *App) userRowIDs(ctx context.Context, query string, userID int) ([]int, error) {
+	rows, err := a.DB.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// eraseUserData removes a deleted user's carts and finished checkouts. Checkouts
+// still in flight are left to finish or compensate, but lose their addresses
+// and payment method.
+func eraseUserData(ctx context.Context, tx pgx.Tx, userID int) error {
+	_, err := tx.Exec(ctx, "DELETE FROM carts WHERE user_id = $1", userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx,
+		"DELETE FROM checkout_sagas WHERE user_id = $1 AND status NOT IN ($2, $3)",
+		userID, SAGA_RUNNING, SAGA_COMPENSATING)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+        UPDATE checkout_sagas SET shipping_address = NULL, billing_address = NULL, payment_method = NULL, updated_at = NOW()
+        WHERE user_id = $1`,
+		userID)
+	if err != nil {
+		return err
+	}
+
+	// Keys are scoped per caller, see service.App.WithIdempotency
+	_, err = tx.Exec(ctx, "DELETE FROM idempotency_keys WHERE scope LIKE $1",
+		"%:user:"+strconv.Itoa(userID))
+	return err
+}
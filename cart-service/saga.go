@@ -0,0 +1,565 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"net/http"
+	"pkg-iae/auth"
+	"pkg-iae/clients"
+	"pkg-iae/messages"
+	"pkg-iae/models"
+	"pkg-iae/web"
+	"strconv"
+	"time"
+)
+
+const (
+	SAGA_MAX_ATTEMPTS    = 5
+	SAGA_MAX_BACKOFF     = 1 * time.Minute
+	SAGA_LEASE_DURATION  = 2 * time.Minute
+	SAGA_RESUME_INTERVAL = 10 * time.Second
+	SAGA_STEP_TIMEOUT    = 10 * time.Second
+	SAGA_RESERVATION_TTL = 15 * 60 // seconds
+
+	SAGA_RUNNING      = "running"
+	SAGA_COMPENSATING = "compensating"
+	SAGA_COMPLETED    = "completed"
+	SAGA_FAILED       = "failed"
+
+	STEP_PENDING     = "pending"
+	STEP_COMPLETED   = "completed"
+	STEP_FAILED      = "failed"
+	STEP_COMPENSATED = "compensated"
+)
+
+// CheckoutSaga represents the persisted state of a cart checkout across services
+type CheckoutSaga struct {
+	ID              int             `json:"id"`
+	CartID          int             `json:"cart_id"`
+	UserID          int             `json:"user_id"`
+	SessionID       string          `json:"session_id"`
+	Status          string          `json:"status"` // running, compensating, completed, failed
+	Items           []SagaItem      `json:"items"`
+	ShippingAddress *models.Address `json:"shipping_address,omitempty"`
+	BillingAddress  *models.Address `json:"billing_address,omitempty"`
+	PaymentMethod   string          `json:"payment_method,omitempty"`
+	OrderID         *int            `json:"order_id,omitempty"`
+	Order           json.RawMessage `json:"order,omitempty"`
+	Error           *string         `json:"error,omitempty"`
+	NextAttemptAt   time.Time       `json:"next_attempt_at"`
+	Steps           []SagaStep      `json:"steps"`
+	CreatedAt       time.Time       `json:"created_at"`
+	UpdatedAt       time.Time       `json:"updated_at"`
+}
+
+// SagaItem is a cart line captured when the checkout started
+type SagaItem struct {
+	ProductID int `json:"product_id"`
+	VariantID int `json:"variant_id,omitempty"` // Left out for lines added before products had variants
+	Quantity  int `json:"quantity"`
+}
+
+// SagaStep represents the progress of a single checkout step
+type SagaStep struct {
+	Name      string    `json:"name"`
+	Status    string    `json:"status"` // pending, completed, failed, compensated
+	Attempts  int       `json:"attempts"`
+	Error     *string   `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// sagaStep describes how to run a checkout step and how to undo it.
+// Every action must be idempotent since a step is re-run when the service
+// crashes before its outcome was recorded.
+type sagaStep struct {
+	name       string
+	run        func(a *App, ctx context.Context, saga *CheckoutSaga) error
+	compensate func(a *App, ctx context.Context, saga *CheckoutSaga) error
+	// retryForever is set once the order exists: from then on the saga can only move forward
+	retryForever bool
+}
+
+// checkoutSteps lists the checkout steps in execution order.
+// create_order is retried until the order service gives a definite answer because
+// it is idempotent on the reservation reference, so an order is never left behind
+// by a saga that gave up.
+var checkoutSteps = []sagaStep{
+	{name: "validate_user", run: (*App).sagaValidateUser},
+	{name: "reserve_stock", run: (*App).sagaReserveStock, compensate: (*App).sagaReleaseStock},
+	{name: "create_order", run: (*App).sagaCreateOrder, retryForever: true},
+	{name: "clear_cart", run: (*App).sagaClearCart, retryForever: true},
+	{name: "emit_events", run: (*App).sagaEmitEvents, retryForever: true},
+}
+
+// permanentError marks a step failure that retrying cannot fix
+type permanentError struct {
+	message string
+}
+
+func (e *permanentError) Error() string {
+	return e.message
+}
+
+// permanent returns a step error that triggers compensation instead of a retry
+func permanent(format string, args ...interface{}) error {
+	return &permanentError{message: fmt.Sprintf(format, args...)}
+}
+
+// sagaReservationRef returns the reference stock is reserved under for a checkout
+func sagaReservationRef(sagaID int) string {
+	return fmt.Sprintf("checkout-%d", sagaID)
+}
+
+// sagaBackoff returns the delay before the next attempt of a failed step
+func sagaBackoff(attempts int) time.Duration {
+	if attempts > 6 {
+		return SAGA_MAX_BACKOFF
+	}
+	backoff := time.Duration(1<<uint(attempts)) * time.Second
+	if backoff > SAGA_MAX_BACKOFF {
+		return SAGA_MAX_BACKOFF
+	}
+	return backoff
+}
+
+// startCheckoutSaga persists a new saga for a cart together with its pending steps.
+// The checkout's addresses must already be resolved.
+func (a *App) startCheckoutSaga(cart Cart, checkout CheckoutRequest) (int, error) {
+	items := make([]SagaItem, 0, len(cart.Items))
+	for _, item := range cart.Items {
+		line := SagaItem{ProductID: item.ProductID, Quantity: item.Quantity}
+		if item.VariantID != nil {
+			line.VariantID = *item.VariantID
+		}
+		items = append(items, line)
+	}
+	itemsJSON, err := json.Marshal(items)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx := context.Background()
+	tx, err := a.DB.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var sagaID int
+	err = tx.QueryRow(ctx,
+		`INSERT INTO checkout_sagas (cart_id, user_id, session_id, status, items, shipping_address, billing_address, payment_method,
+		next_attempt_at, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NOW(), NOW(), NOW()) RETURNING id`,
+		cart.ID, *cart.UserID, cart.SessionID, SAGA_RUNNING, itemsJSON, checkout.ShippingAddress, checkout.BillingAddress,
+		checkout.PaymentMethod).Scan(&sagaID)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, step := range checkoutSteps {
+		_, err = tx.Exec(ctx,
+			"INSERT INTO checkout_saga_steps (saga_id, name, position, status, updated_at) VALUES ($1, $2, $3, $4, NOW())",
+			sagaID, step.name, i, STEP_PENDING)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+
+	return sagaID, nil
+}
+
+// resumeCheckoutSagas periodically picks up sagas left unfinished by a crash or waiting for a retry
+func (a *App) resumeCheckoutSagas() {
+	ticker := time.NewTicker(SAGA_RESUME_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		rows, err := a.DB.Query(context.Background(),
+			`SELECT id FROM checkout_sagas WHERE status IN ($1, $2) AND next_attempt_at <= NOW()
+			AND (locked_until IS NULL OR locked_until < NOW()) ORDER BY id`,
+			SAGA_RUNNING, SAGA_COMPENSATING)
+		if err != nil {
+			log.Printf("Error finding sagas to resume: %v", err)
+			continue
+		}
+
+		ids := []int{}
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				log.Printf("Error reading saga ID: %v", err)
+				continue
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+
+		for _, id := range ids {
+			if err := a.runCheckoutSaga(id); err != nil {
+				log.Printf("Error resuming checkout saga %d: %v", id, err)
+			}
+		}
+	}
+}
+
+// runCheckoutSaga advances a saga as far as it can go. It stops when the saga
+// finishes or a step has to wait for a retry; the resumer continues from there.
+func (a *App) runCheckoutSaga(sagaID int) error {
+	ctx := context.Background()
+
+	// Take a lease so only one worker drives the saga at a time
+	result, err := a.DB.Exec(ctx,
+		`UPDATE checkout_sagas SET locked_until = $1 WHERE id = $2 AND status IN ($3, $4)
+		AND (locked_until IS NULL OR locked_until < NOW())`,
+		time.Now().Add(SAGA_LEASE_DURATION), sagaID, SAGA_RUNNING, SAGA_COMPENSATING)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return nil
+	}
+	defer func() {
+		if _, err := a.DB.Exec(ctx, "UPDATE checkout_sagas SET locked_until = NULL WHERE id = $1", sagaID); err != nil {
+			log.Printf("Error releasing lease on checkout saga %d: %v", sagaID, err)
+		}
+	}()
+
+	saga, err := a.fetchCheckoutSaga(sagaID)
+	if err != nil {
+		return err
+	}
+
+	if saga.Status == SAGA_RUNNING {
+		if err := a.runSagaSteps(&saga); err != nil {
+			return err
+		}
+	}
+	if saga.Status == SAGA_COMPENSATING {
+		return a.compensateSaga(&saga)
+	}
+	return nil
+}
+
+// runSagaSteps executes the pending steps in order
+func (a *App) runSagaSteps(saga *CheckoutSaga) error {
+	ctx := context.Background()
+
+	for i, step := range checkoutSteps {
+		if saga.Steps[i].Status == STEP_COMPLETED {
+			continue
+		}
+
+		// Bound each attempt so a hung service cannot stall the saga
+		stepCtx, cancel := context.WithTimeout(ctx, SAGA_STEP_TIMEOUT)
+		stepErr := step.run(a, stepCtx, saga)
+		cancel()
+		attempts := saga.Steps[i].Attempts + 1
+
+		if stepErr == nil {
+			if err := a.updateSagaStep(saga.ID, step.name, STEP_COMPLETED, attempts, nil); err != nil {
+				return err
+			}
+			saga.Steps[i].Status = STEP_COMPLETED
+			continue
+		}
+
+		message := stepErr.Error()
+		var permanentErr *permanentError
+		if errors.As(stepErr, &permanentErr) || (!step.retryForever && attempts >= SAGA_MAX_ATTEMPTS) {
+			log.Printf("Checkout saga %d failed at %s: %s", saga.ID, step.name, message)
+			if err := a.updateSagaStep(saga.ID, step.name, STEP_FAILED, attempts, &message); err != nil {
+				return err
+			}
+			saga.Steps[i].Status = STEP_FAILED
+			saga.Status = SAGA_COMPENSATING
+			saga.Error = &message
+			_, err := a.DB.Exec(ctx,
+				"UPDATE checkout_sagas SET status = $1, error = $2, updated_at = NOW() WHERE id = $3",
+				saga.Status, message, saga.ID)
+			return err
+		}
+
+		// Transient failure: keep the step pending and let the resumer try again later
+		log.Printf("Checkout saga %d step %s will be retried: %s", saga.ID, step.name, message)
+		if err := a.updateSagaStep(saga.ID, step.name, STEP_PENDING, attempts, &message); err != nil {
+			return err
+		}
+		saga.NextAttemptAt = time.Now().Add(sagaBackoff(attempts))
+		_, err := a.DB.Exec(ctx,
+			"UPDATE checkout_sagas SET next_attempt_at = $1, updated_at = NOW() WHERE id = $2",
+			saga.NextAttemptAt, saga.ID)
+		return err
+	}
+
+	saga.Status = SAGA_COMPLETED
+	_, err := a.DB.Exec(ctx,
+		"UPDATE checkout_sagas SET status = $1, error = NULL, updated_at = NOW() WHERE id = $2",
+		saga.Status, saga.ID)
+	if err == nil {
+		log.Printf("Checkout saga %d completed with order %d", saga.ID, *saga.OrderID)
+	}
+	return err
+}
+
+// compensateSaga undoes completed steps in reverse order. The failed step is
+// compensated as well because its outcome may not be known (e.g. a timeout).
+func (a *App) compensateSaga(saga *CheckoutSaga) error {
+	ctx := context.Background()
+
+	for i := len(checkoutSteps) - 1; i >= 0; i-- {
+		step := checkoutSteps[i]
+		state := saga.Steps[i]
+		if step.compensate == nil || (state.Status != STEP_COMPLETED && state.Status != STEP_FAILED) {
+			continue
+		}
+
+		stepCtx, cancel := context.WithTimeout(ctx, SAGA_STEP_TIMEOUT)
+		err := step.compensate(a, stepCtx, saga)
+		cancel()
+		if err != nil {
+			// Compensations must eventually succeed, so they are retried without a limit
+			message := fmt.Sprintf("compensation failed: %v", err)
+			log.Printf("Checkout saga %d step %s %s", saga.ID, step.name, message)
+			saga.NextAttemptAt = time.Now().Add(SAGA_MAX_BACKOFF)
+			_, dbErr := a.DB.Exec(ctx,
+				"UPDATE checkout_sagas SET next_attempt_at = $1, updated_at = NOW() WHERE id = $2",
+				saga.NextAttemptAt, saga.ID)
+			return dbErr
+		}
+
+		if err := a.updateSagaStep(saga.ID, step.name, STEP_COMPENSATED, state.Attempts, state.Error); err != nil {
+			return err
+		}
+		saga.Steps[i].Status = STEP_COMPENSATED
+	}
+
+	saga.Status = SAGA_FAILED
+	_, err := a.DB.Exec(ctx,
+		"UPDATE checkout_sagas SET status = $1, updated_at = NOW() WHERE id = $2",
+		saga.Status, saga.ID)
+	return err
+}
+
+// updateSagaStep records the outcome of a step
+func (a *App) updateSagaStep(sagaID int, name, status string, attempts int, stepErr *string) error {
+	_, err := a.DB.Exec(context.Background(),
+		"UPDATE checkout_saga_steps SET status = $1, attempts = $2, error = $3, updated_at = NOW() WHERE saga_id = $4 AND name = $5",
+		status, attempts, stepErr, sagaID, name)
+	return err
+}
+
+// sagaValidateUser checks that the user placing the order exists and has verified their email address
+func (a *App) sagaValidateUser(ctx context.Context, saga *CheckoutSaga) error {
+	user, err := a.Users.GetUser(ctx, saga.UserID)
+	if errors.Is(err, clients.ErrNotFound) {
+		return permanent("User does not exist")
+	}
+	if err != nil {
+		return fmt.Errorf("error verifying user: %v", err)
+	}
+	if user.VerifiedAt == nil {
+		return permanent(ERR_EMAIL_NOT_VERIFIED)
+	}
+	return nil
+}
+
+// sagaReserveStock holds stock for the cart items in the Product Service
+func (a *App) sagaReserveStock(ctx context.Context, saga *CheckoutSaga) error {
+	reservation := models.ReservationRequest{
+		Reference:  sagaReservationRef(saga.ID),
+		Items:      make([]models.ReservationItem, 0, len(saga.Items)),
+		TTLSeconds: SAGA_RESERVATION_TTL,
+	}
+	for _, item := range saga.Items {
+		reservation.Items = append(reservation.Items, models.ReservationItem{
+			ProductID: item.ProductID,
+			VariantID: item.VariantID,
+			Quantity:  item.Quantity,
+		})
+	}
+
+	_, err := a.Products.Reserve(ctx, reservation)
+	if err == nil {
+		return nil
+	}
+
+	var unavailable *clients.StockUnavailableError
+	if errors.As(err, &unavailable) || clients.IsClientError(err) {
+		return permanent("Unable to reserve stock: %v", err)
+	}
+	return fmt.Errorf("error reserving stock: %v", err)
+}
+
+// sagaReleaseStock gives back the stock held for the checkout
+func (a *App) sagaReleaseStock(ctx context.Context, saga *CheckoutSaga) error {
+	if err := a.Products.ReleaseReservations(ctx, sagaReservationRef(saga.ID)); err != nil {
+		return fmt.Errorf("error releasing stock: %v", err)
+	}
+	return nil
+}
+
+// sagaCreateOrder places the order against the stock reserved for the checkout
+func (a *App) sagaCreateOrder(ctx context.Context, saga *CheckoutSaga) error {
+	orderRequest := models.OrderRequest{
+		UserID:          saga.UserID,
+		Items:           make([]models.OrderItemInput, 0, len(saga.Items)),
+		ShippingAddress: saga.ShippingAddress,
+		BillingAddress:  saga.BillingAddress,
+		ReservationRef:  sagaReservationRef(saga.ID),
+	}
+	for _, item := range saga.Items {
+		orderRequest.Items = append(orderRequest.Items, models.OrderItemInput{
+			ProductID: item.ProductID,
+			VariantID: item.VariantID,
+			Quantity:  item.Quantity,
+		})
+	}
+
+	order, err := a.Orders.CreateOrder(ctx, orderRequest)
+	if clients.IsClientError(err) {
+		return permanent("Error creating order: %v", err)
+	}
+	if err != nil {
+		return fmt.Errorf("error creating order: %v", err)
+	}
+
+	orderJSON, err := json.Marshal(order)
+	if err != nil {
+		return fmt.Errorf("error serializing order: %v", err)
+	}
+
+	_, err = a.DB.Exec(ctx,
+		"UPDATE checkout_sagas SET order_id = $1, order_response = $2, updated_at = NOW() WHERE id = $3",
+		order.ID, orderJSON, saga.ID)
+	if err != nil {
+		return err
+	}
+	saga.OrderID = &order.ID
+	saga.Order = orderJSON
+
+	return nil
+}
+
+// sagaClearCart removes the checked out cart
+func (a *App) sagaClearCart(ctx context.Context, saga *CheckoutSaga) error {
+	tx, err := a.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "DELETE FROM cart_items WHERE cart_id = $1", saga.CartID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM carts WHERE id = $1", saga.CartID); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// sagaEmitEvents publishes the checkout event. It may be published more than
+// once if the service crashes right after publishing.
+func (a *App) sagaEmitEvents(ctx context.Context, saga *CheckoutSaga) error {
+	event := CartEvent{
+		EventType: "checkout",
+		CartID:    saga.CartID,
+		UserID:    &saga.UserID,
+		SessionID: saga.SessionID,
+		EventTime: time.Now(),
+	}
+	if _, err := messages.CartEvents.Encode(event); err != nil {
+		return permanent("Error serializing cart event: %v", err)
+	}
+
+	return messages.CartEvents.Publish(ctx, a.RabbitCh, event)
+}
+
+// fetchCheckoutSaga loads a saga with its steps
+func (a *App) fetchCheckoutSaga(sagaID int) (CheckoutSaga, error) {
+	var saga CheckoutSaga
+	var itemsJSON []byte
+	var order []byte
+	err := a.DB.QueryRow(context.Background(),
+		`SELECT id, cart_id, user_id, session_id, status, items, shipping_address, billing_address, COALESCE(payment_method, ''),
+		order_id, order_response, error, next_attempt_at, created_at, updated_at FROM checkout_sagas WHERE id = $1`,
+		sagaID).Scan(&saga.ID, &saga.CartID, &saga.UserID, &saga.SessionID, &saga.Status, &itemsJSON,
+		&saga.ShippingAddress, &saga.BillingAddress, &saga.PaymentMethod, &saga.OrderID, &order, &saga.Error, &saga.NextAttemptAt,
+		&saga.CreatedAt, &saga.UpdatedAt)
+	if err != nil {
+		return saga, err
+	}
+	if err := json.Unmarshal(itemsJSON, &saga.Items); err != nil {
+		return saga, fmt.Errorf("error parsing saga items: %v", err)
+	}
+	if order != nil {
+		saga.Order = order
+	}
+
+	rows, err := a.DB.Query(context.Background(),
+		"SELECT name, status, attempts, error, updated_at FROM checkout_saga_steps WHERE saga_id = $1 ORDER BY position",
+		sagaID)
+	if err != nil {
+		return saga, err
+	}
+	defer rows.Close()
+
+	saga.Steps = []SagaStep{}
+	for rows.Next() {
+		var step SagaStep
+		if err := rows.Scan(&step.Name, &step.Status, &step.Attempts, &step.Error, &step.UpdatedAt); err != nil {
+			return saga, err
+		}
+		saga.Steps = append(saga.Steps, step)
+	}
+	if err := rows.Err(); err != nil {
+		return saga, err
+	}
+
+	if len(saga.Steps) != len(checkoutSteps) {
+		return saga, fmt.Errorf("saga %d has %d steps, expected %d", sagaID, len(saga.Steps), len(checkoutSteps))
+	}
+
+	return saga, nil
+}
+
+// isUniqueViolation reports whether an error was caused by a unique constraint
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+// getSaga returns the progress of a checkout saga
+func (a *App) getSaga(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		web.RespondWithError(w, http.StatusBadRequest, "Invalid saga ID")
+		return
+	}
+
+	saga, err := a.fetchCheckoutSaga(id)
+	if err == pgx.ErrNoRows {
+		web.RespondWithError(w, http.StatusNotFound, "Saga not found")
+		return
+	}
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if !auth.AuthorizeUser(w, r, saga.UserID, auth.PERM_CARTS_MANAGE) {
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, saga)
+}
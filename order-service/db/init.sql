@@ -4,10 +4,15 @@ CREATE TABLE IF NOT EXISTS orders (
                                       user_id INTEGER NOT NULL,
                                       total_price DECIMAL(10, 2) NOT NULL,
     status VARCHAR(50) NOT NULL,
+    reservation_ref VARCHAR(100) UNIQUE, -- Stock reservation held for the order in the Product Service
     created_at TIMESTAMP NOT NULL,
     updated_at TIMESTAMP NOT NULL
     );
 
+-- Copies of the addresses the order was placed with, as JSON
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS shipping_address JSONB;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS billing_address JSONB;
+
 -- Create order items table
 CREATE TABLE IF NOT EXISTS order_items (
                                            id SERIAL PRIMARY KEY,
@@ -18,10 +23,59 @@ CREATE TABLE IF NOT EXISTS order_items (
     FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
     );
 
+-- The product variant ordered and its SKU at the time; NULL for items ordered before products had variants
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS variant_id INTEGER;
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS sku VARCHAR(64);
+
+-- Create outbox table for events published to RabbitMQ by the relay
+CREATE TABLE IF NOT EXISTS outbox_events (
+    id BIGSERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL,
+    queue VARCHAR(100) NOT NULL,
+    payload JSONB NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    created_at TIMESTAMP NOT NULL,
+    published_at TIMESTAMP,
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+    );
+
+-- Create order status history table
+CREATE TABLE IF NOT EXISTS order_status_history (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL,
+    from_status VARCHAR(50), -- NULL when the order was created
+    to_status VARCHAR(50) NOT NULL,
+    changed_by VARCHAR(100),
+    reason TEXT,
+    changed_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+    );
+
+-- Create idempotency keys table for replaying responses to retried requests
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    scope VARCHAR(100) NOT NULL,
+    key VARCHAR(255) NOT NULL,
+    request_hash CHAR(64) NOT NULL,
+    status VARCHAR(20) NOT NULL, -- in_progress, completed
+    response_code INTEGER,
+    response_body BYTEA,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (scope, key)
+    );
+
 -- Create indexes for faster lookups
 CREATE INDEX IF NOT EXISTS idx_orders_user_id ON orders(user_id);
 CREATE INDEX IF NOT EXISTS idx_order_items_order_id ON order_items(order_id);
 CREATE INDEX IF NOT EXISTS idx_order_items_product_id ON order_items(product_id);
+CREATE INDEX IF NOT EXISTS idx_outbox_events_order_id ON outbox_events(order_id);
+CREATE INDEX IF NOT EXISTS idx_outbox_events_pending ON outbox_events(id) WHERE published_at IS NULL;
+
+-- Set while a relay is publishing an event; an expired claim can be taken over
+ALTER TABLE outbox_events ADD COLUMN IF NOT EXISTS claimed_until TIMESTAMP;
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at ON idempotency_keys(expires_at);
+CREATE INDEX IF NOT EXISTS idx_order_status_history_order_id ON order_status_history(order_id);
 
 -- Insert sample data
 INSERT INTO orders (user_id, total_price, status, created_at, updated_at)
@@ -31,10 +85,25 @@ VALUES
     (2, 2249.98, 'shipped', NOW() - INTERVAL '3 days', NOW() - INTERVAL '1 day'),
     (3, 799.99, 'pending', NOW(), NOW());
 
-INSERT INTO order_items (order_id, product_id, quantity, price)
+INSERT INTO order_items (order_id, product_id, variant_id, sku, quantity, price)
+VALUES
+    (1, 2, 2, 'SKU-2', 1, 1499.99),
+    (2, 3, 3, 'SKU-3', 1, 199.99),
+    (3, 1, 1, 'SKU-1', 1, 999.99),
+    (3, 2, 2, 'SKU-2', 1, 1249.99),
+    (4, 5, 5, 'SKU-5', 1, 799.99);
+
+INSERT INTO order_status_history (order_id, from_status, to_status, reason, changed_at)
 VALUES
-    (1, 2, 1, 1499.99),
-    (2, 3, 1, 199.99),
-    (3, 1, 1, 999.99),
-    (3, 2, 1, 1249.99),
-    (4, 5, 1, 799.99);
\ No newline at end of file
+    (1, NULL, 'pending', 'Order created', NOW() - INTERVAL '15 days'),
+    (1, 'pending', 'processing', NULL, NOW() - INTERVAL '14 days'),
+    (1, 'processing', 'shipped', NULL, NOW() - INTERVAL '12 days'),
+    (1, 'shipped', 'delivered', NULL, NOW() - INTERVAL '10 days'),
+    (2, NULL, 'pending', 'Order created', NOW() - INTERVAL '7 days'),
+    (2, 'pending', 'processing', NULL, NOW() - INTERVAL '6 days'),
+    (2, 'processing', 'shipped', NULL, NOW() - INTERVAL '6 days'),
+    (2, 'shipped', 'delivered', NULL, NOW() - INTERVAL '5 days'),
+    (3, NULL, 'pending', 'Order created', NOW() - INTERVAL '3 days'),
+    (3, 'pending', 'processing', NULL, NOW() - INTERVAL '2 days'),
+    (3, 'processing', 'shipped', NULL, NOW() - INTERVAL '1 day'),
+    (4, NULL, 'pending', 'Order created', NOW());
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"log"
+	"net/http"
+	"pkg-iae/messages"
+	"pkg-iae/web"
+	"time"
+)
+
+const (
+	OUTBOX_POLL_INTERVAL   = 2 * time.Second
+	OUTBOX_BATCH_SIZE      = 100
+	OUTBOX_CONFIRM_TIMEOUT = 5 * time.Second
+	// OUTBOX_LEASE is how long a claimed batch is left to one relay; it outlasts a
+	// batch of publishes that all wait out their confirm
+	OUTBOX_LEASE = 10 * time.Minute
+)
+
+// OutboxEvent represents a message stored in the outbox waiting to be relayed to RabbitMQ
+type OutboxEvent struct {
+	ID          int64           `json:"id"`
+	OrderID     int             `json:"order_id"`
+	Queue       string          `json:"queue"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts"`
+	LastError   *string         `json:"last_error,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	PublishedAt *time.Time      `json:"published_at"`
+}
+
+// newEventID returns a random identifier consumers use to deduplicate messages
+func newEventID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand never fails on supported platforms; fall back to a time-based ID just in case
+		return fmt.Sprintf("evt-%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// enqueueOutboxEvent validates a message and writes it to the outbox as part of the caller's transaction
+func enqueueOutboxEvent[T any](tx pgx.Tx, orderID int, queue messages.Queue[T], payload T) error {
+	body, err := queue.Encode(payload)
+	if err != nil {
+		return fmt.Errorf("unable to serialize outbox payload: %v", err)
+	}
+
+	_, err = tx.Exec(context.Background(),
+		"INSERT INTO outbox_events (order_id, queue, payload, created_at) VALUES ($1, $2, $3, NOW())",
+		orderID, queue.Name, body)
+	if err != nil {
+		return fmt.Errorf("unable to write outbox event: %v", err)
+	}
+
+	return nil
+}
+
+// notifyOutbox wakes the relay so freshly committed events go out without waiting for the next poll
+func (a *App) notifyOutbox() {
+	select {
+	case a.outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+// relayOutbox periodically publishes pending outbox events to RabbitMQ
+func (a *App) relayOutbox() {
+	ticker := time.NewTicker(OUTBOX_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-a.outboxWake:
+		}
+
+		for {
+			published, err := a.publishPendingOutbox()
+			if err != nil {
+				log.Printf("Error relaying outbox events: %v", err)
+				break
+			}
+			if published < OUTBOX_BATCH_SIZE {
+				break
+			}
+		}
+	}
+}
+
+// ensureOutboxChannel (re)opens the confirm-mode channel used by the relay
+func (a *App) ensureOutboxChannel() error {
+	if a.outboxCh != nil && !a.outboxCh.IsClosed() {
+		return nil
+	}
+
+	if a.outboxConn == nil || a.outboxConn.IsClosed() {
+		conn, err := amqp.Dial(a.Config.RabbitMQURI)
+		if err != nil {
+			return fmt.Errorf("failed to connect to RabbitMQ: %v", err)
+		}
+		a.outboxConn = conn
+	}
+
+	ch, err := a.outboxConn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open a channel: %v", err)
+	}
+
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return fmt.Errorf("failed to enable publisher confirms: %v", err)
+	}
+
+	a.outboxCh = ch
+	return nil
+}
+
+// closeOutbox closes the relay's RabbitMQ connection on shutdown
+func (a *App) closeOutbox() {
+	if a.outboxConn != nil && !a.outboxConn.IsClosed() {
+		if err := a.outboxConn.Close(); err != nil {
+			log.Printf("Error closing outbox RabbitMQ connection: %v", err)
+		}
+	}
+}
+
+// publishPendingOutbox publishes one batch of pending events and marks the confirmed ones as sent.
+// Events are published in insertion order and the batch stops at the first failure so that
+// consumers never see a later event for an order before an earlier one. The batch is claimed
+// by setting claimed_until, so no transaction stays open while waiting for the broker; the
+// claim on events left unpublished is released for the next poll.
+func (a *App) publishPendingOutbox() (int, error) {
+	if err := a.ensureOutboxChannel(); err != nil {
+		return 0, err
+	}
+
+	ctx := context.Background()
+	rows, err := a.DB.Query(ctx, `
+        WITH claimed AS (
+            UPDATE outbox_events SET claimed_until = $1
+            WHERE id IN (
+                SELECT id FROM outbox_events
+                WHERE published_at IS NULL AND (claimed_until IS NULL OR claimed_until <= NOW())
+                ORDER BY id
+                LIMIT $2
+                FOR UPDATE SKIP LOCKED
+            )
+            RETURNING id, queue, payload
+        )
+        SELECT id, queue, payload FROM claimed ORDER BY id`,
+		time.Now().Add(OUTBOX_LEASE), OUTBOX_BATCH_SIZE)
+	if err != nil {
+		return 0, err
+	}
+
+	events := []OutboxEvent{}
+	for rows.Next() {
+		var e OutboxEvent
+		if err := rows.Scan(&e.ID, &e.Queue, &e.Payload); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		events = append(events, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	published := 0
+	var publishErr error
+	for _, e := range events {
+		if publishErr = a.publishOutboxEvent(ctx, e); publishErr != nil {
+			_, err = a.DB.Exec(ctx,
+				"UPDATE outbox_events SET attempts = attempts + 1, last_error = $1 WHERE id = $2",
+				publishErr.Error(), e.ID)
+			if err != nil {
+				log.Printf("Error recording failed outbox event %d: %v", e.ID, err)
+			}
+			break
+		}
+
+		_, err = a.DB.Exec(ctx,
+			"UPDATE outbox_events SET attempts = attempts + 1, last_error = NULL, published_at = NOW(), claimed_until = NULL WHERE id = $1",
+			e.ID)
+		if err != nil {
+			// The event goes out again once the claim runs out, and consumers drop the duplicate
+			log.Printf("Error marking outbox event %d as sent: %v", e.ID, err)
+			publishErr = err
+			break
+		}
+		published++
+	}
+
+	if published < len(events) {
+		unpublished := []int64{}
+		for _, e := range events[published:] {
+			unpublished = append(unpublished, e.ID)
+		}
+		if _, err := a.DB.Exec(ctx,
+			"UPDATE outbox_events SET claimed_until = NULL WHERE id = ANY($1) AND published_at IS NULL",
+			unpublished); err != nil {
+			log.Printf("Error releasing outbox events: %v", err)
+		}
+	}
+
+	if published > 0 {
+		log.Printf("Relayed %d outbox events", published)
+	}
+
+	return published, publishErr
+}
+
+// publishOutboxEvent publishes a single event and waits for the broker to confirm it
+func (a *App) publishOutboxEvent(ctx context.Context, e OutboxEvent) error {
+	confirmation, err := a.outboxCh.PublishWithDeferredConfirmWithContext(ctx,
+		"",      // exchange
+		e.Queue, // routing key
+		false,   // mandatory
+		false,   // immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			MessageId:    fmt.Sprintf("order-outbox-%d", e.ID),
+			Body:         e.Payload,
+		})
+	if err != nil {
+		return err
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, OUTBOX_CONFIRM_TIMEOUT)
+	defer cancel()
+
+	acked, err := confirmation.WaitContext(waitCtx)
+	if err != nil {
+		// The channel state is unknown after a missed confirm, so start over with a fresh one
+		a.outboxCh.Close()
+		return fmt.Errorf("timed out waiting for publisher confirm: %v", err)
+	}
+	if !acked {
+		return fmt.Errorf("broker nacked message")
+	}
+
+	return nil
+}
+
+// getOrderEvents returns the outbox events recorded for an order
+func (a *App) getOrderEvents(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	rows, err := a.DB.Query(context.Background(),
+		"SELECT id, order_id, queue, payload, attempts, last_error, created_at, published_at FROM outbox_events WHERE order_id = $1 ORDER BY id",
+		id)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	events := []OutboxEvent{}
+	for rows.Next() {
+		var e OutboxEvent
+		if err := rows.Scan(&e.ID, &e.OrderID, &e.Queue, &e.Payload, &e.Attempts, &e.LastError,
+			&e.CreatedAt, &e.PublishedAt); err != nil {
+			web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		events = append(events, e)
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, events)
+}
+
+// replayOrderEvents marks every outbox event of an order as pending so the relay publishes them again
+func (a *App) replayOrderEvents(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	var exists bool
+	err := a.DB.QueryRow(context.Background(), "SELECT EXISTS(SELECT 1 FROM orders WHERE id = $1)", id).Scan(&exists)
+	if err != nil || !exists {
+		web.RespondWithError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+
+	result, err := a.DB.Exec(context.Background(),
+		"UPDATE outbox_events SET published_at = NULL, last_error = NULL WHERE order_id = $1",
+		id)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	a.notifyOutbox()
+
+	web.RespondWithJSON(w, http.StatusAccepted, map[string]interface{}{
+		"result":   "success",
+		"replayed": result.RowsAffected(),
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+	"net/http"
+	"pkg-iae/auth"
+	"pkg-iae/web"
+	"strconv"
+)
+
+// UserExport is the part of a user's data export held by the Order Service
+type UserExport struct {
+	Orders []Order `json:"orders"`
+}
+
+// exportUserData returns everything the Order Service holds about a user
+func (a *App) exportUserData(w http.ResponseWriter, r *http.Request) {
+	userID := web.ParseInt(mux.Vars(r)["user_id"])
+
+	if !auth.AuthorizeUser(w, r, userID, auth.PERM_PRIVACY_MANAGE) {
+		return
+	}
+
+	rows, err := a.DB.Query(r.Context(),
+		"SELECT id, user_id, total_price, status, shipping_address, billing_address, created_at, updated_at FROM orders WHERE user_id = $1 ORDER BY id",
+		userID)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	export := UserExport{Orders: []Order{}}
+	for rows.Next() {
+		var o Order
+		if err := rows.Scan(&o.ID, &o.UserID, &o.TotalPrice, &o.Status, &o.ShippingAddress, &o.BillingAddress,
+			&o.CreatedAt, &o.UpdatedAt); err != nil {
+			web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		export.Orders = append(export.Orders, o)
+	}
+	rows.Close()
+
+	if err := a.attachOrderItems(r.Context(), export.Orders); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, export)
+}
+
+// eraseUserData anonymizes a deleted user's orders. The orders themselves are
+// kept for bookkeeping, but lose the addresses they were placed with, and the
+// stored responses of the user's requests are dropped.
+func eraseUserData(ctx context.Context, tx pgx.Tx, userID int) error {
+	_, err := tx.Exec(ctx, `
+        UPDATE orders SET shipping_address = NULL, billing_address = NULL, updated_at = NOW()
+        WHERE user_id = $1 AND (shipping_address IS NOT NULL OR billing_address IS NOT NULL)`,
+		userID)
+	if err != nil {
+		return err
+	}
+
+	// Keys are scoped per caller, see service.App.WithIdempotency
+	_, err = tx.Exec(ctx, "DELETE FROM idempotency_keys WHERE scope LIKE $1",
+		"%:user:"+strconv.Itoa(userID))
+	return err
+}
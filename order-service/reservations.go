@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"pkg-iae/models"
+)
+
+// orderReservationRef returns the reference stock is reserved under for an order placed directly
+func orderReservationRef(orderID int) string {
+	return fmt.Sprintf("order-%d", orderID)
+}
+
+// reserveStock holds stock for all items of an order in the Product Service.
+// It returns a *clients.StockUnavailableError when some items cannot be reserved.
+func (a *App) reserveStock(ctx context.Context, reference string, items []OrderItem) error {
+	reservation := models.ReservationRequest{
+		Reference: reference,
+		Items:     make([]models.ReservationItem, 0, len(items)),
+	}
+	for _, item := range items {
+		reservation.Items = append(reservation.Items, models.ReservationItem{
+			ProductID: item.ProductID,
+			VariantID: *item.VariantID,
+			Quantity:  item.Quantity,
+		})
+	}
+
+	_, err := a.Products.Reserve(ctx, reservation)
+	return err
+}
+
+// releaseStock gives back stock held for an order that was not placed.
+// Failures are only logged since the Product Service expires reservations on its own.
+func (a *App) releaseStock(reference string) {
+	// The request may already be cancelled, but the stock should still be given back
+	if err := a.Products.ReleaseReservations(context.Background(), reference); err != nil {
+		log.Printf("Error releasing stock reserved under %s: %v", reference, err)
+	}
+}
+
+// hasActiveReservation reports whether the Product Service still holds stock under a reference
+func (a *App) hasActiveReservation(ctx context.Context, reference string) (bool, error) {
+	reservations, err := a.Products.GetReservations(ctx, reference)
+	if err != nil {
+		return false, fmt.Errorf("error fetching reservations: %v", err)
+	}
+
+	for _, res := range reservations {
+		if res.Status == "reserved" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
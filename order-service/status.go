@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+	"net/http"
+	"pkg-iae/auth"
+	"pkg-iae/web"
+	"time"
+)
+
+const (
+	ORDER_PENDING    = "pending"
+	ORDER_PROCESSING = "processing"
+	ORDER_SHIPPED    = "shipped"
+	ORDER_DELIVERED  = "delivered"
+	ORDER_CANCELLED  = "cancelled"
+	ORDER_RETURNED   = "returned"
+	ORDER_REFUNDED   = "refunded"
+)
+
+// orderTransitions lists the statuses an order may move to from each status.
+// Orders can only be cancelled before they ship; after that they are returned.
+var orderTransitions = map[string][]string{
+	ORDER_PENDING:    {ORDER_PROCESSING, ORDER_CANCELLED},
+	ORDER_PROCESSING: {ORDER_SHIPPED, ORDER_CANCELLED},
+	ORDER_SHIPPED:    {ORDER_DELIVERED, ORDER_RETURNED},
+	ORDER_DELIVERED:  {ORDER_RETURNED, ORDER_REFUNDED},
+	ORDER_RETURNED:   {ORDER_REFUNDED},
+	ORDER_CANCELLED:  {ORDER_REFUNDED},
+	ORDER_REFUNDED:   {},
+}
+
+// OrderStatusChange represents a recorded transition of an order's status
+type OrderStatusChange struct {
+	ID         int       `json:"id"`
+	OrderID    int       `json:"order_id"`
+	FromStatus *string   `json:"from_status"`
+	ToStatus   string    `json:"to_status"`
+	ChangedBy  *string   `json:"changed_by,omitempty"`
+	Reason     *string   `json:"reason,omitempty"`
+	ChangedAt  time.Time `json:"changed_at"`
+}
+
+// StatusUpdateRequest represents a request to move an order to a new status
+type StatusUpdateRequest struct {
+	Status    string `json:"status"`
+	ChangedBy string `json:"changed_by,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// isKnownOrderStatus reports whether a status is part of the order state machine
+func isKnownOrderStatus(status string) bool {
+	_, ok := orderTransitions[status]
+	return ok
+}
+
+// canTransition reports whether an order may move from one status to another
+func canTransition(from, to string) bool {
+	for _, next := range orderTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// nullIfEmpty stores optional text columns as NULL instead of an empty string
+func nullIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// recordStatusChange adds a transition to the order's status history as part of the caller's transaction
+func recordStatusChange(tx pgx.Tx, orderID int, from *string, to, changedBy, reason string) error {
+	_, err := tx.Exec(context.Background(),
+		"INSERT INTO order_status_history (order_id, from_status, to_status, changed_by, reason, changed_at) VALUES ($1, $2, $3, $4, $5, NOW())",
+		orderID, from, to, nullIfEmpty(changedBy), nullIfEmpty(reason))
+	if err != nil {
+		return fmt.Errorf("unable to record status change: %v", err)
+	}
+	return nil
+}
+
+// respondWithIllegalTransition rejects a status change the state machine does not allow
+func respondWithIllegalTransition(w http.ResponseWriter, from, to string) {
+	web.RespondWithJSON(w, http.StatusConflict, map[string]interface{}{
+		"error":            fmt.Sprintf("Cannot change order status from %s to %s", from, to),
+		"current_status":   from,
+		"allowed_statuses": orderTransitions[from],
+	})
+}
+
+// getOrderHistory returns the status transitions of an order, oldest first
+func (a *App) getOrderHistory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	var ownerID int
+	err := a.DB.QueryRow(context.Background(), "SELECT user_id FROM orders WHERE id = $1", id).Scan(&ownerID)
+	if err != nil {
+		web.RespondWithError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+
+	if !auth.AuthorizeUser(w, r, ownerID, auth.PERM_ORDERS_READ) {
+		return
+	}
+
+	rows, err := a.DB.Query(context.Background(),
+		"SELECT id, order_id, from_status, to_status, changed_by, reason, changed_at FROM order_status_history WHERE order_id = $1 ORDER BY changed_at, id",
+		id)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	history := []OrderStatusChange{}
+	for rows.Next() {
+		var c OrderStatusChange
+		if err := rows.Scan(&c.ID, &c.OrderID, &c.FromStatus, &c.ToStatus, &c.ChangedBy, &c.Reason, &c.ChangedAt); err != nil {
+			web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		history = append(history, c)
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, history)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+var allOrderStatuses = []string{
+	ORDER_PENDING, ORDER_PROCESSING, ORDER_SHIPPED, ORDER_DELIVERED,
+	ORDER_CANCELLED, ORDER_RETURNED, ORDER_REFUNDED,
+}
+
+func TestCanTransition(t *testing.T) {
+	// Every allowed transition; any other pair of statuses must be rejected
+	allowed := map[[2]string]bool{
+		{ORDER_PENDING, ORDER_PROCESSING}:   true,
+		{ORDER_PENDING, ORDER_CANCELLED}:    true,
+		{ORDER_PROCESSING, ORDER_SHIPPED}:   true,
+		{ORDER_PROCESSING, ORDER_CANCELLED}: true,
+		{ORDER_SHIPPED, ORDER_DELIVERED}:    true,
+		{ORDER_SHIPPED, ORDER_RETURNED}:     true,
+		{ORDER_DELIVERED, ORDER_RETURNED}:   true,
+		{ORDER_DELIVERED, ORDER_REFUNDED}:   true,
+		{ORDER_RETURNED, ORDER_REFUNDED}:    true,
+		{ORDER_CANCELLED, ORDER_REFUNDED}:   true,
+	}
+
+	for _, from := range allOrderStatuses {
+		for _, to := range allOrderStatuses {
+			want := allowed[[2]string{from, to}]
+			if got := canTransition(from, to); got != want {
+				t.Errorf("canTransition(%s, %s) = %v, want %v", from, to, got, want)
+			}
+		}
+	}
+}
+
+func TestCanTransitionUnknownStatuses(t *testing.T) {
+	tests := []struct {
+		from, to string
+	}{
+		{"", ORDER_PROCESSING},
+		{ORDER_PENDING, ""},
+		{"archived", ORDER_REFUNDED},
+		{ORDER_PENDING, "PROCESSING"},
+	}
+
+	for _, tt := range tests {
+		if canTransition(tt.from, tt.to) {
+			t.Errorf("canTransition(%q, %q) = true, want false", tt.from, tt.to)
+		}
+	}
+}
+
+func TestOrderTransitionsAreClosed(t *testing.T) {
+	for _, status := range allOrderStatuses {
+		if !isKnownOrderStatus(status) {
+			t.Errorf("isKnownOrderStatus(%s) = false, want true", status)
+		}
+	}
+	if len(orderTransitions) != len(allOrderStatuses) {
+		t.Errorf("orderTransitions has %d statuses, want %d", len(orderTransitions), len(allOrderStatuses))
+	}
+
+	for from, targets := range orderTransitions {
+		for _, to := range targets {
+			if !isKnownOrderStatus(to) {
+				t.Errorf("%s may move to unknown status %s", from, to)
+			}
+			if to == from {
+				t.Errorf("%s may move to itself", from)
+			}
+		}
+	}
+
+	if len(orderTransitions[ORDER_REFUNDED]) != 0 {
+		t.Errorf("refunded orders may move to %v, want a final status", orderTransitions[ORDER_REFUNDED])
+	}
+}
+
+func TestRespondWithIllegalTransition(t *testing.T) {
+	w := httptest.NewRecorder()
+	respondWithIllegalTransition(w, ORDER_SHIPPED, ORDER_CANCELLED)
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusConflict)
+	}
+
+	var body struct {
+		CurrentStatus   string   `json:"current_status"`
+		AllowedStatuses []string `json:"allowed_statuses"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("unable to parse response: %v", err)
+	}
+	if body.CurrentStatus != ORDER_SHIPPED {
+		t.Errorf("current_status = %q, want %q", body.CurrentStatus, ORDER_SHIPPED)
+	}
+	if want := []string{ORDER_DELIVERED, ORDER_RETURNED}; !reflect.DeepEqual(body.AllowedStatuses, want) {
+		t.Errorf("allowed_statuses = %v, want %v", body.AllowedStatuses, want)
+	}
+}
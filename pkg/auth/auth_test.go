@@ -0,0 +1,274 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"github.com/golang-jwt/jwt/v5"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testIssuer = "user-service"
+
+// testKey signs tokens for a verifier that trusts it
+func testKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// signToken signs claims with key, naming the key by its key ID
+func signToken(t *testing.T, key *rsa.PrivateKey, claims Claims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = KeyID(&key.PublicKey)
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// validClaims returns claims that pass verification
+func validClaims() Claims {
+	now := time.Now()
+	return Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    testIssuer,
+			Subject:   "42",
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(15 * time.Minute)),
+		},
+		Username:    "john_doe",
+		Roles:       []string{"customer"},
+		Permissions: []string{PERM_ORDERS_READ},
+	}
+}
+
+func TestVerify(t *testing.T) {
+	key := testKey(t)
+	otherKey := testKey(t)
+	verifier, err := NewLocalVerifier(JWKS{Keys: []JWK{NewJWK(&key.PublicKey)}}, testIssuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   func() string
+		wantErr bool
+	}{
+		{
+			name:  "valid token",
+			token: func() string { return signToken(t, key, validClaims()) },
+		},
+		{
+			name: "expired within the clock skew",
+			token: func() string {
+				c := validClaims()
+				c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-CLOCK_SKEW / 2))
+				return signToken(t, key, c)
+			},
+		},
+		{
+			name: "expired",
+			token: func() string {
+				c := validClaims()
+				c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+				return signToken(t, key, c)
+			},
+			wantErr: true,
+		},
+		{
+			name: "without expiry",
+			token: func() string {
+				c := validClaims()
+				c.ExpiresAt = nil
+				return signToken(t, key, c)
+			},
+			wantErr: true,
+		},
+		{
+			name: "other issuer",
+			token: func() string {
+				c := validClaims()
+				c.Issuer = "someone-else"
+				return signToken(t, key, c)
+			},
+			wantErr: true,
+		},
+		{
+			name:    "unknown key",
+			token:   func() string { return signToken(t, otherKey, validClaims()) },
+			wantErr: true,
+		},
+		{
+			name: "signed by another key under a known key ID",
+			token: func() string {
+				token := jwt.NewWithClaims(jwt.SigningMethodRS256, validClaims())
+				token.Header["kid"] = KeyID(&key.PublicKey)
+				signed, _ := token.SignedString(otherKey)
+				return signed
+			},
+			wantErr: true,
+		},
+		{
+			name: "HMAC signed with the public key",
+			token: func() string {
+				token := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims())
+				token.Header["kid"] = KeyID(&key.PublicKey)
+				signed, _ := token.SignedString(key.PublicKey.N.Bytes())
+				return signed
+			},
+			wantErr: true,
+		},
+		{
+			name: "unsigned",
+			token: func() string {
+				signed, _ := jwt.NewWithClaims(jwt.SigningMethodNone, validClaims()).SignedString(jwt.UnsafeAllowNoneSignatureType)
+				return signed
+			},
+			wantErr: true,
+		},
+		{
+			name:    "malformed",
+			token:   func() string { return "not.a.token" },
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := verifier.Verify(t.Context(), tt.token())
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidToken) {
+					t.Errorf("Verify error = %v, want ErrInvalidToken", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if claims.Subject != "42" || claims.Username != "john_doe" {
+				t.Errorf("claims = %+v, want subject 42 and username john_doe", claims)
+			}
+		})
+	}
+}
+
+func TestNewPrincipal(t *testing.T) {
+	tests := []struct {
+		name        string
+		subject     string
+		roles       []string
+		wantUserID  int
+		wantService string
+		wantErr     bool
+	}{
+		{name: "user", subject: "42", roles: []string{"customer"}, wantUserID: 42},
+		{name: "service", subject: "cart-service", roles: []string{ROLE_SERVICE}, wantService: "cart-service"},
+		{name: "service without subject", subject: "", roles: []string{ROLE_SERVICE}, wantErr: true},
+		{name: "user with non-numeric subject", subject: "cart-service", wantErr: true},
+		{name: "user with zero ID", subject: "0", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := &Claims{RegisteredClaims: jwt.RegisteredClaims{Subject: tt.subject}, Roles: tt.roles}
+			p, err := newPrincipal(claims)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("newPrincipal = %+v, want an error", p)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newPrincipal: %v", err)
+			}
+			if p.UserID != tt.wantUserID || p.Service != tt.wantService {
+				t.Errorf("principal = %+v, want user %d service %q", p, tt.wantUserID, tt.wantService)
+			}
+		})
+	}
+}
+
+func TestCanActFor(t *testing.T) {
+	user := &Principal{UserID: 42}
+	admin := &Principal{UserID: 1, Permissions: []string{PERM_ORDERS_READ}}
+	// A service's user ID is zero, so it must never match a user by ID
+	service := &Principal{Service: "cart-service"}
+	trustedService := &Principal{Service: "cart-service", Permissions: []string{PERM_ORDERS_READ}}
+
+	tests := []struct {
+		name      string
+		principal *Principal
+		userID    int
+		want      bool
+	}{
+		{"own resource", user, 42, true},
+		{"someone else's resource", user, 7, false},
+		{"permission over everyone's", admin, 7, true},
+		{"service without permission", service, 0, false},
+		{"service with permission", trustedService, 7, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.principal.CanActFor(tt.userID, PERM_ORDERS_READ); got != tt.want {
+				t.Errorf("CanActFor(%d) = %v, want %v", tt.userID, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	key := testKey(t)
+	verifier, err := NewLocalVerifier(JWKS{Keys: []JWK{NewJWK(&key.PublicKey)}}, testIssuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+		wantStatus    int
+		wantUserID    int // Zero for anonymous
+	}{
+		{"anonymous", "", http.StatusOK, 0},
+		{"valid token", "Bearer " + signToken(t, key, validClaims()), http.StatusOK, 42},
+		{"not a bearer token", "Basic dXNlcjpwYXNz", http.StatusUnauthorized, 0},
+		{"empty bearer token", "Bearer ", http.StatusUnauthorized, 0},
+		{"invalid token", "Bearer not.a.token", http.StatusUnauthorized, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotUserID int
+			handler := Middleware(verifier)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if p := PrincipalFrom(r.Context()); p != nil {
+					gotUserID = p.UserID
+				}
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, "/orders", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if gotUserID != tt.wantUserID {
+				t.Errorf("user ID = %d, want %d", gotUserID, tt.wantUserID)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TOKEN_RENEW_BEFORE is how long before expiry a service token is replaced
+const TOKEN_RENEW_BEFORE = 1 * time.Minute
+
+// Options configures how a service verifies access tokens and authenticates
+// its own calls to other services. It can be embedded in a service Config.
+type Options struct {
+	Issuer       string        `env:"AUTH_ISSUER" required:"true" default:"user-service"`
+	JWKSCacheTTL time.Duration `env:"AUTH_JWKS_CACHE_TTL" default:"5m"`
+	ClientID     string        `env:"AUTH_CLIENT_ID" required:"true"`
+	ClientSecret string        `env:"AUTH_CLIENT_SECRET" required:"true" secret:"true"`
+}
+
+// Validate checks that the options can be used
+func (o Options) Validate() error {
+	if o.JWKSCacheTTL <= 0 {
+		return fmt.Errorf("AUTH_JWKS_CACHE_TTL must be positive")
+	}
+	return nil
+}
+
+// ServiceTokenRequest is the body of the User Service's POST /auth/token
+type ServiceTokenRequest struct {
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+}
+
+// ServiceTokenResponse is returned by POST /auth/token
+type ServiceTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// ClientCredentials gets service tokens from the User Service with a client ID
+// and secret, caching each token until shortly before it expires
+type ClientCredentials struct {
+	tokenURL string
+	request  ServiceTokenRequest
+	http     *http.Client
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+// NewClientCredentials returns a token source for the User Service at userServiceURL
+func NewClientCredentials(userServiceURL string, opts Options) *ClientCredentials {
+	return &ClientCredentials{
+		tokenURL: strings.TrimRight(userServiceURL, "/") + "/auth/token",
+		request:  ServiceTokenRequest{ClientID: opts.ClientID, ClientSecret: opts.ClientSecret},
+		http:     &http.Client{Timeout: JWKS_FETCH_TIMEOUT},
+	}
+}
+
+// Token returns a valid service token, fetching a new one when needed
+func (c *ClientCredentials) Token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && time.Until(c.expiresAt) > TOKEN_RENEW_BEFORE {
+		return c.token, nil
+	}
+
+	body, _ := json.Marshal(c.request)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.tokenURL, bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("unable to request service token: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("unable to request service token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return "", fmt.Errorf("service token request returned %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+
+	var token ServiceTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("unable to parse service token: %v", err)
+	}
+
+	c.token = token.AccessToken
+	c.expiresAt = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return c.token, nil
+}
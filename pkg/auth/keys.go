@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+)
+
+// GENERATED_KEY_BITS is the size of RSA keys generated when no key file exists
+const GENERATED_KEY_BITS = 2048
+
+// LoadPrivateKey reads an RSA private key from a PEM file in PKCS #1 or PKCS #8 form
+func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s does not hold an RSA private key: %v", path, err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s holds a %T, not an RSA private key", path, parsed)
+	}
+	return key, nil
+}
+
+// LoadOrCreatePrivateKey reads an RSA private key from path. If the file does not
+// exist a new key is generated and written there, so a development setup needs
+// no key management. The second result reports whether the key was generated.
+func LoadOrCreatePrivateKey(path string) (*rsa.PrivateKey, bool, error) {
+	key, err := LoadPrivateKey(path)
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return key, false, err
+	}
+
+	key, err = rsa.GenerateKey(rand.Reader, GENERATED_KEY_BITS)
+	if err != nil {
+		return nil, false, fmt.Errorf("unable to generate signing key: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, false, fmt.Errorf("unable to create key directory: %v", err)
+	}
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		return nil, false, fmt.Errorf("unable to write signing key: %v", err)
+	}
+	return key, true, nil
+}
+
+// LoadPublicKey reads an RSA public key from a PEM file in PKIX or PKCS #1 form.
+// A private key file is accepted too, and its public half returned.
+func LoadPublicKey(path string) (*rsa.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if parsed, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		key, ok := parsed.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%s holds a %T, not an RSA public key", path, parsed)
+		}
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	private, err := LoadPrivateKey(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s does not hold an RSA key", path)
+	}
+	return &private.PublicKey, nil
+}
+
+// KeyID returns the RFC 7638 thumbprint of a public key, used as its kid
+func KeyID(key *rsa.PublicKey) string {
+	// The members must be in lexicographic order, without whitespace
+	thumbprint := fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`,
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		base64.RawURLEncoding.EncodeToString(key.N.Bytes()))
+	sum := sha256.Sum256([]byte(thumbprint))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read key file: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", path)
+	}
+	return block, nil
+}
@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"pkg-iae/web"
+	"strconv"
+	"strings"
+)
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	UserID      int    // Zero for services
+	Username    string // Empty for services
+	Service     string // Client ID of a calling service, empty for users
+	Roles       []string
+	Permissions []string
+}
+
+// Subject identifies the principal in logs and per-caller keys, e.g. "user:42"
+// or "service:cart-service"
+func (p *Principal) Subject() string {
+	if p.IsService() {
+		return "service:" + p.Service
+	}
+	return "user:" + strconv.Itoa(p.UserID)
+}
+
+// Can reports whether the principal was granted a permission
+func (p *Principal) Can(permission string) bool {
+	for _, granted := range p.Permissions {
+		if granted == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// IsService reports whether the principal is another service
+func (p *Principal) IsService() bool {
+	return p.Service != ""
+}
+
+// CanActFor reports whether the principal may touch resources owned by a user:
+// the user themselves, or callers granted the permission over everyone's
+func (p *Principal) CanActFor(userID int, permission string) bool {
+	return (!p.IsService() && p.UserID == userID) || p.Can(permission)
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a context carrying the principal
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFrom returns the principal of a request, or nil if it is anonymous
+func PrincipalFrom(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// newPrincipal builds the principal a verified token stands for
+func newPrincipal(claims *Claims) (*Principal, error) {
+	p := &Principal{Roles: claims.Roles, Permissions: claims.Permissions}
+	if claims.HasRole(ROLE_SERVICE) {
+		if claims.Subject == "" {
+			return nil, errors.New("service token without a subject")
+		}
+		p.Service = claims.Subject
+		return p, nil
+	}
+
+	id, err := claims.UserID()
+	if err != nil {
+		return nil, err
+	}
+	p.UserID = id
+	p.Username = claims.Username
+	return p, nil
+}
+
+// Middleware authenticates requests carrying an "Authorization: Bearer" header
+// and puts the principal in the request context. Requests without the header
+// pass through anonymously, so public routes keep working; routes that need a
+// caller are wrapped with Required, RequirePermission or check the principal themselves.
+// A header with an invalid token is rejected with 401 rather than ignored.
+func Middleware(v *Verifier) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := r.Header.Get("Authorization")
+			if header == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+			if token == header || token == "" {
+				unauthorized(w, "Authorization header must be a Bearer token")
+				return
+			}
+
+			claims, err := v.Verify(r.Context(), token)
+			if err != nil {
+				if !errors.Is(err, ErrInvalidToken) {
+					log.Printf("Error verifying access token: %v", err)
+					web.RespondWithError(w, http.StatusServiceUnavailable, "Unable to verify access token")
+					return
+				}
+				unauthorized(w, "Invalid or expired access token")
+				return
+			}
+
+			principal, err := newPrincipal(claims)
+			if err != nil {
+				unauthorized(w, "Invalid or expired access token")
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), principal)))
+		})
+	}
+}
+
+// Required rejects anonymous requests with 401
+func Required(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if PrincipalFrom(r.Context()) == nil {
+			unauthorized(w, "Authentication required")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// RequirePermission declares the permission a route needs. It rejects
+// anonymous requests with 401 and callers without the permission with 403.
+func RequirePermission(permission string, next http.HandlerFunc) http.HandlerFunc {
+	return Required(func(w http.ResponseWriter, r *http.Request) {
+		if !PrincipalFrom(r.Context()).Can(permission) {
+			forbidden(w, permission)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// AuthorizeUser checks that the caller may act for a user: the user, or a
+// caller with the permission. It responds with 401 or 403 and returns false if not.
+func AuthorizeUser(w http.ResponseWriter, r *http.Request, userID int, permission string) bool {
+	p := PrincipalFrom(r.Context())
+	if p == nil {
+		unauthorized(w, "Authentication required")
+		return false
+	}
+	if !p.CanActFor(userID, permission) {
+		forbidden(w, permission)
+		return false
+	}
+	return true
+}
+
+// forbidden responds with 403 naming the missing permission
+func forbidden(w http.ResponseWriter, permission string) {
+	web.RespondWithError(w, http.StatusForbidden, "Forbidden: requires the "+permission+" permission")
+}
+
+// unauthorized responds with 401 and a Bearer challenge
+func unauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+	web.RespondWithError(w, http.StatusUnauthorized, message)
+}
@@ -0,0 +1,21 @@
+package auth
+
+// Permissions granted through roles. Owners never need a permission to touch
+// their own resources; permissions let a caller touch everyone's. The names
+// must match the permissions table of the User Service.
+const (
+	PERM_USERS_READ          = "users:read"
+	PERM_USERS_WRITE         = "users:write"
+	PERM_ROLES_MANAGE        = "roles:manage"
+	PERM_PRODUCTS_WRITE      = "products:write"
+	PERM_CATEGORIES_WRITE    = "categories:write"
+	PERM_INVENTORY_WRITE     = "inventory:write"
+	PERM_REVIEWS_MODERATE    = "reviews:moderate"
+	PERM_RESERVATIONS_MANAGE = "reservations:manage"
+	PERM_ORDERS_READ         = "orders:read"
+	PERM_ORDERS_WRITE        = "orders:write"
+	PERM_ORDERS_MANAGE       = "orders:manage"
+	PERM_CARTS_MANAGE        = "carts:manage"
+	PERM_ANALYTICS_READ      = "analytics:read"
+	PERM_PRIVACY_MANAGE      = "privacy:manage"
+)
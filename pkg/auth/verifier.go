@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// JWKS_FETCH_TIMEOUT bounds a fetch of the key set
+	JWKS_FETCH_TIMEOUT = 5 * time.Second
+	// JWKS_MIN_REFRESH_INTERVAL limits refetches caused by tokens with unknown key IDs
+	JWKS_MIN_REFRESH_INTERVAL = 30 * time.Second
+	// CLOCK_SKEW is how far token times may be off from the local clock
+	CLOCK_SKEW = 30 * time.Second
+)
+
+// ErrInvalidToken is returned for tokens that are malformed, expired or not signed by a known key
+var ErrInvalidToken = errors.New("invalid token")
+
+// Verifier checks access tokens against the User Service's public keys. Keys
+// are fetched from the JWKS URL, cached for a TTL and refetched early when a
+// token names a key that is not cached, which is how key rotation is picked up.
+type Verifier struct {
+	issuer  string
+	jwksURL string
+	ttl     time.Duration
+	http    *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+// NewVerifier returns a verifier of tokens from issuer, with keys fetched from jwksURL
+func NewVerifier(jwksURL, issuer string, ttl time.Duration) *Verifier {
+	return &Verifier{
+		issuer:  issuer,
+		jwksURL: jwksURL,
+		ttl:     ttl,
+		http:    &http.Client{Timeout: JWKS_FETCH_TIMEOUT},
+		keys:    map[string]*rsa.PublicKey{},
+	}
+}
+
+// NewLocalVerifier returns a verifier with a fixed key set, for the service that signs the tokens
+func NewLocalVerifier(jwks JWKS, issuer string) (*Verifier, error) {
+	keys, err := decodeKeys(jwks)
+	if err != nil {
+		return nil, err
+	}
+	return &Verifier{issuer: issuer, keys: keys}, nil
+}
+
+// Verify checks a token's signature, issuer and lifetime and returns its claims.
+// Failures wrap ErrInvalidToken unless the key set could not be fetched.
+func (v *Verifier) Verify(ctx context.Context, token string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return v.key(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{ALGORITHM}),
+		jwt.WithIssuer(v.issuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(CLOCK_SKEW),
+	)
+	if err != nil {
+		var fetchErr *jwksFetchError
+		if errors.As(err, &fetchErr) {
+			return nil, fetchErr
+		}
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	return claims, nil
+}
+
+// key returns the public key with the given ID, refreshing the key set if it
+// is stale or does not have the key
+func (v *Verifier) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.jwksURL != "" {
+		_, known := v.keys[kid]
+		stale := time.Since(v.fetchedAt) > v.ttl
+		if stale || (!known && time.Since(v.fetchedAt) > JWKS_MIN_REFRESH_INTERVAL) {
+			if err := v.refresh(ctx); err != nil && len(v.keys) == 0 {
+				return nil, err
+			}
+		}
+	}
+
+	key, ok := v.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+// refresh fetches the key set. On failure the cached keys are kept, so a User
+// Service outage does not lock everyone out while the keys are still valid.
+func (v *Verifier) refresh(ctx context.Context) error {
+	// Failed fetches also count, so an unreachable User Service is not retried on every request
+	v.fetchedAt = time.Now()
+
+	ctx, cancel := context.WithTimeout(ctx, JWKS_FETCH_TIMEOUT)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.jwksURL, nil)
+	if err != nil {
+		return &jwksFetchError{err}
+	}
+	resp, err := v.http.Do(req)
+	if err != nil {
+		return &jwksFetchError{err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &jwksFetchError{fmt.Errorf("status %d", resp.StatusCode)}
+	}
+
+	var jwks JWKS
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&jwks); err != nil {
+		return &jwksFetchError{err}
+	}
+
+	keys, err := decodeKeys(jwks)
+	if err != nil {
+		return &jwksFetchError{err}
+	}
+
+	v.keys = keys
+	return nil
+}
+
+// decodeKeys indexes the keys of a key set by their ID
+func decodeKeys(jwks JWKS) (map[string]*rsa.PublicKey, error) {
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		key, err := jwk.PublicKey()
+		if err != nil {
+			return nil, err
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+// jwksFetchError is a failure to get the key set, as opposed to a bad token
+type jwksFetchError struct {
+	err error
+}
+
+func (e *jwksFetchError) Error() string {
+	return fmt.Sprintf("unable to fetch JWKS: %v", e.err)
+}
+
+func (e *jwksFetchError) Unwrap() error {
+	return e.err
+}
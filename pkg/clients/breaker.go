@@ -0,0 +1,107 @@
+package clients
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	BREAKER_CLOSED    = "closed"
+	BREAKER_OPEN      = "open"
+	BREAKER_HALF_OPEN = "half_open"
+)
+
+// CircuitBreaker stops calls to a downstream service after repeated failures.
+// Once the cooldown has passed a single probe call is let through: if it succeeds
+// the breaker closes again, otherwise it stays open for another cooldown.
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     string
+	failures  int
+	openedAt  time.Time
+	probing   bool
+}
+
+// NewCircuitBreaker returns a closed breaker that opens after threshold consecutive failures
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     BREAKER_CLOSED,
+	}
+}
+
+// Allow reports whether a call may be made now
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BREAKER_OPEN:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = BREAKER_HALF_OPEN
+		b.probing = true
+		return true
+	case BREAKER_HALF_OPEN:
+		// Only one probe at a time
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// Success records a call that reached a healthy service
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = BREAKER_CLOSED
+	b.failures = 0
+	b.probing = false
+}
+
+// Failure records a call that failed because the service was unreachable or broken
+func (b *CircuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if b.state == BREAKER_HALF_OPEN {
+		b.state = BREAKER_OPEN
+		b.openedAt = time.Now()
+		return
+	}
+
+	b.failures++
+	if b.state == BREAKER_CLOSED && b.failures >= b.threshold {
+		b.state = BREAKER_OPEN
+		b.openedAt = time.Now()
+	}
+}
+
+// Cancel records a call abandoned by the caller, which says nothing about the service
+func (b *CircuitBreaker) Cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
+
+// State returns closed, open or half_open
+func (b *CircuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BREAKER_OPEN && time.Since(b.openedAt) >= b.cooldown {
+		return BREAKER_HALF_OPEN
+	}
+	return b.state
+}
@@ -0,0 +1,11 @@
+package clients
+
+// CartClient calls the Cart Service
+type CartClient struct {
+	*client
+}
+
+// NewCartClient returns a client for the Cart Service at baseURL, authenticated with tokens
+func NewCartClient(baseURL string, opts Options, tokens TokenSource) *CartClient {
+	return &CartClient{newClient("Cart Service", baseURL, opts, tokens)}
+}
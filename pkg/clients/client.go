@@ -0,0 +1,316 @@
+// Package clients provides typed HTTP clients for calls between services.
+//
+// Every call runs under the caller's context with a per-attempt timeout. GET
+// requests are idempotent and are retried with jittered exponential backoff
+// when the service is unreachable or answers with a 5xx or 429. Each client has
+// its own circuit breaker, so a failing downstream service is not hammered
+// and callers fail fast with ErrCircuitOpen while it recovers. Calls carry the
+// calling service's own access token when the client has a TokenSource.
+package clients
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"pkg-iae/web"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MAX_RESPONSE_SIZE caps how much of a response body is read
+const MAX_RESPONSE_SIZE = 10 << 20
+
+var (
+	// ErrNotFound is returned when the service answers 404
+	ErrNotFound = errors.New("not found")
+	// ErrCircuitOpen is returned without making a call while the service's breaker is open
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+)
+
+// Options configures a client. It can be embedded in a service Config.
+type Options struct {
+	Timeout          time.Duration `env:"HTTP_CLIENT_TIMEOUT" default:"5s"`
+	MaxRetries       int           `env:"HTTP_CLIENT_MAX_RETRIES" default:"2"`
+	RetryBackoff     time.Duration `env:"HTTP_CLIENT_RETRY_BACKOFF" default:"100ms"`
+	BreakerThreshold int           `env:"HTTP_CLIENT_BREAKER_THRESHOLD" default:"5"`
+	BreakerCooldown  time.Duration `env:"HTTP_CLIENT_BREAKER_COOLDOWN" default:"30s"`
+}
+
+// Validate checks that the options can be used
+func (o Options) Validate() error {
+	if o.Timeout <= 0 {
+		return fmt.Errorf("HTTP_CLIENT_TIMEOUT must be positive")
+	}
+	if o.MaxRetries < 0 {
+		return fmt.Errorf("HTTP_CLIENT_MAX_RETRIES must not be negative")
+	}
+	if o.RetryBackoff <= 0 {
+		return fmt.Errorf("HTTP_CLIENT_RETRY_BACKOFF must be positive")
+	}
+	if o.BreakerThreshold < 1 {
+		return fmt.Errorf("HTTP_CLIENT_BREAKER_THRESHOLD must be at least 1")
+	}
+	if o.BreakerCooldown <= 0 {
+		return fmt.Errorf("HTTP_CLIENT_BREAKER_COOLDOWN must be positive")
+	}
+	return nil
+}
+
+// StatusError is returned when the service answers with a 4xx or 5xx status
+type StatusError struct {
+	Service    string
+	StatusCode int
+	Message    string // The "error" field of the response, or the raw body
+	Body       []byte
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s returned %d: %s", e.Service, e.StatusCode, e.Message)
+}
+
+// Is lets errors.Is(err, ErrNotFound) match 404 responses
+func (e *StatusError) Is(target error) bool {
+	return target == ErrNotFound && e.StatusCode == http.StatusNotFound
+}
+
+// IsClientError reports whether err is a 4xx answer, which retrying will not change
+func IsClientError(err error) bool {
+	var statusErr *StatusError
+	return errors.As(err, &statusErr) && statusErr.StatusCode >= 400 && statusErr.StatusCode < 500
+}
+
+// TokenSource supplies the bearer token sent with each call
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// client holds what the typed clients share
+type client struct {
+	service string
+	baseURL string
+	http    *http.Client
+	opts    Options
+	tokens  TokenSource
+	breaker *CircuitBreaker
+}
+
+func newClient(service, baseURL string, opts Options, tokens TokenSource) *client {
+	return &client{
+		service: service,
+		baseURL: strings.TrimRight(baseURL, "/"),
+		http:    &http.Client{},
+		opts:    opts,
+		tokens:  tokens,
+		breaker: NewCircuitBreaker(opts.BreakerThreshold, opts.BreakerCooldown),
+	}
+}
+
+// BreakerState returns the state of the client's circuit breaker
+func (c *client) BreakerState() string {
+	return c.breaker.State()
+}
+
+// Health calls the service's /health endpoint once, without retries
+func (c *client) Health(ctx context.Context) error {
+	return c.do(ctx, http.MethodGet, "/health", nil, nil, false)
+}
+
+// ExportUserData fetches the data the service holds about a user, as the
+// document its GET /users/{id}/export endpoint returns
+func (c *client) ExportUserData(ctx context.Context, userID int) (json.RawMessage, error) {
+	var data json.RawMessage
+	err := c.get(ctx, fmt.Sprintf("/users/%d/export", userID), &data)
+	return data, err
+}
+
+// get fetches path into out, retrying transient failures
+func (c *client) get(ctx context.Context, path string, out interface{}) error {
+	return c.do(ctx, http.MethodGet, path, nil, out, true)
+}
+
+// send makes a single non-idempotent call with an optional JSON body
+func (c *client) send(ctx context.Context, method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		body, err = json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("unable to serialize %s request: %v", c.service, err)
+		}
+	}
+	return c.do(ctx, method, path, body, out, false)
+}
+
+// do makes the call, retrying it if allowed and the failure is transient
+func (c *client) do(ctx context.Context, method, path string, body []byte, out interface{}, retry bool) error {
+	attempts := 1
+	if retry {
+		attempts += c.opts.MaxRetries
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := c.attempt(ctx, method, path, body, out)
+		if err == nil || attempt >= attempts || !isRetryable(err) {
+			return err
+		}
+
+		select {
+		case <-time.After(c.backoff(attempt)):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// attempt makes one call through the circuit breaker
+func (c *client) attempt(ctx context.Context, method, path string, body []byte, out interface{}) error {
+	if !c.breaker.Allow() {
+		return fmt.Errorf("%s: %w", c.service, ErrCircuitOpen)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		c.breaker.Cancel()
+		return fmt.Errorf("unable to build %s request: %v", c.service, err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.tokens != nil {
+		token, err := c.tokens.Token(ctx)
+		if err != nil {
+			c.breaker.Cancel()
+			return &transportError{service: c.service, err: err}
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		if ctx.Err() == context.Canceled {
+			c.breaker.Cancel()
+		} else {
+			c.breaker.Failure()
+		}
+		return &transportError{service: c.service, err: err}
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_RESPONSE_SIZE))
+	if err != nil {
+		c.breaker.Failure()
+		return &transportError{service: c.service, err: err}
+	}
+
+	if resp.StatusCode >= 500 {
+		c.breaker.Failure()
+	} else {
+		c.breaker.Success()
+	}
+
+	if resp.StatusCode >= 400 {
+		return &StatusError{
+			Service:    c.service,
+			StatusCode: resp.StatusCode,
+			Message:    errorMessage(data),
+			Body:       data,
+		}
+	}
+
+	if out != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("unable to parse %s response: %v", c.service, err)
+		}
+	}
+	return nil
+}
+
+// backoff returns the delay before the next attempt: exponential with full jitter
+func (c *client) backoff(attempt int) time.Duration {
+	max := c.opts.RetryBackoff << uint(attempt-1)
+	return time.Duration(rand.Int63n(int64(max) + 1))
+}
+
+// listPage is one page of a list endpoint, see web.ListResponse
+type listPage[T any] struct {
+	Data       []T     `json:"data"`
+	NextCursor *string `json:"next_cursor"`
+}
+
+// getAll fetches every page of a list endpoint, following next_cursor
+func getAll[T any](ctx context.Context, c *client, path string, query url.Values) ([]T, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("limit", strconv.Itoa(web.MAX_LIST_LIMIT))
+
+	all := []T{}
+	for {
+		var page listPage[T]
+		if err := c.get(ctx, path+"?"+query.Encode(), &page); err != nil {
+			return all, err
+		}
+		all = append(all, page.Data...)
+
+		if page.NextCursor == nil {
+			return all, nil
+		}
+		query.Set("cursor", *page.NextCursor)
+	}
+}
+
+// transportError is a call that got no usable response
+type transportError struct {
+	service string
+	err     error
+}
+
+func (e *transportError) Error() string {
+	return fmt.Sprintf("unable to contact %s: %v", e.service, e.err)
+}
+
+func (e *transportError) Unwrap() error {
+	return e.err
+}
+
+// isRetryable reports whether another attempt could succeed
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var transportErr *transportError
+	if errors.As(err, &transportErr) {
+		return true
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+
+	return false
+}
+
+// errorMessage extracts the message from a {"error": "..."} body
+func errorMessage(body []byte) string {
+	var payload struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &payload) == nil && payload.Error != "" {
+		return payload.Error
+	}
+	return strings.TrimSpace(string(body))
+}
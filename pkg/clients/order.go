@@ -0,0 +1,33 @@
+package clients
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"pkg-iae/models"
+)
+
+// OrderClient calls the Order Service
+type OrderClient struct {
+	*client
+}
+
+// NewOrderClient returns a client for the Order Service at baseURL, authenticated with tokens
+func NewOrderClient(baseURL string, opts Options, tokens TokenSource) *OrderClient {
+	return &OrderClient{newClient("Order Service", baseURL, opts, tokens)}
+}
+
+// CreateOrder places an order. The call is not retried here; requests carrying a
+// reservation reference are idempotent, so callers that set one may retry it.
+func (c *OrderClient) CreateOrder(ctx context.Context, req models.OrderRequest) (models.Order, error) {
+	var order models.Order
+	err := c.send(ctx, http.MethodPost, "/orders", req, &order)
+	return order, err
+}
+
+// GetProductSales fetches the units sold of every product that sold over the last days
+func (c *OrderClient) GetProductSales(ctx context.Context, days int) ([]models.ProductSales, error) {
+	sales := []models.ProductSales{}
+	err := c.get(ctx, fmt.Sprintf("/analytics/product-sales?days=%d", days), &sales)
+	return sales, err
+}
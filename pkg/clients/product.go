@@ -0,0 +1,137 @@
+package clients
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"pkg-iae/models"
+	"strconv"
+	"strings"
+)
+
+// PRODUCT_BATCH_SIZE is the most IDs the Product Service accepts in one batch lookup
+const PRODUCT_BATCH_SIZE = 100
+
+// ProductClient calls the Product Service
+type ProductClient struct {
+	*client
+}
+
+// NewProductClient returns a client for the Product Service at baseURL, authenticated with tokens
+func NewProductClient(baseURL string, opts Options, tokens TokenSource) *ProductClient {
+	return &ProductClient{newClient("Product Service", baseURL, opts, tokens)}
+}
+
+// StockUnavailableError is returned when the Product Service cannot hold stock for every item
+type StockUnavailableError struct {
+	Items []models.UnavailableItem `json:"items"`
+}
+
+func (e *StockUnavailableError) Error() string {
+	message := "The following errors occurred while reserving stock for your order:\n"
+	for _, item := range e.Items {
+		message += fmt.Sprintf("- Product %d (variant %d): %s (requested %d, available %d)\n",
+			item.ProductID, item.VariantID, item.Reason, item.Requested, item.Available)
+	}
+	return message
+}
+
+// GetProduct fetches a product, returning an error matching ErrNotFound if it does not exist
+func (c *ProductClient) GetProduct(ctx context.Context, id int) (models.Product, error) {
+	var product models.Product
+	err := c.get(ctx, fmt.Sprintf("/products/%d", id), &product)
+	return product, err
+}
+
+// GetProductSummaries fetches compact summaries of many products with as few calls as
+// possible. Products that do not exist are missing from the returned map.
+func (c *ProductClient) GetProductSummaries(ctx context.Context, ids []int) (map[int]models.ProductSummary, error) {
+	summaries := map[int]models.ProductSummary{}
+
+	for _, batchIDs := range idBatches(ids) {
+		batch := []models.ProductSummary{}
+		query := url.Values{"ids": {batchIDs}}
+		if err := c.get(ctx, "/products?"+query.Encode(), &batch); err != nil {
+			return summaries, err
+		}
+		for _, summary := range batch {
+			summaries[summary.ID] = summary
+		}
+	}
+
+	return summaries, nil
+}
+
+// GetVariantSummaries fetches compact summaries of many product variants with as few
+// calls as possible. Variants that do not exist are missing from the returned map.
+func (c *ProductClient) GetVariantSummaries(ctx context.Context, ids []int) (map[int]models.VariantSummary, error) {
+	summaries := map[int]models.VariantSummary{}
+
+	for _, batchIDs := range idBatches(ids) {
+		batch := []models.VariantSummary{}
+		query := url.Values{"ids": {batchIDs}}
+		if err := c.get(ctx, "/variants?"+query.Encode(), &batch); err != nil {
+			return summaries, err
+		}
+		for _, summary := range batch {
+			summaries[summary.ID] = summary
+		}
+	}
+
+	return summaries, nil
+}
+
+// idBatches drops duplicate IDs and splits the rest into comma separated lists
+// of at most PRODUCT_BATCH_SIZE
+func idBatches(ids []int) []string {
+	unique := []string{}
+	seen := map[int]bool{}
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, strconv.Itoa(id))
+		}
+	}
+
+	batches := []string{}
+	for start := 0; start < len(unique); start += PRODUCT_BATCH_SIZE {
+		end := start + PRODUCT_BATCH_SIZE
+		if end > len(unique) {
+			end = len(unique)
+		}
+		batches = append(batches, strings.Join(unique[start:end], ","))
+	}
+	return batches
+}
+
+// Reserve holds stock for the request's items. It returns a *StockUnavailableError
+// when some items cannot be reserved. Reserving again under the same reference
+// returns the existing reservations, so the call is safe to repeat.
+func (c *ProductClient) Reserve(ctx context.Context, req models.ReservationRequest) ([]models.StockReservation, error) {
+	reservations := []models.StockReservation{}
+	err := c.send(ctx, http.MethodPost, "/reservations", req, &reservations)
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusConflict {
+		var unavailable StockUnavailableError
+		if json.Unmarshal(statusErr.Body, &unavailable) == nil && len(unavailable.Items) > 0 {
+			return nil, &unavailable
+		}
+	}
+	return reservations, err
+}
+
+// GetReservations fetches the reservations made under a reference
+func (c *ProductClient) GetReservations(ctx context.Context, reference string) ([]models.StockReservation, error) {
+	reservations := []models.StockReservation{}
+	err := c.get(ctx, "/reservations/"+url.PathEscape(reference), &reservations)
+	return reservations, err
+}
+
+// ReleaseReservations gives back the stock held under a reference
+func (c *ProductClient) ReleaseReservations(ctx context.Context, reference string) error {
+	return c.send(ctx, http.MethodPost, "/reservations/"+url.PathEscape(reference)+"/release", nil, nil)
+}
@@ -0,0 +1,45 @@
+package clients
+
+import (
+	"context"
+	"fmt"
+	"pkg-iae/messages"
+	"pkg-iae/models"
+)
+
+// UserClient calls the User Service
+type UserClient struct {
+	*client
+}
+
+// NewUserClient returns a client for the User Service at baseURL, authenticated with tokens
+func NewUserClient(baseURL string, opts Options, tokens TokenSource) *UserClient {
+	return &UserClient{newClient("User Service", baseURL, opts, tokens)}
+}
+
+// GetUser fetches a user, returning an error matching ErrNotFound if it does not exist
+func (c *UserClient) GetUser(ctx context.Context, id int) (models.User, error) {
+	var user models.User
+	err := c.get(ctx, fmt.Sprintf("/users/%d", id), &user)
+	return user, err
+}
+
+// GetOrderHistory fetches the whole order history the User Service keeps for a user, newest first
+func (c *UserClient) GetOrderHistory(ctx context.Context, userID int) ([]messages.OrderHistory, error) {
+	return getAll[messages.OrderHistory](ctx, c.client, fmt.Sprintf("/users/%d/orders", userID), nil)
+}
+
+// GetAddress fetches an entry of a user's address book, returning an error
+// matching ErrNotFound if the user has no such address
+func (c *UserClient) GetAddress(ctx context.Context, userID, addressID int) (models.UserAddress, error) {
+	var address models.UserAddress
+	err := c.get(ctx, fmt.Sprintf("/users/%d/addresses/%d", userID, addressID), &address)
+	return address, err
+}
+
+// GetAddresses fetches a user's address book
+func (c *UserClient) GetAddresses(ctx context.Context, userID int) ([]models.UserAddress, error) {
+	var addresses []models.UserAddress
+	err := c.get(ctx, fmt.Sprintf("/users/%d/addresses", userID), &addresses)
+	return addresses, err
+}
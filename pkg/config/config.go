@@ -0,0 +1,275 @@
+// Package config loads service configuration from defaults, an optional
+// YAML or JSON file and environment variables, in that order of precedence.
+//
+// Fields are described with struct tags:
+//
+//	env:"POSTGRES_URI"      variable name; the file key is the same name in lower case
+//	default:"..."           value used when neither the file nor the environment sets one
+//	required:"true"         the value must not be empty
+//	validate:"url"          the value must be an absolute URL
+//	validate:"port"         the value must be a TCP port number
+//	secret:"true"           the value is redacted when the configuration is logged
+//
+// Supported field types are string, bool, int, float64, time.Duration and []string
+// (comma separated). Nested structs are walked, so services can embed Base.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CONFIG_FILE_ENV names the environment variable pointing at an optional config file
+const CONFIG_FILE_ENV = "CONFIG_FILE"
+
+// Base holds the settings every service needs
+type Base struct {
+	Port        int    `env:"PORT" required:"true" validate:"port"`
+	PostgresURI string `env:"POSTGRES_URI" required:"true" validate:"url"`
+	RabbitMQURI string `env:"RABBITMQ_URI" required:"true" validate:"url"`
+}
+
+// Validator is implemented by configs that need checks beyond the struct tags
+type Validator interface {
+	Validate() error
+}
+
+// Load fills cfg, which must be a pointer to a struct, and validates the result
+func Load(cfg interface{}) error {
+	v := reflect.ValueOf(cfg)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("config: Load needs a pointer to a struct, got %T", cfg)
+	}
+
+	fileValues, err := readFile(os.Getenv(CONFIG_FILE_ENV))
+	if err != nil {
+		return err
+	}
+
+	errs := []string{}
+	walk(v.Elem(), func(field reflect.Value, tag reflect.StructTag) {
+		name := tag.Get("env")
+
+		raw, found := os.LookupEnv(name)
+		if !found {
+			raw, found = fileValues[strings.ToLower(name)]
+		}
+		if !found {
+			raw, found = tag.Lookup("default")
+		}
+		if found {
+			if err := setField(field, raw); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+				return
+			}
+		}
+
+		if msg := checkField(field, tag); msg != "" {
+			errs = append(errs, fmt.Sprintf("%s %s", name, msg))
+		}
+	})
+
+	if validator, ok := cfg.(Validator); ok && len(errs) == 0 {
+		if err := validator.Validate(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Dump logs the effective configuration with secrets and URL passwords redacted
+func Dump(service string, cfg interface{}) {
+	v := reflect.ValueOf(cfg)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+
+	lines := []string{}
+	walk(v, func(field reflect.Value, tag reflect.StructTag) {
+		lines = append(lines, fmt.Sprintf("  %s=%s", tag.Get("env"), displayValue(field, tag)))
+	})
+	sort.Strings(lines)
+
+	log.Printf("%s configuration:\n%s", service, strings.Join(lines, "\n"))
+}
+
+// walk calls fn for every field carrying an env tag, descending into nested structs
+func walk(v reflect.Value, fn func(field reflect.Value, tag reflect.StructTag)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		field := v.Field(i)
+		if sf.PkgPath != "" && !sf.Anonymous {
+			continue // unexported
+		}
+		if _, ok := sf.Tag.Lookup("env"); ok {
+			fn(field, sf.Tag)
+			continue
+		}
+		if field.Kind() == reflect.Struct && field.Type() != reflect.TypeOf(time.Time{}) {
+			walk(field, fn)
+		}
+	}
+}
+
+// readFile loads a flat YAML or JSON file of settings keyed by lower-case variable name
+func readFile(path string) (map[string]string, error) {
+	values := map[string]string{}
+	if path == "" {
+		return values, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file: %v", err)
+	}
+
+	raw := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(data, &raw)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("unsupported config file type %q, use .yaml, .yml or .json", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse config file %s: %v", path, err)
+	}
+
+	for key, value := range raw {
+		switch typed := value.(type) {
+		case []interface{}:
+			parts := make([]string, 0, len(typed))
+			for _, part := range typed {
+				parts = append(parts, fmt.Sprint(part))
+			}
+			values[strings.ToLower(key)] = strings.Join(parts, ",")
+		case float64:
+			// JSON numbers decode as float64; keep integers free of exponents
+			values[strings.ToLower(key)] = strconv.FormatFloat(typed, 'f', -1, 64)
+		default:
+			values[strings.ToLower(key)] = fmt.Sprint(value)
+		}
+	}
+	return values, nil
+}
+
+// setField parses raw into the field according to its type
+func setField(field reflect.Value, raw string) error {
+	raw = strings.TrimSpace(raw)
+
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", raw)
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", raw)
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", raw)
+		}
+		field.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", raw)
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported field type %s", field.Type())
+		}
+		parts := []string{}
+		for _, part := range strings.Split(raw, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				parts = append(parts, part)
+			}
+		}
+		field.Set(reflect.ValueOf(parts))
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+	return nil
+}
+
+// checkField applies the required and validate tags, returning a message when the value is invalid
+func checkField(field reflect.Value, tag reflect.StructTag) string {
+	if tag.Get("required") == "true" && field.IsZero() {
+		return "is required"
+	}
+
+	switch tag.Get("validate") {
+	case "url":
+		if field.Kind() == reflect.String && field.String() != "" {
+			u, err := url.Parse(field.String())
+			if err != nil || u.Scheme == "" || u.Host == "" {
+				return "must be an absolute URL"
+			}
+		}
+	case "port":
+		if field.Kind() == reflect.Int && (field.Int() < 1 || field.Int() > 65535) {
+			return "must be between 1 and 65535"
+		}
+	}
+
+	return ""
+}
+
+// displayValue formats a field for Dump
+func displayValue(field reflect.Value, tag reflect.StructTag) string {
+	if tag.Get("secret") == "true" {
+		if field.IsZero() {
+			return ""
+		}
+		return "[redacted]"
+	}
+
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		return time.Duration(field.Int()).String()
+	}
+
+	if field.Kind() == reflect.Slice {
+		parts := make([]string, field.Len())
+		for i := range parts {
+			parts[i] = field.Index(i).String()
+		}
+		return strings.Join(parts, ",")
+	}
+
+	if tag.Get("validate") == "url" {
+		if u, err := url.Parse(field.String()); err == nil {
+			return u.Redacted()
+		}
+	}
+
+	return fmt.Sprint(field.Interface())
+}
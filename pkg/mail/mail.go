@@ -0,0 +1,186 @@
+// Package mail sends outbound email. Services depend on the Mailer interface
+// and pick an implementation from configuration: SMTP in production, or a sink
+// that writes messages to a file or the log for local testing.
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DRIVER_SMTP = "smtp"
+	DRIVER_LOG  = "log"
+	// SEND_TIMEOUT bounds a whole SMTP conversation
+	SEND_TIMEOUT = 30 * time.Second
+)
+
+// Message is a plain-text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends email
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// Options configures the mailer. It can be embedded in a service Config.
+type Options struct {
+	Driver       string `env:"MAIL_DRIVER" default:"log"`
+	From         string `env:"MAIL_FROM" default:"no-reply@example.com"`
+	LogFile      string `env:"MAIL_LOG_FILE"` // Empty writes messages to the log
+	SMTPHost     string `env:"SMTP_HOST"`
+	SMTPPort     int    `env:"SMTP_PORT" default:"587" validate:"port"`
+	SMTPUsername string `env:"SMTP_USERNAME"`
+	SMTPPassword string `env:"SMTP_PASSWORD" secret:"true"`
+}
+
+// Validate checks that the options can be used
+func (o Options) Validate() error {
+	if _, err := mail.ParseAddress(o.From); err != nil {
+		return fmt.Errorf("MAIL_FROM must be an email address")
+	}
+	switch o.Driver {
+	case DRIVER_LOG:
+	case DRIVER_SMTP:
+		if o.SMTPHost == "" {
+			return fmt.Errorf("SMTP_HOST is required when MAIL_DRIVER is smtp")
+		}
+	default:
+		return fmt.Errorf("MAIL_DRIVER must be %s or %s", DRIVER_SMTP, DRIVER_LOG)
+	}
+	return nil
+}
+
+// New returns the mailer the options select
+func New(opts Options) Mailer {
+	if opts.Driver == DRIVER_SMTP {
+		return &SMTPMailer{opts: opts}
+	}
+	return &LogMailer{from: opts.From, path: opts.LogFile}
+}
+
+// SMTPMailer sends email through an SMTP server, upgrading to TLS when the
+// server offers STARTTLS and authenticating when a username is configured
+type SMTPMailer struct {
+	opts Options
+}
+
+// Send delivers a message
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	ctx, cancel := context.WithTimeout(ctx, SEND_TIMEOUT)
+	defer cancel()
+
+	addr := net.JoinHostPort(m.opts.SMTPHost, strconv.Itoa(m.opts.SMTPPort))
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("unable to connect to SMTP server: %v", err)
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	c, err := smtp.NewClient(conn, m.opts.SMTPHost)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("unable to start SMTP session: %v", err)
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: m.opts.SMTPHost}); err != nil {
+			return fmt.Errorf("unable to start TLS: %v", err)
+		}
+	}
+	if m.opts.SMTPUsername != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.opts.SMTPUsername, m.opts.SMTPPassword, m.opts.SMTPHost)); err != nil {
+			return fmt.Errorf("unable to authenticate with SMTP server: %v", err)
+		}
+	}
+
+	// MAIL_FROM may carry a display name, e.g. "Shop <no-reply@example.com>"
+	from, _ := mail.ParseAddress(m.opts.From)
+	if err := c.Mail(from.Address); err != nil {
+		return fmt.Errorf("SMTP server rejected sender: %v", err)
+	}
+	if err := c.Rcpt(msg.To); err != nil {
+		return fmt.Errorf("SMTP server rejected recipient %s: %v", msg.To, err)
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("unable to send message: %v", err)
+	}
+	if _, err := w.Write(format(m.opts.From, msg)); err != nil {
+		return fmt.Errorf("unable to send message: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("unable to send message: %v", err)
+	}
+
+	return c.Quit()
+}
+
+// LogMailer writes messages to a file, or to the log when no file is set,
+// instead of sending them
+type LogMailer struct {
+	from string
+	path string
+	mu   sync.Mutex
+}
+
+// Send records a message
+func (m *LogMailer) Send(ctx context.Context, msg Message) error {
+	if m.path == "" {
+		log.Printf("Mail to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(m.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open mail log: %v", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(format(m.from, msg), "\r\n\r\n"...)); err != nil {
+		return fmt.Errorf("unable to write mail log: %v", err)
+	}
+	return nil
+}
+
+// format renders a message with its headers
+func format(from string, msg Message) []byte {
+	var b strings.Builder
+	b.WriteString("From: " + from + "\r\n")
+	b.WriteString("To: " + header(msg.To) + "\r\n")
+	b.WriteString("Subject: " + header(msg.Subject) + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// header encodes a header value, stripping line breaks so it cannot add headers
+func header(value string) string {
+	value = strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+	return mime.QEncoding.Encode("UTF-8", strings.TrimSpace(value))
+}
@@ -0,0 +1,403 @@
+// Package messages defines the RabbitMQ queues and topics and the message
+// carried on each of them, so producers and consumers cannot drift apart.
+package messages
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"time"
+)
+
+// Queue describes a durable queue carrying messages of type T
+type Queue[T any] struct {
+	Name string
+	Args amqp.Table
+}
+
+var (
+	// OrderUpdatesDLQ holds order updates the User Service could not record
+	OrderUpdatesDLQ = Queue[OrderHistory]{Name: "order_updates_dlq"}
+
+	// OrderUpdates carries order status changes from the Order Service to the User Service
+	OrderUpdates = Queue[OrderHistory]{
+		Name: "order_updates",
+		Args: amqp.Table{
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": "order_updates_dlq",
+		},
+	}
+
+	// InventoryUpdatesDLQ holds inventory updates the Product Service could not apply
+	InventoryUpdatesDLQ = Queue[InventoryUpdate]{Name: "inventory_updates_dlq"}
+
+	// InventoryUpdates carries stock changes from the Order Service to the Product Service
+	InventoryUpdates = Queue[InventoryUpdate]{
+		Name: "inventory_updates",
+		Args: amqp.Table{
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": "inventory_updates_dlq",
+		},
+	}
+
+	// CartEvents carries cart activity from the Cart Service to analytics
+	CartEvents = Queue[CartEvent]{Name: "cart_events"}
+
+	// UserDeleted carries erasure requests from the User Service to every service holding user data
+	UserDeleted = Topic[UserDeletion]{Name: "user.deleted"}
+
+	// UserErasures carries each service's report of having erased a user's data back to the User Service
+	UserErasures = Queue[UserErasure]{Name: "user_erasures"}
+
+	// ProductLowStock announces that a product's stock fell to its reorder threshold
+	ProductLowStock = Topic[StockEvent]{Name: "product.low_stock"}
+
+	// ProductOutOfStock announces that a product sold out
+	ProductOutOfStock = Topic[StockEvent]{Name: "product.out_of_stock"}
+
+	// ProductBackInStock announces that a sold out product can be ordered again
+	ProductBackInStock = Topic[StockEvent]{Name: "product.back_in_stock"}
+
+	// ProductPriceChanged announces a new price of a product or one of its variants
+	ProductPriceChanged = Topic[PriceChange]{Name: "product.price_changed"}
+)
+
+// Services that keep data about users, as named in UserErasure reports and
+// in the queues they subscribe to UserDeleted with
+const (
+	SERVICE_USER    = "user-service"
+	SERVICE_PRODUCT = "product-service"
+	SERVICE_ORDER   = "order-service"
+	SERVICE_CART    = "cart-service"
+)
+
+// ERASURE_SERVICES must each report before a user's erasure is complete
+var ERASURE_SERVICES = []string{SERVICE_USER, SERVICE_PRODUCT, SERVICE_ORDER, SERVICE_CART}
+
+// validator is implemented by messages that can check their own fields
+type validator interface {
+	Validate() error
+}
+
+// Declare declares the queue on a channel. Every service declares a queue with the
+// same arguments, otherwise RabbitMQ rejects the later declaration.
+func (q Queue[T]) Declare(ch *amqp.Channel) error {
+	_, err := ch.QueueDeclare(
+		q.Name, // name
+		true,   // durable
+		false,  // delete when unused
+		false,  // exclusive
+		false,  // no-wait
+		q.Args, // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare queue %s: %v", q.Name, err)
+	}
+	return nil
+}
+
+// Encode validates a message and serializes it for the queue
+func (q Queue[T]) Encode(msg T) ([]byte, error) {
+	if v, ok := any(msg).(validator); ok {
+		if err := v.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid %s message: %v", q.Name, err)
+		}
+	}
+	return json.Marshal(msg)
+}
+
+// Decode parses and validates a message received from the queue
+func (q Queue[T]) Decode(body []byte) (T, error) {
+	var msg T
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return msg, fmt.Errorf("unable to parse %s message: %v", q.Name, err)
+	}
+	if v, ok := any(msg).(validator); ok {
+		if err := v.Validate(); err != nil {
+			return msg, fmt.Errorf("invalid %s message: %v", q.Name, err)
+		}
+	}
+	return msg, nil
+}
+
+// Publish encodes a message and publishes it persistently to the queue
+func (q Queue[T]) Publish(ctx context.Context, ch *amqp.Channel, msg T) error {
+	body, err := q.Encode(msg)
+	if err != nil {
+		return err
+	}
+
+	return ch.PublishWithContext(ctx,
+		"",     // exchange
+		q.Name, // routing key
+		false,  // mandatory
+		false,  // immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			Body:         body,
+		})
+}
+
+// Topic describes a durable fanout exchange. Every subscribing service gets
+// its own queue, so each one receives every message of type T.
+type Topic[T any] struct {
+	Name string
+}
+
+// Declare declares the exchange on a channel
+func (t Topic[T]) Declare(ch *amqp.Channel) error {
+	err := ch.ExchangeDeclare(
+		t.Name,   // name
+		"fanout", // kind
+		true,     // durable
+		false,    // delete when unused
+		false,    // internal
+		false,    // no-wait
+		nil,      // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare exchange %s: %v", t.Name, err)
+	}
+	return nil
+}
+
+// Subscribe declares the exchange and a service's queue bound to it, and
+// returns the queue to consume. Messages published while the queue did not
+// exist yet are not delivered to it.
+func (t Topic[T]) Subscribe(ch *amqp.Channel, service string) (Queue[T], error) {
+	q := Queue[T]{Name: t.Name + "." + service}
+	if err := t.Declare(ch); err != nil {
+		return q, err
+	}
+	if err := q.Declare(ch); err != nil {
+		return q, err
+	}
+	if err := ch.QueueBind(q.Name, "", t.Name, false, nil); err != nil {
+		return q, fmt.Errorf("failed to bind queue %s to %s: %v", q.Name, t.Name, err)
+	}
+	return q, nil
+}
+
+// Publish encodes a message and publishes it persistently to every subscriber
+func (t Topic[T]) Publish(ctx context.Context, ch *amqp.Channel, msg T) error {
+	body, err := Queue[T]{Name: t.Name}.Encode(msg)
+	if err != nil {
+		return err
+	}
+
+	return ch.PublishWithContext(ctx,
+		t.Name, // exchange
+		"",     // routing key
+		false,  // mandatory
+		false,  // immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			Body:         body,
+		})
+}
+
+// PublishConfirmed publishes a message like Publish on a channel in confirm mode and
+// waits until the broker has acknowledged it. Give ctx a deadline to bound the wait.
+func (t Topic[T]) PublishConfirmed(ctx context.Context, ch *amqp.Channel, msg T) error {
+	body, err := Queue[T]{Name: t.Name}.Encode(msg)
+	if err != nil {
+		return err
+	}
+
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx,
+		t.Name, // exchange
+		"",     // routing key
+		false,  // mandatory
+		false,  // immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			Body:         body,
+		})
+	if err != nil {
+		return err
+	}
+	if confirmation == nil {
+		return fmt.Errorf("channel is not in confirm mode")
+	}
+
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return fmt.Errorf("no publisher confirm for %s message: %v", t.Name, err)
+	}
+	if !acked {
+		return fmt.Errorf("broker nacked %s message", t.Name)
+	}
+	return nil
+}
+
+// OrderHistory is published on order_updates whenever an order is created or changes status
+type OrderHistory struct {
+	EventID   string    `json:"event_id,omitempty"` // Unique per update, for deduplication by the consumer
+	UserID    int       `json:"user_id"`
+	OrderID   int       `json:"order_id"`
+	Total     float64   `json:"total"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Validate checks the fields the User Service relies on
+func (m OrderHistory) Validate() error {
+	if m.EventID == "" {
+		return fmt.Errorf("event_id is required")
+	}
+	if m.UserID <= 0 || m.OrderID <= 0 {
+		return fmt.Errorf("user_id and order_id are required")
+	}
+	if m.Status == "" {
+		return fmt.Errorf("status is required")
+	}
+	return nil
+}
+
+// InventoryUpdate is published on inventory_updates to change the stock of a product variant
+type InventoryUpdate struct {
+	EventID string `json:"event_id"` // Lets the Product Service skip redelivered updates
+	OrderID int    `json:"order_id,omitempty"`
+	// ReservationRef is set when the update settles or returns stock reserved under that reference
+	ReservationRef string `json:"reservation_ref,omitempty"`
+	ProductID      int    `json:"product_id"`
+	// VariantID may only be left out for products with a single variant, such as
+	// when returning stock of items ordered before products had variants
+	VariantID int `json:"variant_id,omitempty"`
+	// WarehouseID is the location whose stock changes. Left out, decrements are
+	// allocated across warehouses and stock is returned where it was taken from,
+	// or else to the primary warehouse.
+	WarehouseID int  `json:"warehouse_id,omitempty"`
+	Quantity    int  `json:"quantity"`
+	IsIncrease  bool `json:"is_increase"`
+}
+
+// Validate checks that the update can be applied
+func (m InventoryUpdate) Validate() error {
+	if m.EventID == "" {
+		return fmt.Errorf("event_id is required")
+	}
+	if m.ProductID <= 0 {
+		return fmt.Errorf("product_id is required")
+	}
+	if m.Quantity <= 0 {
+		return fmt.Errorf("quantity must be positive")
+	}
+	return nil
+}
+
+// CartEvent is published on cart_events for cart activity
+type CartEvent struct {
+	EventType string    `json:"event_type"` // created, updated, deleted, item_added, item_removed, checkout
+	CartID    int       `json:"cart_id"`
+	UserID    *int      `json:"user_id"`
+	SessionID string    `json:"session_id"`
+	ProductID int       `json:"product_id,omitempty"`
+	VariantID int       `json:"variant_id,omitempty"`
+	Quantity  int       `json:"quantity,omitempty"`
+	EventTime time.Time `json:"event_time"`
+}
+
+// Validate checks the fields every cart event carries
+func (m CartEvent) Validate() error {
+	if m.EventType == "" {
+		return fmt.Errorf("event_type is required")
+	}
+	if m.CartID <= 0 {
+		return fmt.Errorf("cart_id is required")
+	}
+	return nil
+}
+
+// UserDeletion is published on user.deleted when a user is deleted. Services
+// erase or anonymize what they hold about the user, then report a UserErasure.
+// It may be delivered more than once, so erasing must be repeatable.
+type UserDeletion struct {
+	RequestID int       `json:"request_id"`
+	UserID    int       `json:"user_id"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// Validate checks the fields every service relies on
+func (m UserDeletion) Validate() error {
+	if m.RequestID <= 0 || m.UserID <= 0 {
+		return fmt.Errorf("request_id and user_id are required")
+	}
+	return nil
+}
+
+// UserErasure is published on user_erasures once a service has erased a user's data
+type UserErasure struct {
+	RequestID int       `json:"request_id"`
+	UserID    int       `json:"user_id"`
+	Service   string    `json:"service"`
+	ErasedAt  time.Time `json:"erased_at"`
+}
+
+// Validate checks the fields the User Service relies on
+func (m UserErasure) Validate() error {
+	if m.RequestID <= 0 || m.UserID <= 0 {
+		return fmt.Errorf("request_id and user_id are required")
+	}
+	if m.Service == "" {
+		return fmt.Errorf("service is required")
+	}
+	return nil
+}
+
+// StockEvent is published by the Product Service when a product's available stock
+// falls to its reorder threshold, sells out or comes back. EventID stays the same when an event is
+// published again, so subscribers can ignore duplicates.
+type StockEvent struct {
+	EventID          string    `json:"event_id"`
+	ProductID        int       `json:"product_id"`
+	Name             string    `json:"name"`
+	Available        int       `json:"available"` // Stock on hand that is not reserved
+	ReorderThreshold int       `json:"reorder_threshold"`
+	OccurredAt       time.Time `json:"occurred_at"`
+}
+
+// Validate checks the fields subscribers rely on
+func (m StockEvent) Validate() error {
+	if m.EventID == "" {
+		return fmt.Errorf("event_id is required")
+	}
+	if m.ProductID <= 0 {
+		return fmt.Errorf("product_id is required")
+	}
+	if m.Available < 0 {
+		return fmt.Errorf("available cannot be negative")
+	}
+	return nil
+}
+
+// PriceChange is published by the Product Service when the price of a product, or
+// of a variant with a price of its own, changes. EventID stays the same when an
+// event is published again, so subscribers can ignore duplicates.
+type PriceChange struct {
+	EventID   string    `json:"event_id"`
+	ProductID int       `json:"product_id"`
+	VariantID int       `json:"variant_id,omitempty"` // Zero when the product's price changed
+	Name      string    `json:"name"`
+	OldPrice  float64   `json:"old_price"`
+	Price     float64   `json:"price"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// Validate checks the fields subscribers rely on
+func (m PriceChange) Validate() error {
+	if m.EventID == "" {
+		return fmt.Errorf("event_id is required")
+	}
+	if m.ProductID <= 0 {
+		return fmt.Errorf("product_id is required")
+	}
+	if m.Price < 0 || m.OldPrice < 0 {
+		return fmt.Errorf("prices cannot be negative")
+	}
+	return nil
+}
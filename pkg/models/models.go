@@ -0,0 +1,380 @@
+// Package models holds the resource types services exchange over HTTP.
+package models
+
+import (
+	"pkg-iae/web"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// User represents a user owned by the User Service
+type User struct {
+	ID         int        `json:"id"`
+	Username   string     `json:"username"`
+	Email      string     `json:"email"`
+	VerifiedAt *time.Time `json:"verified_at"` // Nil until the user verifies their email address
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// Address types of a user's address book
+const (
+	ADDRESS_SHIPPING = "shipping"
+	ADDRESS_BILLING  = "billing"
+)
+
+// COUNTRY_CODE is an ISO 3166-1 alpha-2 country code
+var COUNTRY_CODE = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// Address is a postal address. Orders keep a copy of the addresses they were
+// placed with, so later edits to the address book do not change them.
+type Address struct {
+	Name       string `json:"name"` // Recipient
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2,omitempty"`
+	City       string `json:"city"`
+	Region     string `json:"region,omitempty"` // State, province or county
+	PostalCode string `json:"postal_code"`
+	Country    string `json:"country"` // ISO 3166-1 alpha-2, e.g. "US"
+	Phone      string `json:"phone,omitempty"`
+}
+
+// Normalize trims the fields and uppercases the country code
+func (a *Address) Normalize() {
+	for _, field := range []*string{&a.Name, &a.Line1, &a.Line2, &a.City, &a.Region, &a.PostalCode, &a.Phone} {
+		*field = strings.TrimSpace(*field)
+	}
+	a.Country = strings.ToUpper(strings.TrimSpace(a.Country))
+}
+
+// Validate adds the problems with the address to errs, naming fields under prefix, e.g. "shipping_address.city"
+func (a Address) Validate(prefix string, errs web.FieldErrors) {
+	field := func(name string) string {
+		if prefix == "" {
+			return name
+		}
+		return prefix + "." + name
+	}
+	check := func(name, value string, required bool, max int) {
+		if required && value == "" {
+			errs.Add(field(name), "is required")
+		} else if len(value) > max {
+			errs.Add(field(name), "must be at most "+strconv.Itoa(max)+" characters")
+		}
+	}
+
+	check("name", a.Name, true, 100)
+	check("line1", a.Line1, true, 200)
+	check("line2", a.Line2, false, 200)
+	check("city", a.City, true, 100)
+	check("region", a.Region, false, 100)
+	check("postal_code", a.PostalCode, true, 20)
+	check("phone", a.Phone, false, 30)
+	if !COUNTRY_CODE.MatchString(a.Country) {
+		errs.Add(field("country"), "must be a two-letter ISO 3166-1 country code")
+	}
+}
+
+// UserAddress is an entry in a user's address book
+type UserAddress struct {
+	ID        int    `json:"id"`
+	UserID    int    `json:"user_id"`
+	Type      string `json:"type"` // shipping or billing
+	IsDefault bool   `json:"is_default"`
+	Address
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Product represents a product owned by the Product Service
+type Product struct {
+	ID          int        `json:"id"`
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Price       float64    `json:"price"`
+	Inventory   int        `json:"inventory"` // Total of the variants' inventory
+	Images      []Image    `json:"images,omitempty"`
+	Reviews     []Review   `json:"reviews,omitempty"`
+	Categories  []Category `json:"categories,omitempty"`
+	AvgRating   float64    `json:"avg_rating,omitempty"`
+	// Options and Variants are only filled in for a single product
+	Options   []ProductOption  `json:"options,omitempty"`
+	Variants  []ProductVariant `json:"variants,omitempty"`
+	CreatedAt time.Time        `json:"created_at"`
+	UpdatedAt time.Time        `json:"updated_at"`
+}
+
+// Variant returns the product's variant with the given ID. An ID of 0 stands for
+// the only variant of a product that has just one.
+func (p Product) Variant(id int) (ProductVariant, bool) {
+	if id == 0 && len(p.Variants) == 1 {
+		return p.Variants[0], true
+	}
+	for _, v := range p.Variants {
+		if v.ID == id {
+			return v, true
+		}
+	}
+	return ProductVariant{}, false
+}
+
+// ProductOption is an option type a product comes in, such as size or color,
+// with the values its variants use
+type ProductOption struct {
+	Name   string   `json:"name"`
+	Values []string `json:"values"`
+}
+
+// ProductVariant is a version of a product that is sold and stocked on its own,
+// such as one size in one color. Every product has at least one.
+type ProductVariant struct {
+	ID            int               `json:"id"`
+	ProductID     int               `json:"product_id"`
+	SKU           string            `json:"sku"`
+	Price         float64           `json:"price"`          // The price override, or else the product's price
+	PriceOverride *float64          `json:"price_override"` // Nil when the variant sells at the product's price
+	Inventory     int               `json:"inventory"`
+	Options       map[string]string `json:"options"` // Option name to value, e.g. {"color": "Black"}
+	Images        []Image           `json:"images,omitempty"`
+	CreatedAt     time.Time         `json:"created_at"`
+	UpdatedAt     time.Time         `json:"updated_at"`
+}
+
+// Review represents a product review
+type Review struct {
+	ID         int       `json:"id"`
+	ProductID  int       `json:"product_id"`
+	UserID     int       `json:"user_id"`
+	Username   string    `json:"username,omitempty"`
+	Rating     int       `json:"rating"`
+	ReviewText string    `json:"review_text"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Image represents a product image
+type Image struct {
+	ID           int       `json:"id"`
+	ProductID    int       `json:"product_id"`
+	VariantID    *int      `json:"variant_id"` // Nil for images of the product as a whole
+	ImageURL     string    `json:"image_url"`
+	IsPrimary    bool      `json:"is_primary"`
+	DisplayOrder int       `json:"display_order"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Category represents a product category
+type Category struct {
+	ID            int        `json:"id"`
+	Name          string     `json:"name"`
+	Description   string     `json:"description"`
+	ParentID      *int       `json:"parent_id"`
+	ImageURL      *string    `json:"image_url,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	SubCategories []Category `json:"sub_categories,omitempty"`
+	Products      []Product  `json:"products,omitempty"`
+}
+
+// Order represents an order owned by the Order Service
+type Order struct {
+	ID              int         `json:"id"`
+	UserID          int         `json:"user_id"`
+	TotalPrice      float64     `json:"total_price"`
+	Status          string      `json:"status"`
+	Items           []OrderItem `json:"items"`
+	ShippingAddress *Address    `json:"shipping_address"` // Nil only for orders placed before addresses were recorded
+	BillingAddress  *Address    `json:"billing_address"`
+	CreatedAt       time.Time   `json:"created_at"`
+	UpdatedAt       time.Time   `json:"updated_at"`
+}
+
+// OrderItem represents an item in an order
+type OrderItem struct {
+	ID        int     `json:"id"`
+	OrderID   int     `json:"order_id"`
+	ProductID int     `json:"product_id"`
+	VariantID *int    `json:"variant_id"` // Nil for items ordered before products had variants
+	SKU       string  `json:"sku,omitempty"`
+	Name      string  `json:"name,omitempty"` // Populated from product service
+	Quantity  int     `json:"quantity"`
+	Price     float64 `json:"price"` // Price at time of order
+}
+
+// OrderRequest represents the request to create a new order
+type OrderRequest struct {
+	UserID          int              `json:"user_id"`
+	Items           []OrderItemInput `json:"items"`
+	ShippingAddress *Address         `json:"shipping_address"`
+	BillingAddress  *Address         `json:"billing_address,omitempty"` // Defaults to the shipping address
+	// ReservationRef is set by callers that already reserved stock for the order,
+	// such as the checkout saga. Repeating a request with the same reference returns
+	// the order created by the first one.
+	ReservationRef string `json:"reservation_ref,omitempty"`
+}
+
+// OrderItemInput represents an input item for order creation
+type OrderItemInput struct {
+	ProductID int `json:"product_id"`
+	VariantID int `json:"variant_id,omitempty"` // May be left out for products with a single variant
+	Quantity  int `json:"quantity"`
+}
+
+// StockReservation represents units of a product held for an order until it is confirmed or released.
+// The reference identifies the order or checkout the stock is held for. A line that is
+// fulfilled from several warehouses is held by one reservation per warehouse.
+type StockReservation struct {
+	ID          int       `json:"id"`
+	Reference   string    `json:"reference"`
+	ProductID   int       `json:"product_id"`
+	VariantID   int       `json:"variant_id"`
+	WarehouseID int       `json:"warehouse_id"`
+	Quantity    int       `json:"quantity"`
+	Status      string    `json:"status"` // reserved, confirmed, released, expired
+	ExpiresAt   time.Time `json:"expires_at"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// ReservationRequest represents a request to reserve stock for an order
+type ReservationRequest struct {
+	Reference  string            `json:"reference"`
+	Items      []ReservationItem `json:"items"`
+	TTLSeconds int               `json:"ttl_seconds,omitempty"`
+}
+
+// ReservationItem represents a single product line to reserve
+type ReservationItem struct {
+	ProductID int `json:"product_id"`
+	VariantID int `json:"variant_id,omitempty"` // May be left out for products with a single variant
+	Quantity  int `json:"quantity"`
+}
+
+// UnavailableItem describes a product that could not be reserved
+type UnavailableItem struct {
+	ProductID int    `json:"product_id"`
+	VariantID int    `json:"variant_id,omitempty"`
+	Requested int    `json:"requested"`
+	Available int    `json:"available"`
+	Reason    string `json:"reason"`
+}
+
+// Warehouse is a location holding stock. Order lines are fulfilled from active
+// warehouses, lower priority first.
+type Warehouse struct {
+	ID        int       `json:"id"`
+	Code      string    `json:"code"`
+	Name      string    `json:"name"`
+	Priority  int       `json:"priority"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// StockLevel is the stock of one variant at a warehouse
+type StockLevel struct {
+	VariantID int    `json:"variant_id"`
+	SKU       string `json:"sku"`
+	OnHand    int    `json:"on_hand"`
+	Reserved  int    `json:"reserved"`
+	Available int    `json:"available"`
+}
+
+// LocationStock is the stock of a product at one warehouse
+type LocationStock struct {
+	WarehouseID int          `json:"warehouse_id"`
+	Code        string       `json:"code"`
+	Name        string       `json:"name"`
+	OnHand      int          `json:"on_hand"`
+	Reserved    int          `json:"reserved"`
+	Available   int          `json:"available"`
+	Variants    []StockLevel `json:"variants"`
+}
+
+// ProductStock is the stock of a product broken down by location
+type ProductStock struct {
+	ProductID        int             `json:"product_id"`
+	OnHand           int             `json:"on_hand"`
+	Reserved         int             `json:"reserved"`
+	Available        int             `json:"available"`
+	ReorderThreshold int             `json:"reorder_threshold"`
+	Locations        []LocationStock `json:"locations"`
+}
+
+// StockTransfer moves units of a variant from one warehouse to another
+type StockTransfer struct {
+	ID              int       `json:"id"`
+	ProductID       int       `json:"product_id"`
+	VariantID       int       `json:"variant_id,omitempty"` // May be left out for products with a single variant
+	FromWarehouseID int       `json:"from_warehouse_id"`
+	ToWarehouseID   int       `json:"to_warehouse_id"`
+	Quantity        int       `json:"quantity"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// Reasons stock on hand changes, as recorded in the inventory ledger
+const (
+	MOVEMENT_OPENING_BALANCE = "opening_balance" // Stock on hand before the ledger was kept
+	MOVEMENT_INITIAL         = "initial"         // Stock a product or variant was created with
+	MOVEMENT_ADJUSTMENT      = "adjustment"      // Stock counted in or written off by hand
+	MOVEMENT_SALE            = "sale"            // Units shipped for an order
+	MOVEMENT_RETURN          = "return"          // Units back from a cancelled order
+	MOVEMENT_TRANSFER        = "transfer"        // Units moved between warehouses, one movement per warehouse
+	MOVEMENT_RECONCILIATION  = "reconciliation"  // Correction booking the ledger to the stock on hand
+)
+
+// InventoryMovement is an entry of the append-only inventory ledger. The movements
+// of a variant at a warehouse add up to its stock on hand there.
+type InventoryMovement struct {
+	ID          int64     `json:"id"`
+	ProductID   int       `json:"product_id"`
+	VariantID   int       `json:"variant_id"`
+	WarehouseID int       `json:"warehouse_id"`
+	Delta       int       `json:"delta"`
+	Reason      string    `json:"reason"`
+	Source      string    `json:"source"`             // Service the change came from
+	OrderID     *int      `json:"order_id,omitempty"` // Set for sales and returns
+	Actor       *string   `json:"actor,omitempty"`    // Caller who made the change, e.g. "user:42"
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// InventoryDiscrepancy flags stock on hand that does not match the ledger
+type InventoryDiscrepancy struct {
+	ID          int        `json:"id"`
+	ProductID   int        `json:"product_id"`
+	VariantID   int        `json:"variant_id"`
+	WarehouseID int        `json:"warehouse_id"`
+	OnHand      int        `json:"on_hand"`
+	LedgerTotal int        `json:"ledger_total"`
+	DetectedAt  time.Time  `json:"detected_at"`
+	ResolvedAt  *time.Time `json:"resolved_at"`
+}
+
+// ProductSummary is the compact projection of a product returned by batch lookups
+type ProductSummary struct {
+	ID              int     `json:"id"`
+	Name            string  `json:"name"`
+	Price           float64 `json:"price"`
+	Inventory       int     `json:"inventory"`
+	PrimaryImageURL *string `json:"primary_image_url,omitempty"`
+}
+
+// VariantSummary is the compact projection of a variant returned by batch lookups
+type VariantSummary struct {
+	ID              int               `json:"id"`
+	ProductID       int               `json:"product_id"`
+	SKU             string            `json:"sku"`
+	Name            string            `json:"name"` // Product name followed by the option values, e.g. "Smartphone X (256GB, Black)"
+	Price           float64           `json:"price"`
+	Inventory       int               `json:"inventory"`
+	Options         map[string]string `json:"options"`
+	PrimaryImageURL *string           `json:"primary_image_url,omitempty"`
+}
+
+// ProductSales is the number of units of a product sold over a period, as reported by the Order Service
+type ProductSales struct {
+	ProductID int `json:"product_id"`
+	UnitsSold int `json:"units_sold"`
+}
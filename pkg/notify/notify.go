@@ -0,0 +1,153 @@
+// Package notify delivers notifications to users. Services depend on the Notifier
+// interface and pick an implementation from configuration: a webhook that hands
+// notifications to a delivery system, or a sink that writes them to a file or the
+// log for local testing.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	DRIVER_LOG     = "log"
+	DRIVER_WEBHOOK = "webhook"
+	// SEND_TIMEOUT bounds a whole webhook call
+	SEND_TIMEOUT = 10 * time.Second
+	// SIGNATURE_HEADER carries the HMAC-SHA256 of a webhook body when a secret is set
+	SIGNATURE_HEADER = "X-Signature-SHA256"
+)
+
+// Notification tells a user about something they asked to hear about
+type Notification struct {
+	ID        int64           `json:"id"`
+	UserID    int             `json:"user_id"`
+	Email     string          `json:"email"`
+	Kind      string          `json:"kind"`
+	Subject   string          `json:"subject"`
+	Body      string          `json:"body"`
+	Data      json.RawMessage `json:"data,omitempty"` // Details of the event, for receivers that format their own messages
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// Notifier delivers notifications
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// Options configures the notifier. It can be embedded in a service Config.
+type Options struct {
+	Driver        string `env:"NOTIFY_DRIVER" default:"log"`
+	LogFile       string `env:"NOTIFY_LOG_FILE"` // Empty writes notifications to the log
+	WebhookURL    string `env:"NOTIFY_WEBHOOK_URL"`
+	WebhookSecret string `env:"NOTIFY_WEBHOOK_SECRET" secret:"true"`
+}
+
+// Validate checks that the options can be used
+func (o Options) Validate() error {
+	switch o.Driver {
+	case DRIVER_LOG:
+	case DRIVER_WEBHOOK:
+		u, err := url.Parse(o.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("NOTIFY_WEBHOOK_URL must be an http or https URL when NOTIFY_DRIVER is webhook")
+		}
+	default:
+		return fmt.Errorf("NOTIFY_DRIVER must be %s or %s", DRIVER_LOG, DRIVER_WEBHOOK)
+	}
+	return nil
+}
+
+// New returns the notifier the options select
+func New(opts Options) Notifier {
+	if opts.Driver == DRIVER_WEBHOOK {
+		return &WebhookNotifier{url: opts.WebhookURL, secret: opts.WebhookSecret, client: &http.Client{Timeout: SEND_TIMEOUT}}
+	}
+	return &LogNotifier{path: opts.LogFile}
+}
+
+// WebhookNotifier posts each notification as JSON to a URL. With a secret, the
+// body is signed so the receiver can check it came from us. Any answer other
+// than 2xx counts as a failure.
+type WebhookNotifier struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+// Notify posts a notification
+func (n *WebhookNotifier) Notify(ctx context.Context, notification Notification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("unable to encode notification: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to create webhook request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.secret != "" {
+		mac := hmac.New(sha256.New, []byte(n.secret))
+		mac.Write(body)
+		req.Header.Set(SIGNATURE_HEADER, hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to call webhook: %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// LogNotifier writes notifications to a file as JSON lines, or to the log when
+// no file is set, instead of delivering them
+type LogNotifier struct {
+	path string
+	mu   sync.Mutex
+}
+
+// Notify records a notification
+func (n *LogNotifier) Notify(ctx context.Context, notification Notification) error {
+	if n.path == "" {
+		log.Printf("Notification to user %d: %s\n%s", notification.UserID, notification.Subject, notification.Body)
+		return nil
+	}
+
+	line, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("unable to encode notification: %v", err)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	f, err := os.OpenFile(n.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open notification log: %v", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("unable to write notification log: %v", err)
+	}
+	return nil
+}
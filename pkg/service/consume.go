@@ -0,0 +1,81 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"pkg-iae/messages"
+	"time"
+)
+
+// MessageHandler handles the body of one message
+type MessageHandler func(ctx context.Context, body []byte) error
+
+// discardError marks a message that retrying can never handle
+type discardError struct {
+	err error
+}
+
+func (e discardError) Error() string { return e.err.Error() }
+
+func (e discardError) Unwrap() error { return e.err }
+
+// Discard wraps an error to drop the message instead of requeueing it. Queues with
+// a dead-letter exchange hand the message to it.
+func Discard(err error) error {
+	return discardError{err: err}
+}
+
+// Decoded adapts a handler of a queue's messages to their bodies. Bodies that cannot
+// be decoded are discarded.
+func Decoded[T any](queue messages.Queue[T], handle func(context.Context, T) error) MessageHandler {
+	return func(ctx context.Context, body []byte) error {
+		msg, err := queue.Decode(body)
+		if err != nil {
+			return Discard(err)
+		}
+		return handle(ctx, msg)
+	}
+}
+
+// Consume handles the messages of a queue in the background. Handled messages are
+// acknowledged, failed ones are requeued after a second unless the error was wrapped
+// with Discard.
+func (a *App) Consume(queue string, handle MessageHandler) error {
+	msgs, err := a.RabbitCh.Consume(
+		queue, // queue
+		"",    // consumer
+		false, // auto-ack
+		false, // exclusive
+		false, // no-local
+		false, // no-wait
+		nil,   // args
+	)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for d := range msgs {
+			if err := handle(context.Background(), d.Body); err != nil {
+				var discard discardError
+				if errors.As(err, &discard) {
+					log.Printf("Discarding message from %s: %v", queue, err)
+					d.Nack(false, false)
+					continue
+				}
+
+				log.Printf("Error handling message from %s, requeueing: %v", queue, err)
+				time.Sleep(time.Second)
+				d.Nack(false, true)
+				continue
+			}
+
+			if err := d.Ack(false); err != nil {
+				log.Printf("Error acknowledging message from %s: %v", queue, err)
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"pkg-iae/messages"
+	"time"
+)
+
+// EraseFunc erases or anonymizes what a service holds about a user. It runs in
+// a transaction and may run more than once for the same user.
+type EraseFunc func(ctx context.Context, tx pgx.Tx, userID int) error
+
+// ConsumeUserDeletions subscribes the service to user.deleted and erases each
+// deleted user's data with erase, then reports the erasure to the User Service.
+// Failed erasures are requeued; the User Service also republishes deletions
+// that have not been reported.
+func (a *App) ConsumeUserDeletions(service string, erase EraseFunc) error {
+	queue, err := messages.UserDeleted.Subscribe(a.RabbitCh, service)
+	if err != nil {
+		return err
+	}
+	if err := messages.UserErasures.Declare(a.RabbitCh); err != nil {
+		return err
+	}
+
+	return a.Consume(queue.Name, Decoded(queue, func(ctx context.Context, deletion messages.UserDeletion) error {
+		if err := a.eraseUser(ctx, service, deletion, erase); err != nil {
+			return fmt.Errorf("unable to erase user %d: %v", deletion.UserID, err)
+		}
+		log.Printf("Erased data of user %d for erasure request %d", deletion.UserID, deletion.RequestID)
+		return nil
+	}))
+}
+
+// eraseUser runs erase for a deletion and reports it
+func (a *App) eraseUser(ctx context.Context, service string, deletion messages.UserDeletion, erase EraseFunc) error {
+	tx, err := a.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	if err := erase(ctx, tx, deletion.UserID); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	return messages.UserErasures.Publish(ctx, a.RabbitCh, messages.UserErasure{
+		RequestID: deletion.RequestID,
+		UserID:    deletion.UserID,
+		Service:   service,
+		ErasedAt:  time.Now(),
+	})
+}
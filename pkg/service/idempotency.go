@@ -0,0 +1,225 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"pkg-iae/auth"
+	"pkg-iae/web"
+	"time"
+)
+
+const (
+	IDEMPOTENCY_KEY_HEADER     = "Idempotency-Key"
+	IDEMPOTENCY_KEY_MAX_LENGTH = 255
+	// A request still marked in progress after this long is assumed to have died with the service
+	IDEMPOTENCY_LOCK_TIMEOUT     = 2 * time.Minute
+	IDEMPOTENCY_CLEANUP_INTERVAL = 1 * time.Hour
+)
+
+// responseRecorder captures a handler's response so it can be stored for replays
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// storedResponse is what the idempotency_keys table holds for a key
+type storedResponse struct {
+	requestHash  string
+	completed    bool
+	responseCode int
+	responseBody []byte
+}
+
+// idempotencyStore keeps the keys WithIdempotency has seen
+type idempotencyStore interface {
+	// reserve claims a key for a request, or returns false when the key is taken.
+	// Expired keys and requests abandoned by a crash no longer hold their key.
+	reserve(ctx context.Context, scope, key, requestHash string, ttl time.Duration) (bool, error)
+	// lookup returns what is stored for a taken key
+	lookup(ctx context.Context, scope, key string) (storedResponse, error)
+	// complete stores the response of the request holding a key
+	complete(ctx context.Context, scope, key string, status int, body []byte) error
+	// release frees a key so the request can be retried with it
+	release(ctx context.Context, scope, key string) error
+}
+
+// WithIdempotency makes a handler safe to retry when the client sends an Idempotency-Key header.
+// The first response for a key is stored in the service's idempotency_keys table for ttl and
+// returned as-is for later requests with the same key and body; reusing the key with a
+// different body is rejected. Keys are kept apart per scope and per caller.
+func (a *App) WithIdempotency(scope string, ttl time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	return withIdempotency(dbIdempotencyStore{db: a.DB}, scope, ttl, next)
+}
+
+// withIdempotency is WithIdempotency with the keys kept in store
+func withIdempotency(store idempotencyStore, scope string, ttl time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IDEMPOTENCY_KEY_HEADER)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > IDEMPOTENCY_KEY_MAX_LENGTH {
+			web.RespondWithError(w, http.StatusBadRequest, "Idempotency-Key must be at most 255 characters")
+			return
+		}
+
+		// Keys are per caller, so one caller cannot replay another's response
+		keyScope := scope
+		if p := auth.PrincipalFrom(r.Context()); p != nil {
+			keyScope += ":" + p.Subject()
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			web.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		requestHash := hashRequest(r.URL.Path, body)
+
+		ctx := context.Background()
+
+		reserved, err := store.reserve(ctx, keyScope, key, requestHash, ttl)
+		if err != nil {
+			web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !reserved {
+			replayIdempotentResponse(w, store, keyScope, key, requestHash)
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w}
+		next(recorder, r)
+
+		if recorder.status >= http.StatusInternalServerError {
+			// Server errors are not final, so let the client retry with the same key
+			err = store.release(ctx, keyScope, key)
+		} else {
+			err = store.complete(ctx, keyScope, key, recorder.status, recorder.body.Bytes())
+		}
+		if err != nil {
+			log.Printf("Error saving idempotency key %s: %v", key, err)
+		}
+	}
+}
+
+// hashRequest identifies a request by its path and body, so a key cannot be reused for another request
+func hashRequest(path string, body []byte) string {
+	hash := sha256.Sum256(append([]byte(path+"\n"), body...))
+	return hex.EncodeToString(hash[:])
+}
+
+// replayIdempotentResponse answers a request whose key was already used
+func replayIdempotentResponse(w http.ResponseWriter, store idempotencyStore, scope, key, requestHash string) {
+	stored, err := store.lookup(context.Background(), scope, key)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if stored.requestHash != requestHash {
+		web.RespondWithError(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used with a different request")
+		return
+	}
+	if !stored.completed {
+		web.RespondWithError(w, http.StatusConflict, "A request with this Idempotency-Key is still being processed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(stored.responseCode)
+	w.Write(stored.responseBody)
+}
+
+// dbIdempotencyStore keeps idempotency keys in the idempotency_keys table
+type dbIdempotencyStore struct {
+	db *pgxpool.Pool
+}
+
+func (s dbIdempotencyStore) reserve(ctx context.Context, scope, key, requestHash string, ttl time.Duration) (bool, error) {
+	_, err := s.db.Exec(ctx,
+		`DELETE FROM idempotency_keys WHERE scope = $1 AND key = $2
+		AND (expires_at < NOW() OR (status = 'in_progress' AND created_at < $3))`,
+		scope, key, time.Now().Add(-IDEMPOTENCY_LOCK_TIMEOUT))
+	if err != nil {
+		return false, err
+	}
+
+	result, err := s.db.Exec(ctx,
+		`INSERT INTO idempotency_keys (scope, key, request_hash, status, created_at, expires_at)
+		VALUES ($1, $2, $3, 'in_progress', NOW(), $4) ON CONFLICT (scope, key) DO NOTHING`,
+		scope, key, requestHash, time.Now().Add(ttl))
+	if err != nil {
+		return false, err
+	}
+	return result.RowsAffected() == 1, nil
+}
+
+func (s dbIdempotencyStore) lookup(ctx context.Context, scope, key string) (storedResponse, error) {
+	var stored storedResponse
+	var status string
+	var responseCode *int
+	err := s.db.QueryRow(ctx,
+		"SELECT request_hash, status, response_code, response_body FROM idempotency_keys WHERE scope = $1 AND key = $2",
+		scope, key).Scan(&stored.requestHash, &status, &responseCode, &stored.responseBody)
+	if err != nil {
+		return stored, err
+	}
+	if status == "completed" && responseCode != nil {
+		stored.completed = true
+		stored.responseCode = *responseCode
+	}
+	return stored, nil
+}
+
+func (s dbIdempotencyStore) complete(ctx context.Context, scope, key string, status int, body []byte) error {
+	_, err := s.db.Exec(ctx,
+		`UPDATE idempotency_keys SET status = 'completed', response_code = $1, response_body = $2
+		WHERE scope = $3 AND key = $4`,
+		status, body, scope, key)
+	return err
+}
+
+func (s dbIdempotencyStore) release(ctx context.Context, scope, key string) error {
+	_, err := s.db.Exec(ctx, "DELETE FROM idempotency_keys WHERE scope = $1 AND key = $2", scope, key)
+	return err
+}
+
+// CleanupExpiredIdempotencyKeys periodically removes idempotency keys past their expiry
+func (a *App) CleanupExpiredIdempotencyKeys() {
+	ticker := time.NewTicker(IDEMPOTENCY_CLEANUP_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		result, err := a.DB.Exec(context.Background(), "DELETE FROM idempotency_keys WHERE expires_at < NOW()")
+		if err != nil {
+			log.Printf("Error cleaning up idempotency keys: %v", err)
+			continue
+		}
+		log.Printf("Cleaned up %d expired idempotency keys", result.RowsAffected())
+	}
+}
@@ -0,0 +1,177 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"pkg-iae/auth"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memoryIdempotencyStore keeps idempotency keys in memory
+type memoryIdempotencyStore struct {
+	keys map[string]*storedResponse
+}
+
+func newMemoryIdempotencyStore() *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{keys: map[string]*storedResponse{}}
+}
+
+func (s *memoryIdempotencyStore) reserve(ctx context.Context, scope, key, requestHash string, ttl time.Duration) (bool, error) {
+	if _, taken := s.keys[scope+"\x00"+key]; taken {
+		return false, nil
+	}
+	s.keys[scope+"\x00"+key] = &storedResponse{requestHash: requestHash}
+	return true, nil
+}
+
+func (s *memoryIdempotencyStore) lookup(ctx context.Context, scope, key string) (storedResponse, error) {
+	stored, ok := s.keys[scope+"\x00"+key]
+	if !ok {
+		return storedResponse{}, fmt.Errorf("key %s not found", key)
+	}
+	return *stored, nil
+}
+
+func (s *memoryIdempotencyStore) complete(ctx context.Context, scope, key string, status int, body []byte) error {
+	stored := s.keys[scope+"\x00"+key]
+	stored.completed = true
+	stored.responseCode = status
+	stored.responseBody = append([]byte(nil), body...)
+	return nil
+}
+
+func (s *memoryIdempotencyStore) release(ctx context.Context, scope, key string) error {
+	delete(s.keys, scope+"\x00"+key)
+	return nil
+}
+
+// idempotentRequest is one request sent through the middleware and what it should get back
+type idempotentRequest struct {
+	userID     int // Zero for an anonymous caller
+	key        string
+	body       string
+	wantStatus int
+	wantBody   string // Checked when not empty
+	wantReplay bool
+}
+
+func TestWithIdempotency(t *testing.T) {
+	tests := []struct {
+		name string
+		// failFirst makes the handler answer 500 to its first call
+		failFirst bool
+		// inProgress holds the key for this body, as if its first request were still running
+		inProgress string
+		requests   []idempotentRequest
+		wantCalls  int
+	}{
+		{
+			name: "requests without a key are not deduplicated",
+			requests: []idempotentRequest{
+				{body: `{"a":1}`, wantStatus: http.StatusCreated, wantBody: "call 1"},
+				{body: `{"a":1}`, wantStatus: http.StatusCreated, wantBody: "call 2"},
+			},
+			wantCalls: 2,
+		},
+		{
+			name: "a repeated request replays the first response",
+			requests: []idempotentRequest{
+				{key: "k1", body: `{"a":1}`, wantStatus: http.StatusCreated, wantBody: "call 1"},
+				{key: "k1", body: `{"a":1}`, wantStatus: http.StatusCreated, wantBody: "call 1", wantReplay: true},
+			},
+			wantCalls: 1,
+		},
+		{
+			name: "reusing a key with another body is rejected",
+			requests: []idempotentRequest{
+				{key: "k1", body: `{"a":1}`, wantStatus: http.StatusCreated},
+				{key: "k1", body: `{"a":2}`, wantStatus: http.StatusUnprocessableEntity},
+			},
+			wantCalls: 1,
+		},
+		{
+			name:       "a key still being processed is a conflict",
+			inProgress: `{"a":1}`,
+			requests: []idempotentRequest{
+				{key: "k1", body: `{"a":1}`, wantStatus: http.StatusConflict},
+			},
+			wantCalls: 0,
+		},
+		{
+			name:      "a server error frees the key for a retry",
+			failFirst: true,
+			requests: []idempotentRequest{
+				{key: "k1", body: `{"a":1}`, wantStatus: http.StatusInternalServerError},
+				{key: "k1", body: `{"a":1}`, wantStatus: http.StatusCreated, wantBody: "call 2"},
+				{key: "k1", body: `{"a":1}`, wantStatus: http.StatusCreated, wantBody: "call 2", wantReplay: true},
+			},
+			wantCalls: 2,
+		},
+		{
+			name: "keys are kept apart per caller",
+			requests: []idempotentRequest{
+				{userID: 1, key: "k1", body: `{"a":1}`, wantStatus: http.StatusCreated, wantBody: "call 1"},
+				{userID: 2, key: "k1", body: `{"a":1}`, wantStatus: http.StatusCreated, wantBody: "call 2"},
+				{userID: 1, key: "k1", body: `{"a":1}`, wantStatus: http.StatusCreated, wantBody: "call 1", wantReplay: true},
+			},
+			wantCalls: 2,
+		},
+		{
+			name: "overlong keys are rejected",
+			requests: []idempotentRequest{
+				{key: strings.Repeat("k", IDEMPOTENCY_KEY_MAX_LENGTH+1), body: `{"a":1}`, wantStatus: http.StatusBadRequest},
+			},
+			wantCalls: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemoryIdempotencyStore()
+			if tt.inProgress != "" {
+				store.reserve(context.Background(), "test", "k1", hashRequest("/orders", []byte(tt.inProgress)), time.Hour)
+			}
+
+			calls := 0
+			handler := withIdempotency(store, "test", time.Hour, func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				if tt.failFirst && calls == 1 {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				w.WriteHeader(http.StatusCreated)
+				fmt.Fprintf(w, "call %d", calls)
+			})
+
+			for i, req := range tt.requests {
+				r := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(req.body))
+				if req.key != "" {
+					r.Header.Set(IDEMPOTENCY_KEY_HEADER, req.key)
+				}
+				if req.userID != 0 {
+					r = r.WithContext(auth.WithPrincipal(r.Context(), &auth.Principal{UserID: req.userID}))
+				}
+				w := httptest.NewRecorder()
+				handler(w, r)
+
+				if w.Code != req.wantStatus {
+					t.Errorf("request %d: status = %d, want %d", i+1, w.Code, req.wantStatus)
+				}
+				if req.wantBody != "" && w.Body.String() != req.wantBody {
+					t.Errorf("request %d: body = %q, want %q", i+1, w.Body.String(), req.wantBody)
+				}
+				if replayed := w.Header().Get("Idempotent-Replayed") == "true"; replayed != req.wantReplay {
+					t.Errorf("request %d: replayed = %v, want %v", i+1, replayed, req.wantReplay)
+				}
+			}
+
+			if calls != tt.wantCalls {
+				t.Errorf("handler called %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
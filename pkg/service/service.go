@@ -0,0 +1,170 @@
+// Package service provides the scaffolding every service builds on: the
+// database and RabbitMQ connections, the router, health checks and a
+// graceful shutdown.
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4/pgxpool"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"pkg-iae/config"
+	"pkg-iae/web"
+	"syscall"
+	"time"
+)
+
+const SHUTDOWN_TIMEOUT = 15 * time.Second
+
+// App represents the parts of an application shared by all services
+type App struct {
+	Name     string
+	Router   *mux.Router
+	DB       *pgxpool.Pool
+	RabbitMQ *amqp.Connection
+	RabbitCh *amqp.Channel
+
+	port          int
+	shutdownHooks []func()
+	confirmCh     *amqp.Channel
+}
+
+// Connect sets up the database connection, the RabbitMQ channel and the router
+func (a *App) Connect(name string, cfg config.Base) error {
+	var err error
+	a.Name = name
+	a.port = cfg.Port
+
+	// Initialize PostgreSQL connection
+	a.DB, err = pgxpool.Connect(context.Background(), cfg.PostgresURI)
+	if err != nil {
+		return fmt.Errorf("unable to connect to database: %v", err)
+	}
+
+	// Verify database connection
+	if err = a.DB.Ping(context.Background()); err != nil {
+		return fmt.Errorf("unable to ping database: %v", err)
+	}
+
+	// Initialize RabbitMQ connection
+	a.RabbitMQ, err = amqp.Dial(cfg.RabbitMQURI)
+	if err != nil {
+		return fmt.Errorf("failed to connect to RabbitMQ: %v", err)
+	}
+
+	// Create a channel
+	a.RabbitCh, err = a.RabbitMQ.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open a channel: %v", err)
+	}
+
+	a.Router = mux.NewRouter()
+
+	return nil
+}
+
+// ConfirmChannel returns a channel in confirm mode for publishes that must wait for
+// the broker's acknowledgement, opening a new one when the last was closed. It is
+// meant for a single publishing goroutine.
+func (a *App) ConfirmChannel() (*amqp.Channel, error) {
+	if a.confirmCh != nil && !a.confirmCh.IsClosed() {
+		return a.confirmCh, nil
+	}
+
+	ch, err := a.RabbitMQ.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open a channel: %v", err)
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("failed to enable publisher confirms: %v", err)
+	}
+
+	a.confirmCh = ch
+	return ch, nil
+}
+
+// OnShutdown registers a function to run before the shared connections are closed
+func (a *App) OnShutdown(fn func()) {
+	a.shutdownHooks = append(a.shutdownHooks, fn)
+}
+
+// CheckConnections reports whether the database and RabbitMQ are reachable
+func (a *App) CheckConnections() error {
+	if err := a.DB.Ping(context.Background()); err != nil {
+		return fmt.Errorf("Database connection failure")
+	}
+	if a.RabbitMQ.IsClosed() {
+		return fmt.Errorf("RabbitMQ connection failure")
+	}
+	return nil
+}
+
+// HealthCheck is a simple health check endpoint
+func (a *App) HealthCheck(w http.ResponseWriter, r *http.Request) {
+	if err := a.CheckConnections(); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, map[string]string{"status": "healthy"})
+}
+
+// Run starts the HTTP server and blocks until SIGINT or SIGTERM, then shuts down gracefully
+func (a *App) Run() {
+	srv := &http.Server{
+		Addr:         fmt.Sprintf(":%d", a.port),
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+		IdleTimeout:  60 * time.Second,
+		Handler:      a.Router,
+	}
+
+	// Run server in a goroutine so it doesn't block
+	go func() {
+		log.Printf("%s listening on port %d...", a.Name, a.port)
+		if err := srv.ListenAndServe(); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	c := make(chan os.Signal, 1)
+	// Accept graceful shutdowns when quit via SIGINT (Ctrl+C) or SIGTERM
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	// Block until signal is received
+	<-c
+
+	log.Println("Shutting down server...")
+
+	// Create a deadline to wait for
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+
+	for _, hook := range a.shutdownHooks {
+		hook()
+	}
+
+	// Close RabbitMQ connection
+	if err := a.RabbitCh.Close(); err != nil {
+		log.Printf("Error closing RabbitMQ channel: %v", err)
+	}
+	if err := a.RabbitMQ.Close(); err != nil {
+		log.Printf("Error closing RabbitMQ connection: %v", err)
+	}
+
+	// Close DB connection
+	a.DB.Close()
+
+	// Shutdown server
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Fatalf("Server forced to shutdown: %v", err)
+	}
+
+	log.Println("Server exited gracefully")
+}
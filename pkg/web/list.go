@@ -0,0 +1,279 @@
+package web
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// List endpoints share one contract: ?limit= sets the page size, ?sort= a field to
+// sort by (prefixed with - for descending), ?fields= the fields to return and
+// ?cursor= the page to start from. Pages are found with keyset pagination: the
+// cursor holds the sort value and ID of the last row of the previous page, so
+// deep pages cost the same as the first and rows are not skipped or repeated
+// when earlier rows are inserted or deleted.
+const (
+	DEFAULT_LIST_LIMIT = 20
+	MAX_LIST_LIMIT     = 100
+)
+
+// ListSpec describes the sorts and fields a list endpoint accepts
+type ListSpec struct {
+	Sorts       map[string]string // Sort name, as used in ?sort=, to its SQL column; columns must not be NULL
+	DefaultSort string            // Prefixed with - for descending
+	IDColumn    string            // Unique integer column breaking ties between equal sort values
+	Fields      []string          // JSON fields that can be selected with ?fields=
+}
+
+// ListParams are the validated parameters of a list request
+type ListParams struct {
+	Limit  int
+	Sort   string
+	Desc   bool
+	Fields []string // Empty selects every field
+	spec   ListSpec
+	after  *cursor
+}
+
+// CursorKey is where a row sits in the sort order. Scan it from the columns
+// returned by ListParams.KeyColumns.
+type CursorKey struct {
+	Value string
+	ID    int64
+}
+
+// cursor is the decoded form of the opaque ?cursor= parameter
+type cursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    int64  `json:"id"`
+}
+
+// ListResponse is the envelope every list endpoint responds with
+type ListResponse struct {
+	Data       interface{} `json:"data"`
+	NextCursor *string     `json:"next_cursor"` // null on the last page
+}
+
+// ParseListParams validates the list parameters of a request against spec
+func ParseListParams(q url.Values, spec ListSpec) (ListParams, FieldErrors) {
+	errs := FieldErrors{}
+	params := ListParams{Limit: DEFAULT_LIST_LIMIT, spec: spec}
+
+	if raw := q.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > MAX_LIST_LIMIT {
+			errs.Add("limit", fmt.Sprintf("must be an integer from 1 to %d", MAX_LIST_LIMIT))
+		} else {
+			params.Limit = limit
+		}
+	}
+
+	sortParam := spec.DefaultSort
+	if raw := q.Get("sort"); raw != "" {
+		sortParam = raw
+	}
+	params.Desc = strings.HasPrefix(sortParam, "-")
+	params.Sort = strings.TrimPrefix(sortParam, "-")
+	if _, ok := spec.Sorts[params.Sort]; !ok {
+		errs.Add("sort", "must be one of "+strings.Join(sortNames(spec), ", ")+", optionally prefixed with -")
+	}
+
+	if raw := q.Get("fields"); raw != "" {
+		allowed := map[string]bool{}
+		for _, field := range spec.Fields {
+			allowed[field] = true
+		}
+		for _, field := range strings.Split(raw, ",") {
+			field = strings.TrimSpace(field)
+			if !allowed[field] {
+				errs.Add("fields", "must be a comma separated list of "+strings.Join(spec.Fields, ", "))
+				break
+			}
+			params.Fields = append(params.Fields, field)
+		}
+	}
+
+	if raw := q.Get("cursor"); raw != "" {
+		after, err := decodeCursor(raw)
+		if err != nil {
+			errs.Add("cursor", "is not a valid cursor")
+		} else if after.Sort != sortParam {
+			errs.Add("cursor", "was issued for a different sort")
+		} else {
+			params.after = &after
+		}
+	}
+
+	if len(errs) > 0 {
+		return params, errs
+	}
+	return params, nil
+}
+
+// sortNames returns the sorts of a spec in a stable order
+func sortNames(spec ListSpec) []string {
+	names := make([]string, 0, len(spec.Sorts))
+	for name := range spec.Sorts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Selects reports whether field is part of the response, so callers can skip
+// loading fields that were not asked for
+func (p ListParams) Selects(field string) bool {
+	if len(p.Fields) == 0 {
+		return true
+	}
+	for _, f := range p.Fields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyColumns returns the columns to append to the SELECT list and scan into a CursorKey
+func (p ListParams) KeyColumns() string {
+	return p.spec.Sorts[p.Sort] + "::text, " + p.spec.IDColumn
+}
+
+// Page completes a SELECT ... FROM with the WHERE, ORDER BY and LIMIT clauses of
+// the requested page. where is the query's own condition, empty for none, and
+// args are its values for $1, $2, ...; the SELECT list must end with KeyColumns.
+func (p ListParams) Page(selectFrom, where string, args ...interface{}) (string, []interface{}) {
+	conditions := []string{}
+	if where != "" {
+		conditions = append(conditions, "("+where+")")
+	}
+	if after, afterArgs := p.Where(len(args) + 1); after != "" {
+		conditions = append(conditions, after)
+		args = append(args, afterArgs...)
+	}
+
+	query := selectFrom
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, p.FetchLimit())
+	query += fmt.Sprintf(" ORDER BY %s LIMIT $%d", p.OrderBy(), len(args))
+	return query, args
+}
+
+// Where returns the condition selecting the rows after the cursor, numbering its
+// placeholders from $n, or an empty condition on the first page
+func (p ListParams) Where(n int) (string, []interface{}) {
+	if p.after == nil {
+		return "", nil
+	}
+
+	op := ">"
+	if p.Desc {
+		op = "<"
+	}
+	condition := fmt.Sprintf("(%s, %s) %s ($%d, $%d)", p.spec.Sorts[p.Sort], p.spec.IDColumn, op, n, n+1)
+	return condition, []interface{}{p.after.Value, p.after.ID}
+}
+
+// OrderBy returns the ORDER BY clause matching the sort
+func (p ListParams) OrderBy() string {
+	direction := "ASC"
+	if p.Desc {
+		direction = "DESC"
+	}
+	return p.spec.Sorts[p.Sort] + " " + direction + ", " + p.spec.IDColumn + " " + direction
+}
+
+// FetchLimit returns one more than the page size, so Paginate can tell whether
+// there is a next page
+func (p ListParams) FetchLimit() int {
+	return p.Limit + 1
+}
+
+// Paginate trims rows fetched with FetchLimit to the page size and returns the
+// cursor of the next page, or nil on the last page. keys holds the CursorKey of each row.
+func Paginate[T any](p ListParams, rows []T, keys []CursorKey) ([]T, *string) {
+	if len(rows) <= p.Limit {
+		return rows, nil
+	}
+
+	last := keys[p.Limit-1]
+	sortParam := p.Sort
+	if p.Desc {
+		sortParam = "-" + sortParam
+	}
+	next := encodeCursor(cursor{Sort: sortParam, Value: last.Value, ID: last.ID})
+	return rows[:p.Limit], &next
+}
+
+// RespondWithList responds with a page of items in the list envelope, keeping
+// only the selected fields, and links to the next page in a Link header
+func RespondWithList(w http.ResponseWriter, r *http.Request, p ListParams, items interface{}, next *string) {
+	data := items
+	if len(p.Fields) > 0 {
+		projected, err := project(items, p.Fields)
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		data = projected
+	}
+
+	if next != nil {
+		q := r.URL.Query()
+		q.Set("cursor", *next)
+		link := url.URL{Path: r.URL.Path, RawQuery: q.Encode()}
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", link.String()))
+	}
+
+	RespondWithJSON(w, http.StatusOK, ListResponse{Data: data, NextCursor: next})
+}
+
+// project keeps only the given JSON fields of each item
+func project(items interface{}, fields []string) ([]map[string]json.RawMessage, error) {
+	body, err := json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
+
+	var all []map[string]json.RawMessage
+	if err := json.Unmarshal(body, &all); err != nil {
+		return nil, fmt.Errorf("unable to select fields: %v", err)
+	}
+
+	projected := make([]map[string]json.RawMessage, 0, len(all))
+	for _, item := range all {
+		selected := map[string]json.RawMessage{}
+		for _, field := range fields {
+			if value, ok := item[field]; ok {
+				selected[field] = value
+			}
+		}
+		projected = append(projected, selected)
+	}
+	return projected, nil
+}
+
+func encodeCursor(c cursor) string {
+	body, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(body)
+}
+
+func decodeCursor(raw string) (cursor, error) {
+	var c cursor
+	body, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(body, &c); err != nil {
+		return c, err
+	}
+	return c, nil
+}
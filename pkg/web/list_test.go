@@ -0,0 +1,118 @@
+package web
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+var testListSpec = ListSpec{
+	Sorts:       map[string]string{"id": "id", "name": "name", "created_at": "created_at"},
+	DefaultSort: "id",
+	IDColumn:    "id",
+	Fields:      []string{"id", "name"},
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		sort string
+		last CursorKey
+	}{
+		{"ascending", "name", CursorKey{Value: "Laptop", ID: 7}},
+		{"descending", "-created_at", CursorKey{Value: "2025-04-28 12:00:00", ID: 42}},
+		{"default sort", "", CursorKey{Value: "3", ID: 3}},
+		{"value needing escaping", "name", CursorKey{Value: `Ünïcode, "quoted" & /slashed/`, ID: 1}},
+		{"large ID", "name", CursorKey{Value: "", ID: 1 << 40}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := url.Values{"limit": {"2"}}
+			if tt.sort != "" {
+				q.Set("sort", tt.sort)
+			}
+			params, errs := ParseListParams(q, testListSpec)
+			if errs != nil {
+				t.Fatalf("ParseListParams: %v", errs)
+			}
+
+			rows := []int{1, 2, 3}
+			keys := []CursorKey{{Value: "a", ID: 1}, tt.last, {Value: "c", ID: 3}}
+			page, next := Paginate(params, rows, keys)
+			if !reflect.DeepEqual(page, []int{1, 2}) {
+				t.Fatalf("page = %v, want [1 2]", page)
+			}
+			if next == nil {
+				t.Fatal("next cursor is nil, want a cursor")
+			}
+
+			q.Set("cursor", *next)
+			params, errs = ParseListParams(q, testListSpec)
+			if errs != nil {
+				t.Fatalf("ParseListParams with cursor: %v", errs)
+			}
+			_, args := params.Where(1)
+			if want := []interface{}{tt.last.Value, tt.last.ID}; !reflect.DeepEqual(args, want) {
+				t.Errorf("cursor args = %v, want %v", args, want)
+			}
+		})
+	}
+}
+
+func TestPaginateLastPage(t *testing.T) {
+	params, errs := ParseListParams(url.Values{"limit": {"2"}}, testListSpec)
+	if errs != nil {
+		t.Fatalf("ParseListParams: %v", errs)
+	}
+
+	page, next := Paginate(params, []int{1, 2}, []CursorKey{{Value: "1", ID: 1}, {Value: "2", ID: 2}})
+	if len(page) != 2 || next != nil {
+		t.Errorf("Paginate = %v, %v; want 2 rows and no cursor", page, next)
+	}
+}
+
+func TestParseListParamsErrors(t *testing.T) {
+	nameCursor := encodeCursor(cursor{Sort: "name", Value: "a", ID: 1})
+
+	tests := []struct {
+		name  string
+		query url.Values
+		field string
+	}{
+		{"limit too small", url.Values{"limit": {"0"}}, "limit"},
+		{"limit too large", url.Values{"limit": {"101"}}, "limit"},
+		{"limit not a number", url.Values{"limit": {"ten"}}, "limit"},
+		{"unknown sort", url.Values{"sort": {"price"}}, "sort"},
+		{"unknown field", url.Values{"fields": {"id,password"}}, "fields"},
+		{"cursor not base64", url.Values{"cursor": {"%%%"}}, "cursor"},
+		{"cursor not JSON", url.Values{"cursor": {"bm90IGpzb24"}}, "cursor"},
+		{"cursor for another sort", url.Values{"sort": {"-name"}, "cursor": {nameCursor}}, "cursor"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, errs := ParseListParams(tt.query, testListSpec)
+			if _, ok := errs[tt.field]; !ok {
+				t.Errorf("errors = %v, want one for %s", errs, tt.field)
+			}
+		})
+	}
+}
+
+func TestListParamsQuery(t *testing.T) {
+	after := encodeCursor(cursor{Sort: "-name", Value: "m", ID: 5})
+	params, errs := ParseListParams(url.Values{"sort": {"-name"}, "limit": {"10"}, "cursor": {after}}, testListSpec)
+	if errs != nil {
+		t.Fatalf("ParseListParams: %v", errs)
+	}
+
+	query, args := params.Page("SELECT name, "+params.KeyColumns()+" FROM products", "active = $1", true)
+	wantQuery := "SELECT name, name::text, id FROM products WHERE (active = $1) AND (name, id) < ($2, $3) ORDER BY name DESC, id DESC LIMIT $4"
+	if query != wantQuery {
+		t.Errorf("query = %q, want %q", query, wantQuery)
+	}
+	if want := []interface{}{true, "m", int64(5), 11}; !reflect.DeepEqual(args, want) {
+		t.Errorf("args = %v, want %v", args, want)
+	}
+}
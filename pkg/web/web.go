@@ -0,0 +1,57 @@
+// Package web holds the HTTP helpers shared by the service handlers.
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// RespondWithError responds with an error message
+func RespondWithError(w http.ResponseWriter, code int, message string) {
+	RespondWithJSON(w, code, map[string]string{"error": message})
+}
+
+// RespondWithJSON responds with a JSON payload
+func RespondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, _ := json.Marshal(payload)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
+
+// ParseInt converts a route variable to an int, returning 0 if it is not a number
+func ParseInt(s string) int {
+	var i int
+	fmt.Sscanf(s, "%d", &i)
+	return i
+}
+
+// FieldErrors maps request fields to what is wrong with them
+type FieldErrors map[string]string
+
+// Add records a problem with a field, keeping the first one reported
+func (e FieldErrors) Add(field, message string) {
+	if _, ok := e[field]; !ok {
+		e[field] = message
+	}
+}
+
+func (e FieldErrors) Error() string {
+	return fmt.Sprintf("%d invalid fields", len(e))
+}
+
+// RespondWithFieldErrors responds 400 with a message and the problem with each field
+func RespondWithFieldErrors(w http.ResponseWriter, message string, errs FieldErrors) {
+	RespondWithFieldErrorsStatus(w, http.StatusBadRequest, message, errs)
+}
+
+// RespondWithFieldErrorsStatus responds like RespondWithFieldErrors with another status,
+// such as 422 for a well-formed request whose values cannot be processed
+func RespondWithFieldErrorsStatus(w http.ResponseWriter, status int, message string, errs FieldErrors) {
+	RespondWithJSON(w, status, map[string]interface{}{
+		"error":  message,
+		"fields": errs,
+	})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"pkg-iae/models"
+	"pkg-iae/web"
+	"strconv"
+	"strings"
+)
+
+// MAX_BATCH_PRODUCT_IDS caps how many products or variants one batch lookup may ask for
+const MAX_BATCH_PRODUCT_IDS = 100
+
+// Joins that fold per-product lookups into list queries. They expose the primary
+// image as pi.image_url and the average rating as ratings.avg_rating, both NULL when missing.
+// The primary image of the product as a whole is preferred over one of a variant.
+const (
+	PRIMARY_IMAGE_JOIN = `
+        LEFT JOIN (
+            SELECT DISTINCT ON (product_id) product_id, image_url
+            FROM product_images
+            WHERE is_primary = true
+            ORDER BY product_id, variant_id IS NOT NULL, display_order, id
+        ) pi ON pi.product_id = p.id`
+	AVG_RATING_JOIN = `
+        LEFT JOIN (
+            SELECT product_id, AVG(rating) AS avg_rating
+            FROM product_reviews
+            GROUP BY product_id
+        ) ratings ON ratings.product_id = p.id`
+)
+
+// ProductSummary is the projection returned by GET /products?ids=
+type ProductSummary = models.ProductSummary
+
+// primaryImages turns a scanned primary image URL into the product's image list
+func primaryImages(imageURL *string) []Image {
+	if imageURL == nil {
+		return nil
+	}
+	return []Image{{ImageURL: *imageURL, IsPrimary: true}}
+}
+
+// parseBatchIDs parses a comma separated list of product or variant IDs, dropping duplicates.
+// kind names what the IDs are of in error messages.
+func parseBatchIDs(raw, kind string) ([]int, error) {
+	ids := []int{}
+	seen := map[int]bool{}
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, err := strconv.Atoi(part)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("Invalid %s ID %q", kind, part)
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("At least one %s ID is required", kind)
+	}
+	if len(ids) > MAX_BATCH_PRODUCT_IDS {
+		return nil, fmt.Errorf("At most %d %s IDs can be requested at once", MAX_BATCH_PRODUCT_IDS, kind)
+	}
+	return ids, nil
+}
+
+// getProductsByIDs returns compact summaries of the requested products in one query.
+// Unknown IDs are left out of the response.
+func (a *App) getProductsByIDs(w http.ResponseWriter, r *http.Request) {
+	ids, err := parseBatchIDs(r.URL.Query().Get("ids"), "product")
+	if err != nil {
+		web.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	rows, err := a.DB.Query(context.Background(),
+		`SELECT p.id, p.name, p.price, p.inventory, pi.image_url
+        FROM products p`+PRIMARY_IMAGE_JOIN+`
+        WHERE p.id = ANY($1)
+        ORDER BY p.id`, ids)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	products := []ProductSummary{}
+	for rows.Next() {
+		var p ProductSummary
+		if err := rows.Scan(&p.ID, &p.Name, &p.Price, &p.Inventory, &p.PrimaryImageURL); err != nil {
+			web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		products = append(products, p)
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, products)
+}
+
+// getVariantsByIDs returns compact summaries of the requested variants in one query,
+// named after their product and option values. Unknown IDs are left out of the response.
+func (a *App) getVariantsByIDs(w http.ResponseWriter, r *http.Request) {
+	ids, err := parseBatchIDs(r.URL.Query().Get("ids"), "variant")
+	if err != nil {
+		web.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	rows, err := a.DB.Query(context.Background(),
+		`SELECT v.id, v.product_id, v.sku, p.name || COALESCE(' (' || o.label || ')', ''),
+            COALESCE(v.price, p.price), v.inventory, COALESCE(o.options, '{}'), COALESCE(vi.image_url, pi.image_url)
+        FROM product_variants v
+        JOIN products p ON p.id = v.product_id
+        LEFT JOIN LATERAL (
+            SELECT string_agg(ov.value, ', ' ORDER BY po.position, po.id) AS label,
+                jsonb_object_agg(po.name, ov.value) AS options
+            FROM product_variant_values vv
+            JOIN product_option_values ov ON ov.id = vv.option_value_id
+            JOIN product_options po ON po.id = ov.option_id
+            WHERE vv.variant_id = v.id
+        ) o ON true
+        LEFT JOIN LATERAL (
+            SELECT image_url FROM product_images
+            WHERE variant_id = v.id
+            ORDER BY is_primary DESC, display_order, id
+            LIMIT 1
+        ) vi ON true`+PRIMARY_IMAGE_JOIN+`
+        WHERE v.id = ANY($1)
+        ORDER BY v.id`, ids)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	variants := []VariantSummary{}
+	for rows.Next() {
+		var v VariantSummary
+		if err := rows.Scan(&v.ID, &v.ProductID, &v.SKU, &v.Name, &v.Price, &v.Inventory, &v.Options,
+			&v.PrimaryImageURL); err != nil {
+			web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		variants = append(variants, v)
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, variants)
+}
@@ -4,7 +4,8 @@ CREATE TABLE IF NOT EXISTS products (
     name VARCHAR(255) NOT NULL,
     description TEXT,
     price DECIMAL(10, 2) NOT NULL,
-    inventory INTEGER NOT NULL DEFAULT 0,
+    inventory INTEGER NOT NULL DEFAULT 0 CHECK (inventory >= 0),
+    reserved INTEGER NOT NULL DEFAULT 0 CHECK (reserved >= 0),
     created_at TIMESTAMP NOT NULL,
     updated_at TIMESTAMP NOT NULL
     );
@@ -46,6 +47,290 @@ CREATE TABLE IF NOT EXISTS product_images (
     FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE
 );
 
+-- Stock held for orders (or checkouts in progress) until confirmed, released or expired
+CREATE TABLE IF NOT EXISTS stock_reservations (
+    id SERIAL PRIMARY KEY,
+    reference VARCHAR(100) NOT NULL,
+    product_id INTEGER NOT NULL,
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    status VARCHAR(20) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE
+);
+
+-- Option types a product comes in, such as size or color, and the values its variants pick from
+CREATE TABLE IF NOT EXISTS product_options (
+    id SERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL,
+    name VARCHAR(50) NOT NULL,
+    position INTEGER NOT NULL DEFAULT 0,
+    UNIQUE (product_id, name),
+    FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS product_option_values (
+    id SERIAL PRIMARY KEY,
+    option_id INTEGER NOT NULL,
+    value VARCHAR(100) NOT NULL,
+    position INTEGER NOT NULL DEFAULT 0,
+    UNIQUE (option_id, value),
+    FOREIGN KEY (option_id) REFERENCES product_options(id) ON DELETE CASCADE
+);
+
+-- Versions of a product that are sold and stocked on their own. Every product has at least one;
+-- products.inventory and products.reserved are kept as the totals of its variants
+CREATE TABLE IF NOT EXISTS product_variants (
+    id SERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL,
+    sku VARCHAR(64) NOT NULL UNIQUE,
+    price DECIMAL(10, 2), -- NULL sells at the product's price
+    inventory INTEGER NOT NULL DEFAULT 0 CHECK (inventory >= 0),
+    reserved INTEGER NOT NULL DEFAULT 0 CHECK (reserved >= 0),
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE
+);
+
+-- The option value a variant has for each of its product's options
+CREATE TABLE IF NOT EXISTS product_variant_values (
+    variant_id INTEGER NOT NULL,
+    option_value_id INTEGER NOT NULL,
+    PRIMARY KEY (variant_id, option_value_id),
+    FOREIGN KEY (variant_id) REFERENCES product_variants(id) ON DELETE CASCADE,
+    FOREIGN KEY (option_value_id) REFERENCES product_option_values(id) ON DELETE CASCADE
+);
+
+-- Images of a single variant; NULL for images of the product as a whole
+ALTER TABLE product_images
+    ADD COLUMN IF NOT EXISTS variant_id INTEGER REFERENCES product_variants(id) ON DELETE CASCADE;
+
+-- Reservations hold stock of a variant
+ALTER TABLE stock_reservations
+    ADD COLUMN IF NOT EXISTS variant_id INTEGER REFERENCES product_variants(id) ON DELETE CASCADE;
+
+-- Variant stock changed: recompute the product totals shown in listings and search
+CREATE OR REPLACE FUNCTION product_variants_stock_trigger() RETURNS trigger AS $$
+BEGIN
+    UPDATE products p SET
+        inventory = COALESCE((SELECT SUM(inventory) FROM product_variants WHERE product_id = p.id), 0),
+        reserved = COALESCE((SELECT SUM(reserved) FROM product_variants WHERE product_id = p.id), 0)
+    WHERE p.id = CASE WHEN TG_OP = 'DELETE' THEN OLD.product_id ELSE NEW.product_id END;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS product_variants_stock_update ON product_variants;
+CREATE TRIGGER product_variants_stock_update
+    AFTER INSERT OR DELETE OR UPDATE OF inventory, reserved ON product_variants
+    FOR EACH ROW EXECUTE FUNCTION product_variants_stock_trigger();
+
+-- Locations holding stock; order lines are fulfilled from active warehouses, lower priority first
+CREATE TABLE IF NOT EXISTS warehouses (
+    id SERIAL PRIMARY KEY,
+    code VARCHAR(20) NOT NULL UNIQUE,
+    name VARCHAR(100) NOT NULL,
+    priority INTEGER NOT NULL DEFAULT 0,
+    active BOOLEAN NOT NULL DEFAULT true,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
+
+-- Stock of each variant per warehouse. product_variants.inventory and reserved are kept as its totals
+CREATE TABLE IF NOT EXISTS stock_levels (
+    product_id INTEGER NOT NULL,
+    variant_id INTEGER NOT NULL,
+    warehouse_id INTEGER NOT NULL,
+    on_hand INTEGER NOT NULL DEFAULT 0 CHECK (on_hand >= 0),
+    reserved INTEGER NOT NULL DEFAULT 0 CHECK (reserved >= 0 AND reserved <= on_hand),
+    updated_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (variant_id, warehouse_id),
+    FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE,
+    FOREIGN KEY (variant_id) REFERENCES product_variants(id) ON DELETE CASCADE,
+    FOREIGN KEY (warehouse_id) REFERENCES warehouses(id)
+);
+
+-- Units moved between warehouses
+CREATE TABLE IF NOT EXISTS stock_transfers (
+    id SERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL,
+    variant_id INTEGER NOT NULL,
+    from_warehouse_id INTEGER NOT NULL,
+    to_warehouse_id INTEGER NOT NULL,
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    created_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE,
+    FOREIGN KEY (variant_id) REFERENCES product_variants(id) ON DELETE CASCADE,
+    FOREIGN KEY (from_warehouse_id) REFERENCES warehouses(id),
+    FOREIGN KEY (to_warehouse_id) REFERENCES warehouses(id)
+);
+
+-- Reservations hold stock at a warehouse
+ALTER TABLE stock_reservations
+    ADD COLUMN IF NOT EXISTS warehouse_id INTEGER REFERENCES warehouses(id);
+
+-- Stock at a location changed: recompute the variant totals, which in turn update the product's
+CREATE OR REPLACE FUNCTION stock_levels_trigger() RETURNS trigger AS $$
+BEGIN
+    UPDATE product_variants v SET
+        inventory = COALESCE((SELECT SUM(on_hand) FROM stock_levels WHERE variant_id = v.id), 0),
+        reserved = COALESCE((SELECT SUM(reserved) FROM stock_levels WHERE variant_id = v.id), 0)
+    WHERE v.id = CASE WHEN TG_OP = 'DELETE' THEN OLD.variant_id ELSE NEW.variant_id END;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS stock_levels_update ON stock_levels;
+CREATE TRIGGER stock_levels_update
+    AFTER INSERT OR DELETE OR UPDATE OF on_hand, reserved ON stock_levels
+    FOR EACH ROW EXECUTE FUNCTION stock_levels_trigger();
+
+-- Append-only ledger of every change to stock on hand. The movements of a variant at a
+-- warehouse add up to stock_levels.on_hand there; they outlive deleted products for the audit trail
+CREATE TABLE IF NOT EXISTS inventory_movements (
+    id BIGSERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL,
+    variant_id INTEGER NOT NULL,
+    warehouse_id INTEGER NOT NULL,
+    delta INTEGER NOT NULL CHECK (delta <> 0),
+    reason VARCHAR(30) NOT NULL,
+    source VARCHAR(50) NOT NULL,
+    order_id INTEGER,
+    actor VARCHAR(100),
+    created_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (warehouse_id) REFERENCES warehouses(id)
+);
+
+CREATE OR REPLACE FUNCTION inventory_movements_append_only_trigger() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'inventory_movements is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS inventory_movements_append_only ON inventory_movements;
+CREATE TRIGGER inventory_movements_append_only
+    BEFORE UPDATE OR DELETE ON inventory_movements
+    FOR EACH ROW EXECUTE FUNCTION inventory_movements_append_only_trigger();
+
+-- Stock levels the reconciliation job found out of line with the ledger
+CREATE TABLE IF NOT EXISTS inventory_discrepancies (
+    id SERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL,
+    variant_id INTEGER NOT NULL,
+    warehouse_id INTEGER NOT NULL,
+    on_hand INTEGER NOT NULL,
+    ledger_total INTEGER NOT NULL,
+    detected_at TIMESTAMP NOT NULL,
+    resolved_at TIMESTAMP,
+    FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE,
+    FOREIGN KEY (variant_id) REFERENCES product_variants(id) ON DELETE CASCADE,
+    FOREIGN KEY (warehouse_id) REFERENCES warehouses(id)
+);
+
+-- Available stock at or below which a product is reported as low on stock
+ALTER TABLE products
+    ADD COLUMN IF NOT EXISTS reorder_threshold INTEGER NOT NULL DEFAULT 10 CHECK (reorder_threshold >= 0);
+
+-- Stock events waiting to be published to RabbitMQ, written in the same transaction as the stock change
+CREATE TABLE IF NOT EXISTS stock_events (
+    id BIGSERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL,
+    event_type VARCHAR(20) NOT NULL,
+    available INTEGER NOT NULL,
+    reorder_threshold INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    published_at TIMESTAMP,
+    FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE
+);
+
+-- Set while the relay is publishing an event; an expired claim can be taken over
+ALTER TABLE stock_events ADD COLUMN IF NOT EXISTS claimed_until TIMESTAMP;
+
+-- Available stock of a product changed: record it when it fell to the reorder
+-- threshold, ran out or came back after running out
+CREATE OR REPLACE FUNCTION products_stock_events_trigger() RETURNS trigger AS $$
+DECLARE
+    old_available INTEGER := OLD.inventory - OLD.reserved;
+    new_available INTEGER := NEW.inventory - NEW.reserved;
+    kind VARCHAR(20);
+BEGIN
+    IF new_available = 0 AND old_available > 0 THEN
+        kind := 'out_of_stock';
+    ELSIF new_available > 0 AND old_available = 0 THEN
+        kind := 'back_in_stock';
+    ELSIF new_available <= NEW.reorder_threshold AND old_available > NEW.reorder_threshold THEN
+        kind := 'low_stock';
+    ELSE
+        RETURN NULL;
+    END IF;
+
+    INSERT INTO stock_events (product_id, event_type, available, reorder_threshold, created_at)
+    VALUES (NEW.id, kind, new_available, NEW.reorder_threshold, NOW());
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS products_stock_events ON products;
+CREATE TRIGGER products_stock_events
+    AFTER UPDATE OF inventory, reserved ON products
+    FOR EACH ROW EXECUTE FUNCTION products_stock_events_trigger();
+
+-- Price changes waiting to be published to RabbitMQ, written in the same transaction as the change
+CREATE TABLE IF NOT EXISTS price_events (
+    id BIGSERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL,
+    variant_id INTEGER, -- NULL when the product's price changed
+    old_price DECIMAL(10, 2) NOT NULL,
+    price DECIMAL(10, 2) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    published_at TIMESTAMP,
+    FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE
+);
+
+-- Set while the relay is publishing a price change; an expired claim can be taken over
+ALTER TABLE price_events ADD COLUMN IF NOT EXISTS claimed_until TIMESTAMP;
+
+CREATE OR REPLACE FUNCTION products_price_events_trigger() RETURNS trigger AS $$
+BEGIN
+    IF NEW.price <> OLD.price THEN
+        INSERT INTO price_events (product_id, old_price, price, created_at)
+        VALUES (NEW.id, OLD.price, NEW.price, NOW());
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS products_price_events ON products;
+CREATE TRIGGER products_price_events
+    AFTER UPDATE OF price ON products
+    FOR EACH ROW EXECUTE FUNCTION products_price_events_trigger();
+
+-- A variant's own price changed: record the change of the price it sells at
+CREATE OR REPLACE FUNCTION product_variants_price_events_trigger() RETURNS trigger AS $$
+DECLARE
+    product_price DECIMAL(10, 2);
+BEGIN
+    SELECT price INTO product_price FROM products WHERE id = NEW.product_id;
+    IF COALESCE(NEW.price, product_price) <> COALESCE(OLD.price, product_price) THEN
+        INSERT INTO price_events (product_id, variant_id, old_price, price, created_at)
+        VALUES (NEW.product_id, NEW.id, COALESCE(OLD.price, product_price), COALESCE(NEW.price, product_price), NOW());
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS product_variants_price_events ON product_variants;
+CREATE TRIGGER product_variants_price_events
+    AFTER UPDATE OF price ON product_variants
+    FOR EACH ROW EXECUTE FUNCTION product_variants_price_events_trigger();
+
+-- Inventory update events already applied, used to skip redelivered messages
+CREATE TABLE IF NOT EXISTS processed_events (
+    event_id VARCHAR(64) PRIMARY KEY,
+    processed_at TIMESTAMP NOT NULL
+);
+
 ALTER TABLE product_categories
     ADD COLUMN IF NOT EXISTS parent_id INTEGER,
     ADD COLUMN IF NOT EXISTS image_url VARCHAR(255),
@@ -56,8 +341,100 @@ ALTER TABLE product_categories
 CREATE INDEX IF NOT EXISTS idx_product_reviews_product_id ON product_reviews(product_id);
 CREATE INDEX IF NOT EXISTS idx_product_reviews_user_id ON product_reviews(user_id);
 CREATE INDEX IF NOT EXISTS idx_product_images_product_id ON product_images(product_id);
+CREATE INDEX IF NOT EXISTS idx_product_images_variant_id ON product_images(variant_id);
+CREATE INDEX IF NOT EXISTS idx_product_options_product_id ON product_options(product_id);
+CREATE INDEX IF NOT EXISTS idx_product_variants_product_id ON product_variants(product_id);
+CREATE INDEX IF NOT EXISTS idx_stock_levels_product_id ON stock_levels(product_id);
+CREATE INDEX IF NOT EXISTS idx_stock_levels_warehouse_id ON stock_levels(warehouse_id);
+CREATE INDEX IF NOT EXISTS idx_stock_transfers_variant_id ON stock_transfers(variant_id);
+CREATE INDEX IF NOT EXISTS idx_inventory_movements_product_id ON inventory_movements(product_id);
+CREATE INDEX IF NOT EXISTS idx_inventory_movements_location ON inventory_movements(variant_id, warehouse_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_inventory_discrepancies_open ON inventory_discrepancies(variant_id, warehouse_id) WHERE resolved_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_stock_events_pending ON stock_events(id) WHERE published_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_price_events_pending ON price_events(id) WHERE published_at IS NULL;
 CREATE INDEX IF NOT EXISTS idx_product_categories_parent_id ON product_categories(parent_id);
+CREATE INDEX IF NOT EXISTS idx_stock_reservations_reference ON stock_reservations(reference);
+CREATE INDEX IF NOT EXISTS idx_stock_reservations_expires_at ON stock_reservations(expires_at) WHERE status = 'reserved';
+DROP INDEX IF EXISTS idx_stock_reservations_active;
+DROP INDEX IF EXISTS idx_stock_reservations_active_variant;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_stock_reservations_active_location ON stock_reservations(reference, variant_id, warehouse_id) WHERE status IN ('reserved', 'confirmed');
+
+
+-- Full-text search: a weighted document per product (name > description > category names)
+-- kept up to date by triggers, plus trigram indexes for typo tolerant name matching
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+ALTER TABLE products ADD COLUMN IF NOT EXISTS search_vector tsvector;
+
+CREATE OR REPLACE FUNCTION product_search_vector(p_id INTEGER, p_name TEXT, p_description TEXT)
+RETURNS tsvector AS $$
+    SELECT setweight(to_tsvector('english', coalesce(p_name, '')), 'A') ||
+           setweight(to_tsvector('english', coalesce(p_description, '')), 'B') ||
+           setweight(to_tsvector('english', coalesce((
+               SELECT string_agg(c.name, ' ')
+               FROM product_category_map pcm
+               JOIN product_categories c ON c.id = pcm.category_id
+               WHERE pcm.product_id = p_id), '')), 'C');
+$$ LANGUAGE SQL STABLE;
 
+-- Product name or description written
+CREATE OR REPLACE FUNCTION products_search_vector_trigger() RETURNS trigger AS $$
+BEGIN
+    NEW.search_vector := product_search_vector(NEW.id, NEW.name, NEW.description);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS products_search_vector_update ON products;
+CREATE TRIGGER products_search_vector_update
+    BEFORE INSERT OR UPDATE OF name, description ON products
+    FOR EACH ROW EXECUTE FUNCTION products_search_vector_trigger();
+
+-- Product added to or removed from a category
+CREATE OR REPLACE FUNCTION product_category_map_search_vector_trigger() RETURNS trigger AS $$
+BEGIN
+    UPDATE products SET search_vector = product_search_vector(id, name, description)
+    WHERE id = CASE WHEN TG_OP = 'DELETE' THEN OLD.product_id ELSE NEW.product_id END;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS product_category_map_search_vector_update ON product_category_map;
+CREATE TRIGGER product_category_map_search_vector_update
+    AFTER INSERT OR DELETE ON product_category_map
+    FOR EACH ROW EXECUTE FUNCTION product_category_map_search_vector_trigger();
+
+-- Category renamed
+CREATE OR REPLACE FUNCTION product_categories_search_vector_trigger() RETURNS trigger AS $$
+BEGIN
+    UPDATE products SET search_vector = product_search_vector(id, name, description)
+    WHERE id IN (SELECT product_id FROM product_category_map WHERE category_id = NEW.id);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS product_categories_search_vector_update ON product_categories;
+CREATE TRIGGER product_categories_search_vector_update
+    AFTER UPDATE OF name ON product_categories
+    FOR EACH ROW EXECUTE FUNCTION product_categories_search_vector_trigger();
+
+UPDATE products SET search_vector = product_search_vector(id, name, description);
+
+CREATE INDEX IF NOT EXISTS idx_products_search_vector ON products USING GIN (search_vector);
+CREATE INDEX IF NOT EXISTS idx_products_name_trgm ON products USING GIN (name gin_trgm_ops);
+
+CREATE INDEX IF NOT EXISTS idx_product_categories_name_trgm ON product_categories USING GIN (name gin_trgm_ops);
+
+-- Search terms as typed into GET /products/search, used to suggest popular queries
+CREATE TABLE IF NOT EXISTS search_log (
+    id BIGSERIAL PRIMARY KEY,
+    query VARCHAR(200) NOT NULL,
+    result_count INTEGER NOT NULL,
+    searched_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_search_log_query ON search_log(query text_pattern_ops);
+CREATE INDEX IF NOT EXISTS idx_search_log_searched_at ON search_log(searched_at);
 
 -- Insert sample data
 INSERT INTO products (name, description, price, inventory, created_at, updated_at)
@@ -68,6 +445,69 @@ VALUES
     ('Smart Watch', 'Fitness and health tracking smart watch', 249.99, 75, NOW(), NOW()),
     ('Ultra HD TV', '65-inch 4K Ultra HD Smart TV', 799.99, 20, NOW(), NOW());
 
+-- Products from before variants sell as a single default variant holding their stock
+INSERT INTO product_variants (product_id, sku, inventory, reserved, created_at, updated_at)
+SELECT p.id, 'SKU-' || p.id, p.inventory, p.reserved, NOW(), NOW()
+FROM products p
+WHERE NOT EXISTS (SELECT 1 FROM product_variants v WHERE v.product_id = p.id)
+ORDER BY p.id;
+
+UPDATE stock_reservations r SET variant_id = v.id
+FROM product_variants v
+WHERE r.variant_id IS NULL AND v.product_id = r.product_id AND v.sku = 'SKU-' || r.product_id;
+
+-- Smartphone X comes in two storage sizes
+INSERT INTO product_options (product_id, name, position)
+VALUES
+    (1, 'storage', 1),
+    (1, 'color', 2);
+
+INSERT INTO product_option_values (option_id, value, position)
+VALUES
+    (1, '128GB', 1),
+    (1, '256GB', 2),
+    (2, 'Black', 1);
+
+INSERT INTO product_variants (product_id, sku, price, inventory, created_at, updated_at)
+VALUES
+    (1, 'SPX-256-BLK', 1099.99, 20, NOW(), NOW());
+
+INSERT INTO product_variant_values (variant_id, option_value_id)
+VALUES
+    (1, 1), -- SKU-1: 128GB
+    (1, 3), -- SKU-1: Black
+    (6, 2), -- SPX-256-BLK: 256GB
+    (6, 3); -- SPX-256-BLK: Black
+
+INSERT INTO warehouses (code, name, priority, active, created_at, updated_at)
+VALUES
+    ('MAIN', 'Main warehouse', 1, true, NOW(), NOW()),
+    ('EAST', 'East coast warehouse', 2, true, NOW(), NOW());
+
+-- Stock from before warehouses is held at the main warehouse
+INSERT INTO stock_levels (product_id, variant_id, warehouse_id, on_hand, reserved, updated_at)
+SELECT v.product_id, v.id, w.id, v.inventory, v.reserved, NOW()
+FROM product_variants v
+JOIN warehouses w ON w.code = 'MAIN'
+WHERE NOT EXISTS (SELECT 1 FROM stock_levels s WHERE s.variant_id = v.id)
+ORDER BY v.id;
+
+UPDATE stock_reservations SET warehouse_id = (SELECT id FROM warehouses WHERE code = 'MAIN')
+WHERE warehouse_id IS NULL;
+
+-- Wireless Headphones are also stocked on the east coast
+INSERT INTO stock_levels (product_id, variant_id, warehouse_id, on_hand, reserved, updated_at)
+VALUES
+    (3, 3, 2, 40, 0, NOW());
+
+-- Stock on hand before the ledger was kept opens it
+INSERT INTO inventory_movements (product_id, variant_id, warehouse_id, delta, reason, source, created_at)
+SELECT s.product_id, s.variant_id, s.warehouse_id, s.on_hand, 'opening_balance', 'product-service', NOW()
+FROM stock_levels s
+WHERE s.on_hand <> 0
+  AND NOT EXISTS (SELECT 1 FROM inventory_movements m WHERE m.variant_id = s.variant_id AND m.warehouse_id = s.warehouse_id)
+ORDER BY s.variant_id, s.warehouse_id;
+
 INSERT INTO product_categories (name, description)
 VALUES
     ('Electronics', 'Electronic devices and gadgets'),
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"log"
+	"pkg-iae/messages"
+	"time"
+)
+
+const (
+	PRODUCT_EVENT_POLL_INTERVAL = 2 * time.Second
+	PRODUCT_EVENT_BATCH_SIZE    = 100
+	// PRODUCT_EVENT_CONFIRM_TIMEOUT bounds the wait for the broker to acknowledge an event
+	PRODUCT_EVENT_CONFIRM_TIMEOUT = 5 * time.Second
+	// PRODUCT_EVENT_LEASE is how long a claimed batch is left to one relay; it outlasts
+	// a batch of publishes that all wait out their confirm
+	PRODUCT_EVENT_LEASE = 10 * time.Minute
+)
+
+// STOCK_EVENT_TOPICS maps the event types written by the products_stock_events trigger to their topics
+var STOCK_EVENT_TOPICS = map[string]messages.Topic[messages.StockEvent]{
+	"low_stock":     messages.ProductLowStock,
+	"out_of_stock":  messages.ProductOutOfStock,
+	"back_in_stock": messages.ProductBackInStock,
+}
+
+// relayProductEvents periodically publishes the stock and price events recorded by the database
+func (a *App) relayProductEvents() {
+	ticker := time.NewTicker(PRODUCT_EVENT_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	relays := []struct {
+		name    string
+		publish func() (int, error)
+	}{
+		{"stock", a.publishStockEvents},
+		{"price", a.publishPriceEvents},
+	}
+
+	for range ticker.C {
+		for _, relay := range relays {
+			for {
+				published, err := relay.publish()
+				if err != nil {
+					log.Printf("Error publishing %s events: %v", relay.name, err)
+					break
+				}
+				if published < PRODUCT_EVENT_BATCH_SIZE {
+					break
+				}
+			}
+		}
+	}
+}
+
+// publishStockEvents publishes one batch of pending stock events in the order they
+// happened and marks each one as published once the broker has confirmed it. The
+// batch is claimed by setting claimed_until, so no transaction stays open while
+// waiting for the broker. It stops at the first failure and releases the rest,
+// which is published again on the next poll.
+func (a *App) publishStockEvents() (int, error) {
+	ctx := context.Background()
+	rows, err := a.DB.Query(ctx, `
+        WITH claimed AS (
+            UPDATE stock_events SET claimed_until = $1
+            WHERE id IN (
+                SELECT id FROM stock_events
+                WHERE published_at IS NULL AND (claimed_until IS NULL OR claimed_until <= NOW())
+                ORDER BY id
+                LIMIT $2
+                FOR UPDATE SKIP LOCKED
+            )
+            RETURNING id, event_type, product_id, available, reorder_threshold, created_at
+        )
+        SELECT c.id, c.event_type, c.product_id, p.name, c.available, c.reorder_threshold, c.created_at
+        FROM claimed c
+        JOIN products p ON p.id = c.product_id
+        ORDER BY c.id`,
+		time.Now().Add(PRODUCT_EVENT_LEASE), PRODUCT_EVENT_BATCH_SIZE)
+	if err != nil {
+		return 0, err
+	}
+
+	type pendingEvent struct {
+		id        int64
+		eventType string
+		event     messages.StockEvent
+	}
+	pending := []pendingEvent{}
+	ids := []int64{}
+	for rows.Next() {
+		var e pendingEvent
+		if err := rows.Scan(&e.id, &e.eventType, &e.event.ProductID, &e.event.Name, &e.event.Available,
+			&e.event.ReorderThreshold, &e.event.OccurredAt); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		e.event.EventID = fmt.Sprintf("stock-%d", e.id)
+		pending = append(pending, e)
+		ids = append(ids, e.id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	published := 0
+	var publishErr error
+	for _, e := range pending {
+		topic, ok := STOCK_EVENT_TOPICS[e.eventType]
+		if !ok {
+			log.Printf("Skipping stock event %d of unknown type %q", e.id, e.eventType)
+		} else if publishErr = a.publishConfirmed(ctx, func(ctx context.Context, ch *amqp.Channel) error {
+			return topic.PublishConfirmed(ctx, ch, e.event)
+		}); publishErr != nil {
+			break
+		}
+
+		if publishErr = a.markEventPublished(ctx, "stock_events", e.id); publishErr != nil {
+			break
+		}
+		published++
+	}
+	a.releaseEvents(ctx, "stock_events", ids[published:])
+
+	return published, publishErr
+}
+
+// publishPriceEvents publishes one batch of pending price changes like publishStockEvents
+func (a *App) publishPriceEvents() (int, error) {
+	ctx := context.Background()
+	rows, err := a.DB.Query(ctx, `
+        WITH claimed AS (
+            UPDATE price_events SET claimed_until = $1
+            WHERE id IN (
+                SELECT id FROM price_events
+                WHERE published_at IS NULL AND (claimed_until IS NULL OR claimed_until <= NOW())
+                ORDER BY id
+                LIMIT $2
+                FOR UPDATE SKIP LOCKED
+            )
+            RETURNING id, product_id, variant_id, old_price, price, created_at
+        )
+        SELECT c.id, c.product_id, COALESCE(c.variant_id, 0), p.name, c.old_price, c.price, c.created_at
+        FROM claimed c
+        JOIN products p ON p.id = c.product_id
+        ORDER BY c.id`,
+		time.Now().Add(PRODUCT_EVENT_LEASE), PRODUCT_EVENT_BATCH_SIZE)
+	if err != nil {
+		return 0, err
+	}
+
+	pending := []messages.PriceChange{}
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		var e messages.PriceChange
+		if err := rows.Scan(&id, &e.ProductID, &e.VariantID, &e.Name, &e.OldPrice, &e.Price, &e.ChangedAt); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		e.EventID = fmt.Sprintf("price-%d", id)
+		pending = append(pending, e)
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	published := 0
+	var publishErr error
+	for i, e := range pending {
+		if publishErr = a.publishConfirmed(ctx, func(ctx context.Context, ch *amqp.Channel) error {
+			return messages.ProductPriceChanged.PublishConfirmed(ctx, ch, e)
+		}); publishErr != nil {
+			break
+		}
+
+		if publishErr = a.markEventPublished(ctx, "price_events", ids[i]); publishErr != nil {
+			break
+		}
+		published++
+	}
+	a.releaseEvents(ctx, "price_events", ids[published:])
+
+	return published, publishErr
+}
+
+// publishConfirmed runs publish on the confirm-mode channel and waits at most
+// PRODUCT_EVENT_CONFIRM_TIMEOUT for the broker to acknowledge it
+func (a *App) publishConfirmed(ctx context.Context, publish func(context.Context, *amqp.Channel) error) error {
+	ch, err := a.ConfirmChannel()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, PRODUCT_EVENT_CONFIRM_TIMEOUT)
+	defer cancel()
+
+	if err := publish(ctx, ch); err != nil {
+		// The channel state is unknown after a missed confirm, so start over with a fresh one
+		ch.Close()
+		return err
+	}
+	return nil
+}
+
+// markEventPublished marks a claimed event of a stock_events or price_events table as published
+func (a *App) markEventPublished(ctx context.Context, table string, id int64) error {
+	_, err := a.DB.Exec(ctx, "UPDATE "+table+" SET published_at = NOW(), claimed_until = NULL WHERE id = $1", id)
+	return err
+}
+
+// releaseEvents gives up the claim on events that were not published, so the next poll
+// publishes them before any later event
+func (a *App) releaseEvents(ctx context.Context, table string, ids []int64) {
+	if len(ids) == 0 {
+		return
+	}
+	if _, err := a.DB.Exec(ctx, "UPDATE "+table+" SET claimed_until = NULL WHERE id = ANY($1)", ids); err != nil {
+		log.Printf("Error releasing %s: %v", table, err)
+	}
+}
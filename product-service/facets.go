@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+var (
+	// PRICE_FACET_BOUNDS are the lower bounds of the price ranges counted by search;
+	// each range ends where the next begins and the last is open ended
+	PRICE_FACET_BOUNDS = []float64{0, 50, 100, 250, 500, 1000}
+	// RATING_FACET_MINIMUMS are the "and up" average ratings counted by search
+	RATING_FACET_MINIMUMS = []float64{4, 3, 2, 1}
+)
+
+// SearchFacets counts the products matching a search per category, price range and rating
+type SearchFacets struct {
+	Categories  []CategoryFacet `json:"categories"`
+	PriceRanges []RangeFacet    `json:"price_ranges"`
+	Ratings     []RangeFacet    `json:"ratings"`
+}
+
+// CategoryFacet is the number of matching products in a category
+type CategoryFacet struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// RangeFacet is the number of matching products with a value from Min up to,
+// but not including, Max. There is no upper bound when Max is nil.
+type RangeFacet struct {
+	Min   float64  `json:"min"`
+	Max   *float64 `json:"max,omitempty"`
+	Count int      `json:"count"`
+}
+
+// searchFacets counts the products matching the filter, in total and per facet
+func (a *App) searchFacets(ctx context.Context, filter searchFilter) (SearchFacets, int, error) {
+	facets := SearchFacets{
+		Categories:  []CategoryFacet{},
+		PriceRanges: []RangeFacet{},
+		Ratings:     []RangeFacet{},
+	}
+
+	matches, args := searchQuery(filter, "p.id, p.price, COALESCE(ratings.avg_rating, 0) AS avg_rating").Build()
+
+	// Price and rating ranges are fixed, so all of them are counted in one pass
+	counts := []string{"COUNT(*)"}
+	for i, min := range PRICE_FACET_BOUNDS {
+		facet := RangeFacet{Min: min}
+		condition := fmt.Sprintf("price >= %g", min)
+		if i+1 < len(PRICE_FACET_BOUNDS) {
+			max := PRICE_FACET_BOUNDS[i+1]
+			facet.Max = &max
+			condition += fmt.Sprintf(" AND price < %g", max)
+		}
+		facets.PriceRanges = append(facets.PriceRanges, facet)
+		counts = append(counts, "COUNT(*) FILTER (WHERE "+condition+")")
+	}
+	for _, min := range RATING_FACET_MINIMUMS {
+		facets.Ratings = append(facets.Ratings, RangeFacet{Min: min})
+		counts = append(counts, fmt.Sprintf("COUNT(*) FILTER (WHERE avg_rating >= %g)", min))
+	}
+
+	var total int
+	dest := []interface{}{&total}
+	for i := range facets.PriceRanges {
+		dest = append(dest, &facets.PriceRanges[i].Count)
+	}
+	for i := range facets.Ratings {
+		dest = append(dest, &facets.Ratings[i].Count)
+	}
+
+	err := a.DB.QueryRow(ctx,
+		"WITH matches AS ("+matches+")\nSELECT "+strings.Join(counts, ", ")+" FROM matches",
+		args...).Scan(dest...)
+	if err != nil {
+		return facets, 0, fmt.Errorf("unable to count search facets: %v", err)
+	}
+
+	rows, err := a.DB.Query(ctx, `WITH matches AS (`+matches+`)
+        SELECT c.id, c.name, COUNT(*)
+        FROM matches m
+        JOIN product_category_map pcm ON pcm.product_id = m.id
+        JOIN product_categories c ON c.id = pcm.category_id
+        GROUP BY c.id, c.name
+        ORDER BY COUNT(*) DESC, c.name`, args...)
+	if err != nil {
+		return facets, 0, fmt.Errorf("unable to count search categories: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c CategoryFacet
+		if err := rows.Scan(&c.ID, &c.Name, &c.Count); err != nil {
+			return facets, 0, fmt.Errorf("unable to count search categories: %v", err)
+		}
+		facets.Categories = append(facets.Categories, c)
+	}
+
+	return facets, total, rows.Err()
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"net/http"
+	"pkg-iae/auth"
+	"pkg-iae/messages"
+	"pkg-iae/models"
+	"pkg-iae/web"
+	"strconv"
+	"time"
+)
+
+// Ledger types, see pkg-iae/models
+type (
+	InventoryMovement    = models.InventoryMovement
+	InventoryDiscrepancy = models.InventoryDiscrepancy
+)
+
+// MOVEMENT_LIST describes how GET /products/{id}/inventory/history can be paged, sorted and projected
+var MOVEMENT_LIST = web.ListSpec{
+	Sorts: map[string]string{
+		"id":         "id",
+		"created_at": "created_at",
+	},
+	DefaultSort: "-id",
+	IDColumn:    "id",
+	Fields:      []string{"id", "product_id", "variant_id", "warehouse_id", "delta", "reason", "source", "order_id", "actor", "created_at"},
+}
+
+// stockMovement says why stock on hand changes, for the inventory ledger
+type stockMovement struct {
+	Reason  string
+	Source  string
+	OrderID int    // Zero when the change is not for an order
+	Actor   string // Empty when no caller made the change, such as for queued updates
+}
+
+// movementBy describes a change made by the caller of a request
+func movementBy(r *http.Request, reason string) stockMovement {
+	m := stockMovement{Reason: reason, Source: messages.SERVICE_PRODUCT}
+	if p := auth.PrincipalFrom(r.Context()); p != nil {
+		m.Actor = p.Subject()
+	}
+	return m
+}
+
+// recordMovement appends a change of a variant's stock at a warehouse to the ledger
+func recordMovement(ctx context.Context, tx pgx.Tx, variantID, warehouseID, delta int, m stockMovement) error {
+	_, err := tx.Exec(ctx, `
+        INSERT INTO inventory_movements (product_id, variant_id, warehouse_id, delta, reason, source, order_id, actor, created_at)
+        SELECT product_id, id, $2, $3, $4, $5, NULLIF($6, 0), NULLIF($7, ''), NOW() FROM product_variants WHERE id = $1`,
+		variantID, warehouseID, delta, m.Reason, m.Source, m.OrderID, m.Actor)
+	return err
+}
+
+// reconcileInventory periodically compares stock on hand with the ledger. Stock levels
+// that differ are flagged as discrepancies, and flags are cleared once they match again.
+func (a *App) reconcileInventory() {
+	ticker := time.NewTicker(a.Config.ReconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			result, err := a.DB.Exec(context.Background(), `
+                INSERT INTO inventory_discrepancies (product_id, variant_id, warehouse_id, on_hand, ledger_total, detected_at)
+                SELECT s.product_id, s.variant_id, s.warehouse_id, s.on_hand, COALESCE(m.total, 0), NOW()
+                FROM stock_levels s
+                LEFT JOIN (
+                    SELECT variant_id, warehouse_id, SUM(delta) AS total
+                    FROM inventory_movements
+                    GROUP BY variant_id, warehouse_id
+                ) m ON m.variant_id = s.variant_id AND m.warehouse_id = s.warehouse_id
+                WHERE s.on_hand <> COALESCE(m.total, 0)
+                ON CONFLICT (variant_id, warehouse_id) WHERE resolved_at IS NULL
+                DO UPDATE SET on_hand = EXCLUDED.on_hand, ledger_total = EXCLUDED.ledger_total`)
+			if err != nil {
+				log.Printf("Error reconciling inventory: %v", err)
+				continue
+			}
+			if rowsAffected := result.RowsAffected(); rowsAffected > 0 {
+				log.Printf("Inventory drift: %d stock levels do not match the ledger", rowsAffected)
+			}
+
+			result, err = a.DB.Exec(context.Background(), `
+                UPDATE inventory_discrepancies d SET resolved_at = NOW()
+                FROM stock_levels s
+                WHERE d.resolved_at IS NULL AND s.variant_id = d.variant_id AND s.warehouse_id = d.warehouse_id
+                  AND s.on_hand = (
+                      SELECT COALESCE(SUM(delta), 0) FROM inventory_movements m
+                      WHERE m.variant_id = s.variant_id AND m.warehouse_id = s.warehouse_id
+                  )`)
+			if err != nil {
+				log.Printf("Error clearing reconciled inventory discrepancies: %v", err)
+				continue
+			}
+			if rowsAffected := result.RowsAffected(); rowsAffected > 0 {
+				log.Printf("Cleared %d inventory discrepancies that match the ledger again", rowsAffected)
+			}
+		}
+	}
+}
+
+// getInventoryHistory returns the ledger of a product's stock, newest first by default.
+// It can be narrowed with ?variant_id=, ?warehouse_id= and ?reason=.
+func (a *App) getInventoryHistory(w http.ResponseWriter, r *http.Request) {
+	productID := web.ParseInt(mux.Vars(r)["id"])
+
+	var exists bool
+	err := a.DB.QueryRow(r.Context(), "SELECT EXISTS(SELECT 1 FROM products WHERE id = $1)", productID).Scan(&exists)
+	if err != nil || !exists {
+		web.RespondWithError(w, http.StatusNotFound, "Product not found")
+		return
+	}
+
+	q := r.URL.Query()
+	params, errs := web.ParseListParams(q, MOVEMENT_LIST)
+	if errs == nil {
+		errs = web.FieldErrors{}
+	}
+
+	where := "product_id = $1"
+	args := []interface{}{productID}
+	for _, filter := range []string{"variant_id", "warehouse_id"} {
+		if raw := q.Get(filter); raw != "" {
+			id, err := strconv.Atoi(raw)
+			if err != nil || id <= 0 {
+				errs.Add(filter, "must be a positive integer")
+				continue
+			}
+			args = append(args, id)
+			where += " AND " + filter + " = $" + strconv.Itoa(len(args))
+		}
+	}
+	if reason := q.Get("reason"); reason != "" {
+		args = append(args, reason)
+		where += " AND reason = $" + strconv.Itoa(len(args))
+	}
+	if len(errs) > 0 {
+		web.RespondWithFieldErrors(w, "Invalid list parameters", errs)
+		return
+	}
+
+	query, args := params.Page("SELECT id, product_id, variant_id, warehouse_id, delta, reason, source, order_id, actor, created_at, "+params.KeyColumns()+" FROM inventory_movements",
+		where, args...)
+	rows, err := a.DB.Query(r.Context(), query, args...)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	movements := []InventoryMovement{}
+	keys := []web.CursorKey{}
+	for rows.Next() {
+		var m InventoryMovement
+		var key web.CursorKey
+		if err := rows.Scan(&m.ID, &m.ProductID, &m.VariantID, &m.WarehouseID, &m.Delta, &m.Reason, &m.Source,
+			&m.OrderID, &m.Actor, &m.CreatedAt, &key.Value, &key.ID); err != nil {
+			web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		movements = append(movements, m)
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	movements, next := web.Paginate(params, movements, keys)
+	web.RespondWithList(w, r, params, movements, next)
+}
+
+// getInventoryDiscrepancies lists the stock levels flagged by reconciliation that are not resolved yet
+func (a *App) getInventoryDiscrepancies(w http.ResponseWriter, r *http.Request) {
+	rows, err := a.DB.Query(r.Context(), `
+        SELECT id, product_id, variant_id, warehouse_id, on_hand, ledger_total, detected_at, resolved_at
+        FROM inventory_discrepancies
+        WHERE resolved_at IS NULL
+        ORDER BY detected_at, id`)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	discrepancies := []InventoryDiscrepancy{}
+	for rows.Next() {
+		var d InventoryDiscrepancy
+		if err := rows.Scan(&d.ID, &d.ProductID, &d.VariantID, &d.WarehouseID, &d.OnHand, &d.LedgerTotal,
+			&d.DetectedAt, &d.ResolvedAt); err != nil {
+			web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		discrepancies = append(discrepancies, d)
+	}
+	if err := rows.Err(); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, discrepancies)
+}
+
+// resolveInventoryDiscrepancy accepts the stock on hand as counted: the difference to
+// the ledger is booked as a reconciliation movement and the discrepancy is closed
+func (a *App) resolveInventoryDiscrepancy(w http.ResponseWriter, r *http.Request) {
+	id := web.ParseInt(mux.Vars(r)["id"])
+
+	tx, err := a.DB.Begin(r.Context())
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	var d InventoryDiscrepancy
+	err = tx.QueryRow(r.Context(), `
+        SELECT id, product_id, variant_id, warehouse_id, detected_at
+        FROM inventory_discrepancies
+        WHERE id = $1 AND resolved_at IS NULL
+        FOR UPDATE`,
+		id).Scan(&d.ID, &d.ProductID, &d.VariantID, &d.WarehouseID, &d.DetectedAt)
+	if err == pgx.ErrNoRows {
+		web.RespondWithError(w, http.StatusNotFound, "Open discrepancy not found")
+		return
+	}
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Stock may have moved since the discrepancy was detected; compare it again under lock
+	err = tx.QueryRow(r.Context(), `
+        SELECT s.on_hand, (
+            SELECT COALESCE(SUM(delta), 0) FROM inventory_movements m
+            WHERE m.variant_id = s.variant_id AND m.warehouse_id = s.warehouse_id
+        )
+        FROM stock_levels s
+        WHERE s.variant_id = $1 AND s.warehouse_id = $2
+        FOR UPDATE OF s`,
+		d.VariantID, d.WarehouseID).Scan(&d.OnHand, &d.LedgerTotal)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if delta := d.OnHand - d.LedgerTotal; delta != 0 {
+		if err := recordMovement(r.Context(), tx, d.VariantID, d.WarehouseID, delta, movementBy(r, models.MOVEMENT_RECONCILIATION)); err != nil {
+			web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	err = tx.QueryRow(r.Context(),
+		"UPDATE inventory_discrepancies SET on_hand = $1, ledger_total = $2, resolved_at = NOW() WHERE id = $3 RETURNING resolved_at",
+		d.OnHand, d.LedgerTotal, d.ID).Scan(&d.ResolvedAt)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := tx.Commit(r.Context()); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, d)
+}
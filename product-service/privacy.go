@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+	"net/http"
+	"pkg-iae/auth"
+	"pkg-iae/web"
+)
+
+// UserExport is the part of a user's data export held by the Product Service
+type UserExport struct {
+	Reviews []Review `json:"reviews"`
+}
+
+// exportUserData returns everything the Product Service holds about a user
+func (a *App) exportUserData(w http.ResponseWriter, r *http.Request) {
+	userID := web.ParseInt(mux.Vars(r)["user_id"])
+
+	if !auth.AuthorizeUser(w, r, userID, auth.PERM_PRIVACY_MANAGE) {
+		return
+	}
+
+	rows, err := a.DB.Query(r.Context(),
+		"SELECT id, product_id, user_id, rating, review_text, created_at, updated_at FROM product_reviews WHERE user_id = $1 ORDER BY id",
+		userID)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	export := UserExport{Reviews: []Review{}}
+	for rows.Next() {
+		var review Review
+		if err := rows.Scan(&review.ID, &review.ProductID, &review.UserID, &review.Rating, &review.ReviewText,
+			&review.CreatedAt, &review.UpdatedAt); err != nil {
+			web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		export.Reviews = append(export.Reviews, review)
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, export)
+}
+
+// eraseUserData removes a deleted user's reviews. Ratings are computed from
+// the remaining reviews, so nothing else needs updating.
+func eraseUserData(ctx context.Context, tx pgx.Tx, userID int) error {
+	_, err := tx.Exec(ctx, "DELETE FROM product_reviews WHERE user_id = $1", userID)
+	return err
+}
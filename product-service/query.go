@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// queryBuilder assembles a SELECT whose values are always sent as positional
+// parameters, so nothing taken from a request ends up in the SQL text.
+// Conditions use ? for each value; the builder numbers them $1, $2, ...
+type queryBuilder struct {
+	selectClause string
+	joins        []string
+	where        []string
+	groupBy      string
+	having       []string
+	orderBy      string
+	limit        string
+	args         []interface{}
+}
+
+// newQueryBuilder starts a query from its SELECT ... FROM clause
+func newQueryBuilder(selectClause string) *queryBuilder {
+	return &queryBuilder{selectClause: selectClause}
+}
+
+// Join adds a JOIN clause
+func (b *queryBuilder) Join(clause string, values ...interface{}) *queryBuilder {
+	b.joins = append(b.joins, b.bind(clause, values))
+	return b
+}
+
+// Where adds a condition to the WHERE clause; conditions are ANDed
+func (b *queryBuilder) Where(condition string, values ...interface{}) *queryBuilder {
+	b.where = append(b.where, b.bind(condition, values))
+	return b
+}
+
+// GroupBy sets the GROUP BY clause
+func (b *queryBuilder) GroupBy(columns string) *queryBuilder {
+	b.groupBy = columns
+	return b
+}
+
+// Having adds a condition to the HAVING clause; conditions are ANDed
+func (b *queryBuilder) Having(condition string, values ...interface{}) *queryBuilder {
+	b.having = append(b.having, b.bind(condition, values))
+	return b
+}
+
+// OrderBy sets the ORDER BY clause. It must come from a fixed list, never from the request.
+func (b *queryBuilder) OrderBy(clause string) *queryBuilder {
+	b.orderBy = clause
+	return b
+}
+
+// Limit sets the LIMIT clause
+func (b *queryBuilder) Limit(n int) *queryBuilder {
+	b.limit = b.arg(n)
+	return b
+}
+
+// Build returns the SQL and its arguments
+func (b *queryBuilder) Build() (string, []interface{}) {
+	var sql strings.Builder
+	sql.WriteString(b.selectClause)
+	for _, join := range b.joins {
+		sql.WriteString("\n")
+		sql.WriteString(join)
+	}
+	if len(b.where) > 0 {
+		sql.WriteString("\nWHERE ")
+		sql.WriteString(strings.Join(b.where, " AND "))
+	}
+	if b.groupBy != "" {
+		sql.WriteString("\nGROUP BY ")
+		sql.WriteString(b.groupBy)
+	}
+	if len(b.having) > 0 {
+		sql.WriteString("\nHAVING ")
+		sql.WriteString(strings.Join(b.having, " AND "))
+	}
+	if b.orderBy != "" {
+		sql.WriteString("\nORDER BY ")
+		sql.WriteString(b.orderBy)
+	}
+	if b.limit != "" {
+		sql.WriteString("\nLIMIT ")
+		sql.WriteString(b.limit)
+	}
+	return sql.String(), b.args
+}
+
+// arg adds a value to the arguments and returns its placeholder
+func (b *queryBuilder) arg(value interface{}) string {
+	b.args = append(b.args, value)
+	return "$" + strconv.Itoa(len(b.args))
+}
+
+// bind replaces each ? in a clause with the placeholder of the matching value
+func (b *queryBuilder) bind(clause string, values []interface{}) string {
+	if strings.Count(clause, "?") != len(values) {
+		panic("queryBuilder: placeholder count does not match values in " + clause)
+	}
+
+	var out strings.Builder
+	for _, value := range values {
+		i := strings.Index(clause, "?")
+		out.WriteString(clause[:i])
+		out.WriteString(b.arg(value))
+		clause = clause[i+1:]
+	}
+	out.WriteString(clause)
+	return out.String()
+}
+
+// escapeLike escapes the LIKE wildcards in s so it is matched literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"math"
+	"net/http"
+	"pkg-iae/web"
+	"sort"
+)
+
+// ReorderSuggestion proposes restocking a product that is low or will be before a delivery could arrive
+type ReorderSuggestion struct {
+	ProductID         int      `json:"product_id"`
+	Name              string   `json:"name"`
+	OnHand            int      `json:"on_hand"`
+	Reserved          int      `json:"reserved"`
+	Available         int      `json:"available"`
+	ReorderThreshold  int      `json:"reorder_threshold"`
+	UnitsSold         int      `json:"units_sold"`
+	DailySales        float64  `json:"daily_sales"`
+	DaysOfCover       *float64 `json:"days_of_cover"` // Null when the product did not sell
+	SuggestedQuantity int      `json:"suggested_quantity"`
+}
+
+// updateReorderThreshold sets the available stock at or below which a product counts as low on stock
+func (a *App) updateReorderThreshold(w http.ResponseWriter, r *http.Request) {
+	productID := web.ParseInt(mux.Vars(r)["id"])
+
+	var req struct {
+		ReorderThreshold *int `json:"reorder_threshold"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		web.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if req.ReorderThreshold == nil || *req.ReorderThreshold < 0 {
+		web.RespondWithFieldErrors(w, "Invalid reorder threshold", web.FieldErrors{"reorder_threshold": "must be zero or more"})
+		return
+	}
+
+	var stock ProductStock
+	err := a.DB.QueryRow(r.Context(), `
+        UPDATE products SET reorder_threshold = $1, updated_at = NOW()
+        WHERE id = $2
+        RETURNING id, inventory, reserved, reorder_threshold`,
+		*req.ReorderThreshold, productID).Scan(&stock.ProductID, &stock.OnHand, &stock.Reserved, &stock.ReorderThreshold)
+	if err == pgx.ErrNoRows {
+		web.RespondWithError(w, http.StatusNotFound, "Product not found")
+		return
+	}
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	stock.Available = stock.OnHand - stock.Reserved
+
+	web.RespondWithJSON(w, http.StatusOK, stock)
+}
+
+// getReorderSuggestions lists the products that should be restocked. Sales over the
+// last REORDER_SALES_DAYS give each product's daily sales; a product is suggested once
+// its available stock no longer covers REORDER_LEAD_TIME_DAYS of sales on top of its
+// reorder threshold, and the suggested quantity restores that plus REORDER_COVER_DAYS
+// of sales. Without the Order Service, suggestions are based on thresholds alone.
+func (a *App) getReorderSuggestions(w http.ResponseWriter, r *http.Request) {
+	unitsSold := map[int]int{}
+	salesAvailable := true
+	sales, err := a.Orders.GetProductSales(r.Context(), a.Config.ReorderSalesDays)
+	if err != nil {
+		log.Printf("Error fetching product sales: %v", err)
+		salesAvailable = false
+	}
+	for _, s := range sales {
+		unitsSold[s.ProductID] = s.UnitsSold
+	}
+
+	rows, err := a.DB.Query(r.Context(), "SELECT id, name, inventory, reserved, reorder_threshold FROM products ORDER BY id")
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	suggestions := []ReorderSuggestion{}
+	for rows.Next() {
+		var s ReorderSuggestion
+		if err := rows.Scan(&s.ProductID, &s.Name, &s.OnHand, &s.Reserved, &s.ReorderThreshold); err != nil {
+			web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		s.Available = s.OnHand - s.Reserved
+		s.UnitsSold = unitsSold[s.ProductID]
+		s.DailySales = float64(s.UnitsSold) / float64(a.Config.ReorderSalesDays)
+
+		reorderPoint := s.ReorderThreshold + int(math.Ceil(s.DailySales*float64(a.Config.ReorderLeadDays)))
+		if s.Available > reorderPoint {
+			continue
+		}
+
+		if s.DailySales > 0 {
+			cover := math.Round(float64(s.Available)/s.DailySales*10) / 10
+			s.DaysOfCover = &cover
+		}
+		target := s.ReorderThreshold + int(math.Ceil(s.DailySales*float64(a.Config.ReorderLeadDays+a.Config.ReorderCoverDays)))
+		s.SuggestedQuantity = max(target, reorderPoint+1) - s.Available
+		s.DailySales = math.Round(s.DailySales*100) / 100
+
+		suggestions = append(suggestions, s)
+	}
+	if err := rows.Err(); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Most urgent first: the products that run out soonest, then the ones not selling
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		ci, cj := suggestions[i].DaysOfCover, suggestions[j].DaysOfCover
+		switch {
+		case ci != nil && cj != nil:
+			return *ci < *cj
+		case ci != nil || cj != nil:
+			return ci != nil
+		default:
+			return suggestions[i].Available < suggestions[j].Available
+		}
+	})
+
+	web.RespondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"sales_days":      a.Config.ReorderSalesDays,
+		"lead_time_days":  a.Config.ReorderLeadDays,
+		"cover_days":      a.Config.ReorderCoverDays,
+		"sales_available": salesAvailable,
+		"suggestions":     suggestions,
+	})
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"net/http"
+	"pkg-iae/models"
+	"pkg-iae/web"
+	"sort"
+	"time"
+)
+
+const (
+	DEFAULT_RESERVATION_TTL    = 15 * time.Minute
+	MAX_RESERVATION_TTL        = 24 * time.Hour
+	RESERVATION_SWEEP_INTERVAL = 1 * time.Minute
+)
+
+// Reservation types are shared with the services reserving stock, see pkg-iae/models
+type (
+	StockReservation   = models.StockReservation
+	ReservationRequest = models.ReservationRequest
+	ReservationItem    = models.ReservationItem
+	UnavailableItem    = models.UnavailableItem
+)
+
+// releaseExpiredReservations periodically returns held stock of expired reservations
+func (a *App) releaseExpiredReservations() {
+	ticker := time.NewTicker(RESERVATION_SWEEP_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			result, err := a.DB.Exec(context.Background(), `
+                WITH expired AS (
+                    UPDATE stock_reservations SET status = 'expired', updated_at = NOW()
+                    WHERE status = 'reserved' AND expires_at < NOW()
+                    RETURNING variant_id, warehouse_id, quantity
+                )
+                UPDATE stock_levels s SET reserved = s.reserved - e.quantity, updated_at = NOW()
+                FROM (SELECT variant_id, warehouse_id, SUM(quantity) AS quantity FROM expired GROUP BY variant_id, warehouse_id) e
+                WHERE s.variant_id = e.variant_id AND s.warehouse_id = e.warehouse_id`)
+			if err != nil {
+				log.Printf("Error releasing expired reservations: %v", err)
+				continue
+			}
+
+			if rowsAffected := result.RowsAffected(); rowsAffected > 0 {
+				log.Printf("Released expired reservations at %d stock locations", rowsAffected)
+			}
+		}
+	}
+}
+
+// getReservations returns all reservations made under a reference
+func (a *App) getReservations(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	reference := vars["reference"]
+
+	reservations, err := queryReservations(a.DB.Query, "WHERE reference = $1", reference)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, reservations)
+}
+
+// reservationLine is the stock of one variant to hold
+type reservationLine struct {
+	ProductID int
+	VariantID int
+}
+
+// reserveStock holds stock of the variant of every item of an order, all or nothing.
+// Items of products with a single variant may leave the variant out. The allocation
+// policy picks the warehouses each line is held at.
+func (a *App) reserveStock(w http.ResponseWriter, r *http.Request) {
+	var req ReservationRequest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&req); err != nil {
+		web.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if req.Reference == "" || len(req.Reference) > 100 {
+		web.RespondWithError(w, http.StatusBadRequest, "Reference is required and must be at most 100 characters")
+		return
+	}
+	if len(req.Items) == 0 {
+		web.RespondWithError(w, http.StatusBadRequest, "At least one item is required")
+		return
+	}
+
+	ttl := DEFAULT_RESERVATION_TTL
+	if req.TTLSeconds > 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+		if ttl > MAX_RESERVATION_TTL {
+			ttl = MAX_RESERVATION_TTL
+		}
+	}
+
+	for _, item := range req.Items {
+		if item.ProductID <= 0 || item.VariantID < 0 || item.Quantity <= 0 {
+			web.RespondWithError(w, http.StatusBadRequest, "Each item needs a product ID and a positive quantity")
+			return
+		}
+	}
+
+	tx, err := a.DB.Begin(context.Background())
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	// Reserving again under a reference that already holds stock is a no-op so callers can safely retry
+	existing, err := queryReservations(tx.Query,
+		"WHERE reference = $1 AND status IN ('reserved', 'confirmed')", req.Reference)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(existing) > 0 {
+		web.RespondWithJSON(w, http.StatusOK, existing)
+		return
+	}
+
+	// Merge duplicate lines and lock variants in a stable order to avoid deadlocks.
+	// Sorting by product first also keeps the locks taken on product totals in order.
+	unavailable := []UnavailableItem{}
+	quantities := map[reservationLine]int{}
+	for _, item := range req.Items {
+		variantID, err := resolveVariant(tx.QueryRow, item.ProductID, item.VariantID)
+		if errors.Is(err, errProductNotFound) || errors.Is(err, errVariantNotFound) || errors.Is(err, errVariantRequired) {
+			unavailable = append(unavailable, UnavailableItem{ProductID: item.ProductID, VariantID: item.VariantID, Requested: item.Quantity, Reason: err.Error()})
+			continue
+		}
+		if err != nil {
+			web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		quantities[reservationLine{item.ProductID, variantID}] += item.Quantity
+	}
+	lines := make([]reservationLine, 0, len(quantities))
+	for line := range quantities {
+		lines = append(lines, line)
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		if lines[i].ProductID != lines[j].ProductID {
+			return lines[i].ProductID < lines[j].ProductID
+		}
+		return lines[i].VariantID < lines[j].VariantID
+	})
+
+	allocations := map[reservationLine][]allocation{}
+	for _, line := range lines {
+		quantity := quantities[line]
+
+		// The variant's stock stays locked until commit, so the allocation cannot be taken by anyone else
+		allocated, available, err := a.allocateStock(r.Context(), tx, line.VariantID, quantity)
+		if err != nil {
+			web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if allocated == nil {
+			unavailable = append(unavailable, UnavailableItem{ProductID: line.ProductID, VariantID: line.VariantID, Requested: quantity, Available: available, Reason: errInsufficientStock.Error()})
+			continue
+		}
+
+		for _, alloc := range allocated {
+			_, err := tx.Exec(context.Background(),
+				"UPDATE stock_levels SET reserved = reserved + $1, updated_at = NOW() WHERE variant_id = $2 AND warehouse_id = $3",
+				alloc.Quantity, line.VariantID, alloc.WarehouseID)
+			if err != nil {
+				web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		allocations[line] = allocated
+	}
+
+	if len(unavailable) > 0 {
+		web.RespondWithJSON(w, http.StatusConflict, map[string]interface{}{
+			"error": "Unable to reserve stock",
+			"items": unavailable,
+		})
+		return
+	}
+
+	reservations := []StockReservation{}
+	expiresAt := time.Now().Add(ttl)
+	for _, line := range lines {
+		for _, alloc := range allocations[line] {
+			res := StockReservation{
+				Reference:   req.Reference,
+				ProductID:   line.ProductID,
+				VariantID:   line.VariantID,
+				WarehouseID: alloc.WarehouseID,
+				Quantity:    alloc.Quantity,
+				Status:      "reserved",
+				ExpiresAt:   expiresAt,
+				CreatedAt:   time.Now(),
+				UpdatedAt:   time.Now(),
+			}
+
+			err = tx.QueryRow(context.Background(),
+				"INSERT INTO stock_reservations (reference, product_id, variant_id, warehouse_id, quantity, status, expires_at, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id",
+				res.Reference, res.ProductID, res.VariantID, res.WarehouseID, res.Quantity, res.Status, res.ExpiresAt, res.CreatedAt, res.UpdatedAt).Scan(&res.ID)
+			if err != nil {
+				web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			reservations = append(reservations, res)
+		}
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusCreated, reservations)
+}
+
+// confirmReservations turns every held reservation under a reference into a stock decrement
+func (a *App) confirmReservations(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	reference := vars["reference"]
+
+	tx, err := a.DB.Begin(context.Background())
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	held, err := queryReservations(tx.Query, "WHERE reference = $1 AND status = 'reserved'", reference)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(held) == 0 {
+		web.RespondWithError(w, http.StatusNotFound, "No active reservations for this reference")
+		return
+	}
+
+	for _, variantID := range heldVariants(held) {
+		if _, err := confirmReservation(tx, reference, variantID, movementBy(r, models.MOVEMENT_SALE)); err != nil {
+			web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	reservations, err := queryReservations(a.DB.Query, "WHERE reference = $1", reference)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, reservations)
+}
+
+// releaseReservations gives back the stock held under a reference for an order that will not be placed
+func (a *App) releaseReservations(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	reference := vars["reference"]
+
+	tx, err := a.DB.Begin(context.Background())
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	held, err := queryReservations(tx.Query, "WHERE reference = $1 AND status = 'reserved'", reference)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	for _, variantID := range heldVariants(held) {
+		if _, err := releaseReservation(tx, reference, variantID); err != nil {
+			web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	reservations, err := queryReservations(a.DB.Query, "WHERE reference = $1", reference)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, reservations)
+}
+
+// heldVariants returns the variants of reservations once each, in order
+func heldVariants(reservations []StockReservation) []int {
+	variants := []int{}
+	for i, res := range reservations {
+		if i == 0 || reservations[i-1].VariantID != res.VariantID {
+			variants = append(variants, res.VariantID)
+		}
+	}
+	return variants
+}
+
+// confirmReservation converts the stock held for a variant under a reference, at
+// every warehouse holding it, into a real decrement recorded in the ledger. It returns
+// false if nothing is held for the variant under the reference.
+func confirmReservation(tx pgx.Tx, reference string, variantID int, m stockMovement) (bool, error) {
+	rows, err := tx.Query(context.Background(), `
+        UPDATE stock_reservations SET status = 'confirmed', updated_at = NOW()
+        WHERE reference = $1 AND variant_id = $2 AND status = 'reserved'
+        RETURNING warehouse_id, quantity`,
+		reference, variantID)
+	if err != nil {
+		return false, err
+	}
+	held, err := scanAllocations(rows)
+	if err != nil {
+		return false, err
+	}
+
+	for _, alloc := range held {
+		_, err = tx.Exec(context.Background(),
+			"UPDATE stock_levels SET on_hand = on_hand - $1, reserved = reserved - $1, updated_at = NOW() WHERE variant_id = $2 AND warehouse_id = $3",
+			alloc.Quantity, variantID, alloc.WarehouseID)
+		if err != nil {
+			return false, err
+		}
+		if err := recordMovement(context.Background(), tx, variantID, alloc.WarehouseID, -alloc.Quantity, m); err != nil {
+			return false, err
+		}
+	}
+
+	return len(held) > 0, nil
+}
+
+// releaseReservation drops the hold on a variant under a reference and marks returned
+// stock as released. It returns where confirmed stock was taken from, for the caller
+// to return it there.
+func releaseReservation(tx pgx.Tx, reference string, variantID int) ([]allocation, error) {
+	_, err := tx.Exec(context.Background(), `
+        WITH released AS (
+            UPDATE stock_reservations SET status = 'released', updated_at = NOW()
+            WHERE reference = $1 AND variant_id = $2 AND status = 'reserved'
+            RETURNING warehouse_id, quantity
+        )
+        UPDATE stock_levels s SET reserved = s.reserved - r.quantity, updated_at = NOW()
+        FROM (SELECT warehouse_id, SUM(quantity) AS quantity FROM released GROUP BY warehouse_id) r
+        WHERE s.variant_id = $2 AND s.warehouse_id = r.warehouse_id`,
+		reference, variantID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Confirmed stock is returned by the caller; only record that the reservation no longer stands
+	rows, err := tx.Query(context.Background(), `
+        UPDATE stock_reservations SET status = 'released', updated_at = NOW()
+        WHERE reference = $1 AND variant_id = $2 AND status = 'confirmed'
+        RETURNING warehouse_id, quantity`,
+		reference, variantID)
+	if err != nil {
+		return nil, err
+	}
+	return scanAllocations(rows)
+}
+
+// scanAllocations reads warehouse_id, quantity rows
+func scanAllocations(rows pgx.Rows) ([]allocation, error) {
+	defer rows.Close()
+
+	allocations := []allocation{}
+	for rows.Next() {
+		var alloc allocation
+		if err := rows.Scan(&alloc.WarehouseID, &alloc.Quantity); err != nil {
+			return nil, err
+		}
+		allocations = append(allocations, alloc)
+	}
+	return allocations, rows.Err()
+}
+
+// queryReservations loads reservations matching the given WHERE clause
+func queryReservations(query func(context.Context, string, ...interface{}) (pgx.Rows, error), where string, args ...interface{}) ([]StockReservation, error) {
+	rows, err := query(context.Background(),
+		fmt.Sprintf("SELECT id, reference, product_id, variant_id, warehouse_id, quantity, status, expires_at, created_at, updated_at FROM stock_reservations %s ORDER BY product_id, variant_id, warehouse_id", where),
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reservations := []StockReservation{}
+	for rows.Next() {
+		var res StockReservation
+		if err := rows.Scan(&res.ID, &res.Reference, &res.ProductID, &res.VariantID, &res.WarehouseID, &res.Quantity, &res.Status,
+			&res.ExpiresAt, &res.CreatedAt, &res.UpdatedAt); err != nil {
+			return nil, err
+		}
+		reservations = append(reservations, res)
+	}
+
+	return reservations, rows.Err()
+}
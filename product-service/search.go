@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"pkg-iae/web"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MAX_SEARCH_TERM_LENGTH caps the length of the q parameter
+	MAX_SEARCH_TERM_LENGTH = 200
+	// FUZZY_MATCH_WEIGHT scales the trigram similarity of the name into the relevance,
+	// so typo matches rank below full-text matches
+	FUZZY_MATCH_WEIGHT = 0.1
+	// HEADLINE_OPTIONS configures the highlighted description snippets
+	HEADLINE_OPTIONS = "StartSel=<mark>, StopSel=</mark>, MaxWords=25, MinWords=10, MaxFragments=2"
+)
+
+// SEARCH_SORTS maps the accepted sort values to their ORDER BY clauses
+var SEARCH_SORTS = map[string]string{
+	"relevance":   "relevance DESC, p.name ASC",
+	"name":        "p.name ASC",
+	"price_asc":   "p.price ASC",
+	"price_desc":  "p.price DESC",
+	"rating_desc": "avg_rating DESC",
+	"newest":      "p.created_at DESC",
+}
+
+// searchFilter holds the validated filters of a product search
+type searchFilter struct {
+	Term       string
+	CategoryID int // 0 when not filtering by category
+	MinPrice   *float64
+	MaxPrice   *float64
+	MinRating  *float64
+	Sort       string
+}
+
+// parseSearchFilter validates the search query parameters
+func parseSearchFilter(q url.Values) (searchFilter, web.FieldErrors) {
+	errs := web.FieldErrors{}
+	filter := searchFilter{Sort: "name"}
+
+	filter.Term = strings.TrimSpace(q.Get("q"))
+	if filter.Term != "" {
+		filter.Sort = "relevance"
+	}
+	if len(filter.Term) > MAX_SEARCH_TERM_LENGTH {
+		errs.Add("q", fmt.Sprintf("must be at most %d characters", MAX_SEARCH_TERM_LENGTH))
+	}
+
+	if raw := q.Get("category"); raw != "" {
+		id, err := strconv.Atoi(raw)
+		if err != nil || id <= 0 {
+			errs.Add("category", "must be a positive integer")
+		}
+		filter.CategoryID = id
+	}
+
+	filter.MinPrice = parseFloatFilter(q, "min_price", 0, -1, errs)
+	filter.MaxPrice = parseFloatFilter(q, "max_price", 0, -1, errs)
+	if filter.MinPrice != nil && filter.MaxPrice != nil && *filter.MinPrice > *filter.MaxPrice {
+		errs.Add("max_price", "must not be less than min_price")
+	}
+
+	filter.MinRating = parseFloatFilter(q, "min_rating", 0, 5, errs)
+
+	if raw := q.Get("sort"); raw != "" {
+		if _, ok := SEARCH_SORTS[raw]; !ok {
+			errs.Add("sort", "must be one of relevance, name, price_asc, price_desc, rating_desc, newest")
+		}
+		filter.Sort = raw
+	}
+
+	if len(errs) > 0 {
+		return filter, errs
+	}
+	return filter, nil
+}
+
+// parseFloatFilter parses an optional number parameter that must lie between min
+// and max; a negative max means there is no upper bound
+func parseFloatFilter(q url.Values, field string, min, max float64, errs web.FieldErrors) *float64 {
+	raw := q.Get(field)
+	if raw == "" {
+		return nil
+	}
+
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		errs.Add(field, "must be a number")
+		return nil
+	}
+	if value < min {
+		errs.Add(field, fmt.Sprintf("must be at least %g", min))
+		return nil
+	}
+	if max >= 0 && value > max {
+		errs.Add(field, fmt.Sprintf("must be at most %g", max))
+		return nil
+	}
+	return &value
+}
+
+// SearchResult is a product matching a search, with its relevance to the search
+// term and a highlighted snippet of its description
+type SearchResult struct {
+	Product
+	Relevance float64 `json:"relevance,omitempty"`
+	Highlight *string `json:"highlight,omitempty"`
+}
+
+// SearchResponse is returned by GET /products/search
+type SearchResponse struct {
+	Results []SearchResult `json:"results"`
+	Total   int            `json:"total"`
+	Facets  SearchFacets   `json:"facets"`
+}
+
+// searchProducts searches products by relevance to a term and filters, and counts
+// the matching products per category, price range and rating
+func (a *App) searchProducts(w http.ResponseWriter, r *http.Request) {
+	filter, errs := parseSearchFilter(r.URL.Query())
+	if errs != nil {
+		web.RespondWithFieldErrors(w, "Invalid search filters", errs)
+		return
+	}
+
+	results, err := a.searchResults(r.Context(), filter)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	facets, total, err := a.searchFacets(r.Context(), filter)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Learn popular queries for suggestions without delaying the response
+	if filter.Term != "" {
+		go a.logSearch(filter.Term, total)
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, SearchResponse{Results: results, Total: total, Facets: facets})
+}
+
+// searchQuery selects columns from the products matching the filter. The product is
+// p, its average rating ratings.avg_rating and, when there is a term, the parsed
+// term is search.query and the raw term search.term.
+func searchQuery(filter searchFilter, columns string) *queryBuilder {
+	query := newQueryBuilder("SELECT " + columns + "\n        FROM products p").
+		Join(AVG_RATING_JOIN)
+
+	if filter.Term != "" {
+		// Match the full-text document, or the name with a trigram similarity
+		// that tolerates typos and partial words
+		query.Join("CROSS JOIN (SELECT websearch_to_tsquery('english', ?) AS query, ?::text AS term) search",
+			filter.Term, filter.Term).
+			Where("(p.search_vector @@ search.query OR search.term <% p.name)")
+	}
+	if filter.CategoryID != 0 {
+		query.Where("EXISTS (SELECT 1 FROM product_category_map pcm WHERE pcm.product_id = p.id AND pcm.category_id = ?)",
+			filter.CategoryID)
+	}
+	if filter.MinPrice != nil {
+		query.Where("p.price >= ?", *filter.MinPrice)
+	}
+	if filter.MaxPrice != nil {
+		query.Where("p.price <= ?", *filter.MaxPrice)
+	}
+	if filter.MinRating != nil {
+		query.Where("COALESCE(ratings.avg_rating, 0) >= ?", *filter.MinRating)
+	}
+	return query
+}
+
+// searchResults returns the products matching the filter in the requested order
+func (a *App) searchResults(ctx context.Context, filter searchFilter) ([]SearchResult, error) {
+	relevance, highlight := "0::real", "NULL::text"
+	if filter.Term != "" {
+		relevance = fmt.Sprintf("ts_rank(p.search_vector, search.query) + %g * word_similarity(search.term, p.name)", FUZZY_MATCH_WEIGHT)
+		highlight = "ts_headline('english', COALESCE(p.description, ''), search.query, '" + HEADLINE_OPTIONS + "')"
+	}
+
+	query := searchQuery(filter, `p.id, p.name, p.description, p.price, p.inventory, p.created_at, p.updated_at,
+            COALESCE(ratings.avg_rating, 0) AS avg_rating, pi.image_url,
+            `+relevance+` AS relevance, `+highlight+` AS highlight`).
+		Join(PRIMARY_IMAGE_JOIN).
+		OrderBy(SEARCH_SORTS[filter.Sort])
+
+	sql, args := query.Build()
+	rows, err := a.DB.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	for rows.Next() {
+		var p SearchResult
+		var imageURL *string
+		if err := rows.Scan(&p.ID, &p.Name, &p.Description, &p.Price, &p.Inventory, &p.CreatedAt, &p.UpdatedAt, &p.AvgRating, &imageURL,
+			&p.Relevance, &p.Highlight); err != nil {
+			return nil, err
+		}
+		p.Images = primaryImages(imageURL)
+
+		results = append(results, p)
+	}
+
+	return results, rows.Err()
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"pkg-iae/web"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MAX_SUGGEST_TERM_LENGTH = 100
+	DEFAULT_SUGGEST_LIMIT   = 5
+	MAX_SUGGEST_LIMIT       = 20
+	// POPULAR_QUERY_WINDOW is how far back the search log is used for popular
+	// queries; older entries are pruned
+	POPULAR_QUERY_WINDOW    = 30 * 24 * time.Hour
+	SEARCH_LOG_PRUNE_PERIOD = 1 * time.Hour
+	SEARCH_LOG_TIMEOUT      = 5 * time.Second
+)
+
+// Suggestions is returned by GET /products/suggest
+type Suggestions struct {
+	Query      string               `json:"query"`
+	Products   []ProductSuggestion  `json:"products"`
+	Categories []CategorySuggestion `json:"categories"`
+	Queries    []QuerySuggestion    `json:"queries"`
+	// Partial is set when the latency budget ran out before every kind of suggestion was found
+	Partial bool `json:"partial,omitempty"`
+}
+
+// ProductSuggestion is a product whose name matches the typed text
+type ProductSuggestion struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// CategorySuggestion is a category whose name matches the typed text
+type CategorySuggestion struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// QuerySuggestion is a popular past search starting with the typed text
+type QuerySuggestion struct {
+	Query    string `json:"query"`
+	Searches int    `json:"searches"`
+}
+
+// normalizeQuery lower cases a search term and collapses its whitespace, so the
+// same search typed differently is logged and cached once
+func normalizeQuery(term string) string {
+	return strings.ToLower(strings.Join(strings.Fields(term), " "))
+}
+
+// parseSuggestParams validates the q and limit parameters
+func parseSuggestParams(q url.Values) (string, int, web.FieldErrors) {
+	errs := web.FieldErrors{}
+
+	term := normalizeQuery(q.Get("q"))
+	if term == "" {
+		errs.Add("q", "is required")
+	} else if len(term) > MAX_SUGGEST_TERM_LENGTH {
+		errs.Add("q", fmt.Sprintf("must be at most %d characters", MAX_SUGGEST_TERM_LENGTH))
+	}
+
+	limit := DEFAULT_SUGGEST_LIMIT
+	if raw := q.Get("limit"); raw != "" {
+		var err error
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > MAX_SUGGEST_LIMIT {
+			errs.Add("limit", fmt.Sprintf("must be an integer from 1 to %d", MAX_SUGGEST_LIMIT))
+		}
+	}
+
+	if len(errs) > 0 {
+		return term, limit, errs
+	}
+	return term, limit, nil
+}
+
+// suggestProducts returns product names, category names and popular past queries
+// matching the start of what the user typed. Lookups that do not finish within
+// the latency budget are left out and the response is marked partial.
+func (a *App) suggestProducts(w http.ResponseWriter, r *http.Request) {
+	term, limit, errs := parseSuggestParams(r.URL.Query())
+	if errs != nil {
+		web.RespondWithFieldErrors(w, "Invalid suggest parameters", errs)
+		return
+	}
+
+	key := strconv.Itoa(limit) + ":" + term
+	if suggestions, ok := a.suggestions.Get(key); ok {
+		web.RespondWithJSON(w, http.StatusOK, suggestions)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.Config.SuggestTimeout)
+	defer cancel()
+
+	suggestions := a.findSuggestions(ctx, term, limit)
+	if !suggestions.Partial {
+		a.suggestions.Put(key, suggestions)
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, suggestions)
+}
+
+// findSuggestions runs the product, category and popular query lookups concurrently
+func (a *App) findSuggestions(ctx context.Context, term string, limit int) Suggestions {
+	suggestions := Suggestions{
+		Query:      term,
+		Products:   []ProductSuggestion{},
+		Categories: []CategorySuggestion{},
+		Queries:    []QuerySuggestion{},
+	}
+
+	prefix := escapeLike(term) + "%"
+	wordPrefix := "% " + prefix
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	lookup := func(kind string, find func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := find(); err != nil {
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					log.Printf("Suggest lookup of %s ran out of time for %q", kind, term)
+				} else {
+					log.Printf("Error looking up %s suggestions: %v", kind, err)
+				}
+				mu.Lock()
+				suggestions.Partial = true
+				mu.Unlock()
+			}
+		}()
+	}
+
+	lookup("product", func() error {
+		products := []ProductSuggestion{}
+		rows, err := a.DB.Query(ctx, `
+            SELECT id, name FROM products
+            WHERE name ILIKE $1 OR name ILIKE $2 OR $3 <% name
+            ORDER BY name ILIKE $1 DESC, word_similarity($3, name) DESC, name
+            LIMIT $4`, prefix, wordPrefix, term, limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var p ProductSuggestion
+			if err := rows.Scan(&p.ID, &p.Name); err != nil {
+				return err
+			}
+			products = append(products, p)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		mu.Lock()
+		suggestions.Products = products
+		mu.Unlock()
+		return nil
+	})
+
+	lookup("category", func() error {
+		categories := []CategorySuggestion{}
+		rows, err := a.DB.Query(ctx, `
+            SELECT id, name FROM product_categories
+            WHERE name ILIKE $1 OR name ILIKE $2 OR $3 <% name
+            ORDER BY name ILIKE $1 DESC, word_similarity($3, name) DESC, name
+            LIMIT $4`, prefix, wordPrefix, term, limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var c CategorySuggestion
+			if err := rows.Scan(&c.ID, &c.Name); err != nil {
+				return err
+			}
+			categories = append(categories, c)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		mu.Lock()
+		suggestions.Categories = categories
+		mu.Unlock()
+		return nil
+	})
+
+	lookup("popular query", func() error {
+		queries := []QuerySuggestion{}
+		rows, err := a.DB.Query(ctx, `
+            SELECT query, COUNT(*) AS searches FROM search_log
+            WHERE query LIKE $1 AND result_count > 0 AND searched_at > $2
+            GROUP BY query
+            ORDER BY searches DESC, query
+            LIMIT $3`, prefix, time.Now().Add(-POPULAR_QUERY_WINDOW), limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var q QuerySuggestion
+			if err := rows.Scan(&q.Query, &q.Searches); err != nil {
+				return err
+			}
+			queries = append(queries, q)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		mu.Lock()
+		suggestions.Queries = queries
+		mu.Unlock()
+		return nil
+	})
+
+	wg.Wait()
+	return suggestions
+}
+
+// logSearch records a search term and how many products it found, to learn popular queries
+func (a *App) logSearch(term string, resultCount int) {
+	ctx, cancel := context.WithTimeout(context.Background(), SEARCH_LOG_TIMEOUT)
+	defer cancel()
+
+	_, err := a.DB.Exec(ctx,
+		"INSERT INTO search_log (query, result_count, searched_at) VALUES ($1, $2, NOW())",
+		normalizeQuery(term), resultCount)
+	if err != nil {
+		log.Printf("Error logging search: %v", err)
+	}
+}
+
+// pruneSearchLog periodically deletes searches too old to count towards popular queries
+func (a *App) pruneSearchLog() {
+	ticker := time.NewTicker(SEARCH_LOG_PRUNE_PERIOD)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			result, err := a.DB.Exec(context.Background(),
+				"DELETE FROM search_log WHERE searched_at < $1",
+				time.Now().Add(-POPULAR_QUERY_WINDOW))
+			if err != nil {
+				log.Printf("Error pruning search log: %v", err)
+				continue
+			}
+
+			if rowsAffected := result.RowsAffected(); rowsAffected > 0 {
+				log.Printf("Pruned %d old searches from the search log", rowsAffected)
+			}
+		}
+	}
+}
+
+// suggestCache is a size bounded LRU cache of suggestions that expire after a TTL
+type suggestCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List // Most recently used first
+	entries map[string]*list.Element
+}
+
+type suggestCacheEntry struct {
+	key         string
+	suggestions Suggestions
+	expiresAt   time.Time
+}
+
+func newSuggestCache(size int, ttl time.Duration) *suggestCache {
+	return &suggestCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// Get returns the cached suggestions for key if they have not expired
+func (c *suggestCache) Get(key string) (Suggestions, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return Suggestions{}, false
+	}
+
+	entry := element.Value.(*suggestCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return Suggestions{}, false
+	}
+
+	c.order.MoveToFront(element)
+	return entry.suggestions, true
+}
+
+// Put caches suggestions under key, evicting the least recently used entry when full
+func (c *suggestCache) Put(key string, suggestions Suggestions) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.order.Remove(element)
+		delete(c.entries, key)
+	}
+
+	for c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*suggestCacheEntry).key)
+	}
+
+	c.entries[key] = c.order.PushFront(&suggestCacheEntry{
+		key:         key,
+		suggestions: suggestions,
+		expiresAt:   time.Now().Add(c.ttl),
+	})
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"net/http"
+	"pkg-iae/models"
+	"pkg-iae/web"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// MAX_VARIANT_OPTIONS caps how many options a variant can be told apart by
+const MAX_VARIANT_OPTIONS = 3
+
+// SKU_FORMAT is how a variant is known in the warehouse: letters, digits, dots, dashes and underscores
+var SKU_FORMAT = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// Variant types are shared with the services selling them, see pkg-iae/models
+type (
+	ProductOption  = models.ProductOption
+	ProductVariant = models.ProductVariant
+	VariantSummary = models.VariantSummary
+)
+
+// VARIANT_SELECT reads the columns scanVariant expects, with the options folded into a JSON object
+const VARIANT_SELECT = `
+        SELECT v.id, v.product_id, v.sku, COALESCE(v.price, p.price), v.price, v.inventory,
+            COALESCE((
+                SELECT jsonb_object_agg(o.name, ov.value)
+                FROM product_variant_values vv
+                JOIN product_option_values ov ON ov.id = vv.option_value_id
+                JOIN product_options o ON o.id = ov.option_id
+                WHERE vv.variant_id = v.id
+            ), '{}'),
+            v.created_at, v.updated_at
+        FROM product_variants v
+        JOIN products p ON p.id = v.product_id`
+
+var (
+	// errVariantNotFound is returned when a variant does not exist or belongs to another product
+	errVariantNotFound = errors.New("variant not found")
+	// errVariantRequired is returned when no variant is given for a product that has several
+	errVariantRequired = errors.New("variant_id is required for products with several variants")
+)
+
+// VariantRequest is the body of POST /products/{id}/variants and PUT /products/{id}/variants/{variant_id}.
+// Inventory is only taken when the variant is created, and stocked at the primary warehouse;
+// later changes go through PATCH /products/{id}/inventory.
+type VariantRequest struct {
+	SKU       string            `json:"sku"`
+	Price     *float64          `json:"price"` // Leave out to sell at the product's price
+	Inventory int               `json:"inventory"`
+	Options   map[string]string `json:"options"` // Option name to value, e.g. {"size": "M", "color": "Black"}
+}
+
+// validate normalizes the request and returns its problems. Option names are lowercased.
+func (req *VariantRequest) validate() web.FieldErrors {
+	errs := web.FieldErrors{}
+	req.SKU = strings.TrimSpace(req.SKU)
+	if !SKU_FORMAT.MatchString(req.SKU) {
+		errs.Add("sku", "must be 1 to 64 letters, digits, dots, dashes or underscores")
+	}
+	if req.Price != nil && *req.Price < 0 {
+		errs.Add("price", "must not be negative")
+	}
+	if req.Inventory < 0 {
+		errs.Add("inventory", "must not be negative")
+	}
+	if len(req.Options) > MAX_VARIANT_OPTIONS {
+		errs.Add("options", fmt.Sprintf("must have at most %d entries", MAX_VARIANT_OPTIONS))
+	}
+
+	options := make(map[string]string, len(req.Options))
+	for name, value := range req.Options {
+		name, value = strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(value)
+		if name == "" || len(name) > 50 {
+			errs.Add("options", "names must be 1 to 50 characters")
+			continue
+		}
+		if value == "" || len(value) > 100 {
+			errs.Add("options."+name, "must be 1 to 100 characters")
+		}
+		options[name] = value
+	}
+	req.Options = options
+	return errs
+}
+
+// scanVariant reads a row of VARIANT_SELECT
+func scanVariant(row pgx.Row) (ProductVariant, error) {
+	var v ProductVariant
+	err := row.Scan(&v.ID, &v.ProductID, &v.SKU, &v.Price, &v.PriceOverride, &v.Inventory, &v.Options,
+		&v.CreatedAt, &v.UpdatedAt)
+	return v, err
+}
+
+// loadVariants returns the variants of a product, oldest first
+func (a *App) loadVariants(ctx context.Context, productID int) ([]ProductVariant, error) {
+	rows, err := a.DB.Query(ctx, VARIANT_SELECT+" WHERE v.product_id = $1 ORDER BY v.id", productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	variants := []ProductVariant{}
+	for rows.Next() {
+		v, err := scanVariant(rows)
+		if err != nil {
+			return nil, err
+		}
+		variants = append(variants, v)
+	}
+	return variants, rows.Err()
+}
+
+// loadOptions returns the options of a product with the values its variants use, in display order
+func (a *App) loadOptions(ctx context.Context, productID int) ([]ProductOption, error) {
+	rows, err := a.DB.Query(ctx, `
+        SELECT o.name, array_agg(ov.value ORDER BY ov.position, ov.id)
+        FROM product_options o
+        JOIN product_option_values ov ON ov.option_id = o.id
+        WHERE o.product_id = $1
+          AND EXISTS (SELECT 1 FROM product_variant_values vv WHERE vv.option_value_id = ov.id)
+        GROUP BY o.id, o.name, o.position
+        ORDER BY o.position, o.id`,
+		productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	options := []ProductOption{}
+	for rows.Next() {
+		var o ProductOption
+		if err := rows.Scan(&o.Name, &o.Values); err != nil {
+			return nil, err
+		}
+		options = append(options, o)
+	}
+	return options, rows.Err()
+}
+
+// resolveVariant returns the variant of a product that a request or inventory update
+// targets: the given one if it belongs to the product, or the product's only variant
+// when none is given
+func resolveVariant(queryRow func(context.Context, string, ...interface{}) pgx.Row, productID, variantID int) (int, error) {
+	if variantID != 0 {
+		var exists bool
+		err := queryRow(context.Background(),
+			"SELECT EXISTS (SELECT 1 FROM product_variants WHERE id = $1 AND product_id = $2)",
+			variantID, productID).Scan(&exists)
+		if err != nil {
+			return 0, err
+		}
+		if !exists {
+			return 0, errVariantNotFound
+		}
+		return variantID, nil
+	}
+
+	// Every product has a variant, so none means the product does not exist
+	var count, onlyID int
+	err := queryRow(context.Background(),
+		"SELECT COUNT(*), COALESCE(MIN(id), 0) FROM product_variants WHERE product_id = $1",
+		productID).Scan(&count, &onlyID)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case count == 0:
+		return 0, errProductNotFound
+	case count > 1:
+		return 0, errVariantRequired
+	}
+	return onlyID, nil
+}
+
+// lockProduct locks a product so changes to its variants and options are serialized
+func lockProduct(ctx context.Context, tx pgx.Tx, productID int) (bool, error) {
+	var id int
+	err := tx.QueryRow(ctx, "SELECT id FROM products WHERE id = $1 FOR UPDATE", productID).Scan(&id)
+	if err == pgx.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// setVariantOptions records a variant's option values, adding options and values
+// the product does not have yet after the existing ones
+func setVariantOptions(ctx context.Context, tx pgx.Tx, productID, variantID int, options map[string]string) error {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var optionID, valueID int
+		err := tx.QueryRow(ctx, `
+            INSERT INTO product_options (product_id, name, position)
+            VALUES ($1, $2, (SELECT COUNT(*) + 1 FROM product_options WHERE product_id = $1))
+            ON CONFLICT (product_id, name) DO UPDATE SET name = EXCLUDED.name
+            RETURNING id`,
+			productID, name).Scan(&optionID)
+		if err != nil {
+			return err
+		}
+
+		err = tx.QueryRow(ctx, `
+            INSERT INTO product_option_values (option_id, value, position)
+            VALUES ($1, $2, (SELECT COUNT(*) + 1 FROM product_option_values WHERE option_id = $1))
+            ON CONFLICT (option_id, value) DO UPDATE SET value = EXCLUDED.value
+            RETURNING id`,
+			optionID, options[name]).Scan(&valueID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx,
+			"INSERT INTO product_variant_values (variant_id, option_value_id) VALUES ($1, $2)",
+			variantID, valueID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasDuplicateOptions reports whether another variant of the product has exactly the variant's option values
+func hasDuplicateOptions(ctx context.Context, tx pgx.Tx, productID, variantID int) (bool, error) {
+	var duplicate bool
+	err := tx.QueryRow(ctx, `
+        SELECT EXISTS (
+            SELECT 1 FROM product_variants v
+            WHERE v.product_id = $1 AND v.id <> $2
+              AND ARRAY(SELECT option_value_id FROM product_variant_values WHERE variant_id = v.id ORDER BY option_value_id)
+                = ARRAY(SELECT option_value_id FROM product_variant_values WHERE variant_id = $2 ORDER BY option_value_id)
+        )`,
+		productID, variantID).Scan(&duplicate)
+	return duplicate, err
+}
+
+// isUniqueViolation reports whether err is a unique constraint violation, such as a SKU already in use
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+// getVariants lists the variants of a product
+func (a *App) getVariants(w http.ResponseWriter, r *http.Request) {
+	productID := web.ParseInt(mux.Vars(r)["id"])
+
+	var exists bool
+	err := a.DB.QueryRow(r.Context(), "SELECT EXISTS(SELECT 1 FROM products WHERE id = $1)", productID).Scan(&exists)
+	if err != nil || !exists {
+		web.RespondWithError(w, http.StatusNotFound, "Product not found")
+		return
+	}
+
+	variants, err := a.loadVariants(r.Context(), productID)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, variants)
+}
+
+// createVariant adds a variant to a product
+func (a *App) createVariant(w http.ResponseWriter, r *http.Request) {
+	productID := web.ParseInt(mux.Vars(r)["id"])
+
+	var req VariantRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		web.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if errs := req.validate(); len(errs) > 0 {
+		web.RespondWithFieldErrors(w, "Invalid variant", errs)
+		return
+	}
+
+	tx, err := a.DB.Begin(r.Context())
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	found, err := lockProduct(r.Context(), tx, productID)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !found {
+		web.RespondWithError(w, http.StatusNotFound, "Product not found")
+		return
+	}
+
+	var variantID int
+	err = tx.QueryRow(r.Context(), `
+        INSERT INTO product_variants (product_id, sku, price, created_at, updated_at)
+        VALUES ($1, $2, $3, NOW(), NOW())
+        RETURNING id`,
+		productID, req.SKU, req.Price).Scan(&variantID)
+	if isUniqueViolation(err) {
+		web.RespondWithError(w, http.StatusConflict, "SKU is already in use")
+		return
+	}
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !stockInitialInventory(w, r, tx, variantID, req.Inventory) {
+		return
+	}
+
+	if !a.saveVariantOptions(w, r, tx, productID, variantID, req.Options) {
+		return
+	}
+
+	if err := tx.Commit(r.Context()); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	variant, err := scanVariant(a.DB.QueryRow(r.Context(), VARIANT_SELECT+" WHERE v.id = $1", variantID))
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusCreated, variant)
+}
+
+// updateVariant changes the SKU, price and options of a variant
+func (a *App) updateVariant(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	productID := web.ParseInt(vars["id"])
+	variantID := web.ParseInt(vars["variant_id"])
+
+	var req VariantRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		web.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if errs := req.validate(); len(errs) > 0 {
+		web.RespondWithFieldErrors(w, "Invalid variant", errs)
+		return
+	}
+
+	tx, err := a.DB.Begin(r.Context())
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	found, err := lockProduct(r.Context(), tx, productID)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !found {
+		web.RespondWithError(w, http.StatusNotFound, "Product not found")
+		return
+	}
+
+	result, err := tx.Exec(r.Context(),
+		"UPDATE product_variants SET sku = $1, price = $2, updated_at = NOW() WHERE id = $3 AND product_id = $4",
+		req.SKU, req.Price, variantID, productID)
+	if isUniqueViolation(err) {
+		web.RespondWithError(w, http.StatusConflict, "SKU is already in use")
+		return
+	}
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if result.RowsAffected() == 0 {
+		web.RespondWithError(w, http.StatusNotFound, "Variant not found")
+		return
+	}
+
+	if _, err := tx.Exec(r.Context(), "DELETE FROM product_variant_values WHERE variant_id = $1", variantID); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !a.saveVariantOptions(w, r, tx, productID, variantID, req.Options) {
+		return
+	}
+
+	if err := tx.Commit(r.Context()); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	variant, err := scanVariant(a.DB.QueryRow(r.Context(), VARIANT_SELECT+" WHERE v.id = $1", variantID))
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, variant)
+}
+
+// saveVariantOptions sets a variant's options and makes sure no other variant of the
+// product has the same ones. It responds and returns false when the variant cannot be saved.
+func (a *App) saveVariantOptions(w http.ResponseWriter, r *http.Request, tx pgx.Tx, productID, variantID int, options map[string]string) bool {
+	if err := setVariantOptions(r.Context(), tx, productID, variantID, options); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return false
+	}
+
+	duplicate, err := hasDuplicateOptions(r.Context(), tx, productID, variantID)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return false
+	}
+	if duplicate {
+		web.RespondWithError(w, http.StatusConflict, "Another variant of the product has the same options")
+		return false
+	}
+	return true
+}
+
+// deleteVariant removes a variant that holds no reserved stock. A product keeps at least one variant.
+func (a *App) deleteVariant(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	productID := web.ParseInt(vars["id"])
+	variantID := web.ParseInt(vars["variant_id"])
+
+	tx, err := a.DB.Begin(r.Context())
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	found, err := lockProduct(r.Context(), tx, productID)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !found {
+		web.RespondWithError(w, http.StatusNotFound, "Product not found")
+		return
+	}
+
+	var reserved, variantCount int
+	err = tx.QueryRow(r.Context(),
+		"SELECT reserved, (SELECT COUNT(*) FROM product_variants WHERE product_id = $2) FROM product_variants WHERE id = $1 AND product_id = $2",
+		variantID, productID).Scan(&reserved, &variantCount)
+	if err == pgx.ErrNoRows {
+		web.RespondWithError(w, http.StatusNotFound, "Variant not found")
+		return
+	}
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if variantCount == 1 {
+		web.RespondWithError(w, http.StatusConflict, "A product keeps at least one variant")
+		return
+	}
+	if reserved > 0 {
+		web.RespondWithError(w, http.StatusConflict, "The variant has stock reserved for orders")
+		return
+	}
+
+	if _, err := tx.Exec(r.Context(), "DELETE FROM product_variants WHERE id = $1", variantID); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := tx.Commit(r.Context()); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"net/http"
+	"pkg-iae/models"
+	"pkg-iae/web"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// WAREHOUSE_CODE is the short name of a location: uppercase letters, digits and dashes
+var WAREHOUSE_CODE = regexp.MustCompile(`^[A-Z0-9][A-Z0-9-]{1,19}$`)
+
+// ALLOCATION_POLICIES choose the warehouses that fulfil an order line, selected with ALLOCATION_POLICY
+var ALLOCATION_POLICIES = map[string]allocationPolicy{
+	"priority":    allocateByPriority,
+	"consolidate": allocateConsolidated,
+}
+
+// Warehouse types are shared with the services reading stock, see pkg-iae/models
+type (
+	Warehouse     = models.Warehouse
+	StockLevel    = models.StockLevel
+	LocationStock = models.LocationStock
+	ProductStock  = models.ProductStock
+	StockTransfer = models.StockTransfer
+)
+
+var (
+	// errWarehouseNotFound is returned when a warehouse does not exist, or no warehouse is active
+	errWarehouseNotFound = errors.New("warehouse not found")
+	// errInsufficientStock is returned when the warehouses together cannot cover a decrement
+	errInsufficientStock = errors.New("insufficient inventory")
+)
+
+// locationStock is the unreserved stock of a variant at an active warehouse
+type locationStock struct {
+	WarehouseID int
+	Priority    int
+	Available   int
+}
+
+// allocation is a number of units of a variant taken from one warehouse
+type allocation struct {
+	WarehouseID int
+	Quantity    int
+}
+
+// allocationPolicy splits a line over locations given in priority order. It returns
+// nil if the locations do not have enough stock.
+type allocationPolicy func(quantity int, locations []locationStock) []allocation
+
+// allocateByPriority takes units from the highest priority warehouses first, splitting the line as needed
+func allocateByPriority(quantity int, locations []locationStock) []allocation {
+	allocations := []allocation{}
+	for _, loc := range locations {
+		if quantity == 0 {
+			break
+		}
+		take := min(quantity, loc.Available)
+		if take <= 0 {
+			continue
+		}
+		allocations = append(allocations, allocation{WarehouseID: loc.WarehouseID, Quantity: take})
+		quantity -= take
+	}
+	if quantity > 0 {
+		return nil
+	}
+	return allocations
+}
+
+// allocateConsolidated ships a line from the highest priority warehouse that has all
+// of it, and only splits it like allocateByPriority when none has
+func allocateConsolidated(quantity int, locations []locationStock) []allocation {
+	for _, loc := range locations {
+		if loc.Available >= quantity {
+			return []allocation{{WarehouseID: loc.WarehouseID, Quantity: quantity}}
+		}
+	}
+	return allocateByPriority(quantity, locations)
+}
+
+// lockLocations locks the stock of a variant at every active warehouse and returns it in
+// priority order. Rows are locked by warehouse ID, like transfers do, to avoid deadlocks.
+func lockLocations(ctx context.Context, tx pgx.Tx, variantID int) ([]locationStock, error) {
+	rows, err := tx.Query(ctx, `
+        SELECT s.warehouse_id, w.priority, s.on_hand - s.reserved
+        FROM stock_levels s
+        JOIN warehouses w ON w.id = s.warehouse_id
+        WHERE s.variant_id = $1 AND w.active
+        ORDER BY s.warehouse_id
+        FOR UPDATE OF s`,
+		variantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	locations := []locationStock{}
+	for rows.Next() {
+		var loc locationStock
+		if err := rows.Scan(&loc.WarehouseID, &loc.Priority, &loc.Available); err != nil {
+			return nil, err
+		}
+		locations = append(locations, loc)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(locations, func(i, j int) bool {
+		return locations[i].Priority < locations[j].Priority
+	})
+	return locations, nil
+}
+
+// allocateStock locks the stock of a variant and picks the warehouses to take quantity
+// units from. When they cannot cover it, it returns nil and the units available.
+func (a *App) allocateStock(ctx context.Context, tx pgx.Tx, variantID, quantity int) ([]allocation, int, error) {
+	locations, err := lockLocations(ctx, tx, variantID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if allocations := a.allocate(quantity, locations); allocations != nil {
+		return allocations, 0, nil
+	}
+
+	available := 0
+	for _, loc := range locations {
+		available += max(loc.Available, 0)
+	}
+	return nil, available, nil
+}
+
+// adjustStock changes the units of a variant on hand at a warehouse by delta and records
+// the movement in the ledger. Taking more than the unreserved stock there fails with a
+// check violation.
+func adjustStock(ctx context.Context, tx pgx.Tx, variantID, warehouseID, delta int, m stockMovement) error {
+	_, err := tx.Exec(ctx, `
+        INSERT INTO stock_levels (product_id, variant_id, warehouse_id, on_hand, updated_at)
+        SELECT product_id, id, $2, $3, NOW() FROM product_variants WHERE id = $1
+        ON CONFLICT (variant_id, warehouse_id)
+        DO UPDATE SET on_hand = stock_levels.on_hand + EXCLUDED.on_hand, updated_at = NOW()`,
+		variantID, warehouseID, delta)
+	if err != nil {
+		return err
+	}
+	return recordMovement(ctx, tx, variantID, warehouseID, delta, m)
+}
+
+// takeStock removes units of a variant from a warehouse, or from the warehouses the
+// allocation policy picks when none is given
+func (a *App) takeStock(ctx context.Context, tx pgx.Tx, variantID, warehouseID, quantity int, m stockMovement) error {
+	if warehouseID != 0 {
+		return adjustStock(ctx, tx, variantID, warehouseID, -quantity, m)
+	}
+
+	allocations, _, err := a.allocateStock(ctx, tx, variantID, quantity)
+	if err != nil {
+		return err
+	}
+	if allocations == nil {
+		return errInsufficientStock
+	}
+	for _, alloc := range allocations {
+		if err := adjustStock(ctx, tx, variantID, alloc.WarehouseID, -alloc.Quantity, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// returnStock adds units of a variant back to a warehouse. When none is given they go
+// back to the warehouses they were taken from, and whatever is left to the primary warehouse.
+func returnStock(ctx context.Context, tx pgx.Tx, variantID, warehouseID, quantity int, takenFrom []allocation, m stockMovement) error {
+	if warehouseID == 0 {
+		for _, alloc := range takenFrom {
+			if quantity == 0 {
+				break
+			}
+			units := min(quantity, alloc.Quantity)
+			if err := adjustStock(ctx, tx, variantID, alloc.WarehouseID, units, m); err != nil {
+				return err
+			}
+			quantity -= units
+		}
+		if quantity == 0 {
+			return nil
+		}
+	}
+
+	warehouseID, err := resolveWarehouse(tx.QueryRow, warehouseID)
+	if err != nil {
+		return err
+	}
+	return adjustStock(ctx, tx, variantID, warehouseID, quantity, m)
+}
+
+// resolveWarehouse returns the warehouse stock is changed at: the given one if it
+// exists, or the primary warehouse, the active one with the lowest priority, when none is given
+func resolveWarehouse(queryRow func(context.Context, string, ...interface{}) pgx.Row, warehouseID int) (int, error) {
+	var id int
+	var err error
+	if warehouseID != 0 {
+		err = queryRow(context.Background(), "SELECT id FROM warehouses WHERE id = $1", warehouseID).Scan(&id)
+	} else {
+		err = queryRow(context.Background(),
+			"SELECT id FROM warehouses WHERE active ORDER BY priority, id LIMIT 1").Scan(&id)
+	}
+	if err == pgx.ErrNoRows {
+		return 0, errWarehouseNotFound
+	}
+	return id, err
+}
+
+// stockInitialInventory stocks the inventory a product or variant is created with at the
+// primary warehouse. It responds and returns false when the stock cannot be placed.
+func stockInitialInventory(w http.ResponseWriter, r *http.Request, tx pgx.Tx, variantID, inventory int) bool {
+	if inventory == 0 {
+		return true
+	}
+
+	warehouseID, err := resolveWarehouse(tx.QueryRow, 0)
+	if errors.Is(err, errWarehouseNotFound) {
+		web.RespondWithError(w, http.StatusConflict, "No active warehouse to hold the stock")
+		return false
+	}
+	if err == nil {
+		err = adjustStock(r.Context(), tx, variantID, warehouseID, inventory, movementBy(r, models.MOVEMENT_INITIAL))
+	}
+	if isCheckViolation(err) {
+		web.RespondWithError(w, http.StatusBadRequest, "Inventory must not be negative")
+		return false
+	}
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return false
+	}
+	return true
+}
+
+// isCheckViolation reports whether err is a check constraint violation, such as stock going negative
+func isCheckViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23514"
+}
+
+// WarehouseRequest is the body of POST /warehouses and PUT /warehouses/{id}
+type WarehouseRequest struct {
+	Code     string `json:"code"`
+	Name     string `json:"name"`
+	Priority int    `json:"priority"`
+	Active   *bool  `json:"active"` // Defaults to true
+}
+
+// validate normalizes the request and returns its problems. Codes are uppercased.
+func (req *WarehouseRequest) validate() web.FieldErrors {
+	errs := web.FieldErrors{}
+	req.Code = strings.ToUpper(strings.TrimSpace(req.Code))
+	req.Name = strings.TrimSpace(req.Name)
+	if !WAREHOUSE_CODE.MatchString(req.Code) {
+		errs.Add("code", "must be 2 to 20 letters, digits or dashes")
+	}
+	if req.Name == "" || len(req.Name) > 100 {
+		errs.Add("name", "must be 1 to 100 characters")
+	}
+	if req.Active == nil {
+		active := true
+		req.Active = &active
+	}
+	return errs
+}
+
+// getWarehouses lists the warehouses in priority order
+func (a *App) getWarehouses(w http.ResponseWriter, r *http.Request) {
+	rows, err := a.DB.Query(r.Context(),
+		"SELECT id, code, name, priority, active, created_at, updated_at FROM warehouses ORDER BY priority, id")
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	warehouses := []Warehouse{}
+	for rows.Next() {
+		var wh Warehouse
+		if err := rows.Scan(&wh.ID, &wh.Code, &wh.Name, &wh.Priority, &wh.Active, &wh.CreatedAt, &wh.UpdatedAt); err != nil {
+			web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		warehouses = append(warehouses, wh)
+	}
+	if err := rows.Err(); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, warehouses)
+}
+
+// createWarehouse adds a warehouse
+func (a *App) createWarehouse(w http.ResponseWriter, r *http.Request) {
+	var req WarehouseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		web.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if errs := req.validate(); len(errs) > 0 {
+		web.RespondWithFieldErrors(w, "Invalid warehouse", errs)
+		return
+	}
+
+	wh := Warehouse{
+		Code:      req.Code,
+		Name:      req.Name,
+		Priority:  req.Priority,
+		Active:    *req.Active,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	err := a.DB.QueryRow(r.Context(),
+		"INSERT INTO warehouses (code, name, priority, active, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+		wh.Code, wh.Name, wh.Priority, wh.Active, wh.CreatedAt, wh.UpdatedAt).Scan(&wh.ID)
+	if isUniqueViolation(err) {
+		web.RespondWithError(w, http.StatusConflict, "Warehouse code is already in use")
+		return
+	}
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusCreated, wh)
+}
+
+// updateWarehouse changes a warehouse. A warehouse holding stock cannot be deactivated,
+// since its stock could no longer be allocated; transfer the stock first.
+func (a *App) updateWarehouse(w http.ResponseWriter, r *http.Request) {
+	id := web.ParseInt(mux.Vars(r)["id"])
+
+	var req WarehouseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		web.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if errs := req.validate(); len(errs) > 0 {
+		web.RespondWithFieldErrors(w, "Invalid warehouse", errs)
+		return
+	}
+
+	tx, err := a.DB.Begin(r.Context())
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	var wh Warehouse
+	err = tx.QueryRow(r.Context(),
+		"SELECT id, created_at FROM warehouses WHERE id = $1 FOR UPDATE", id).Scan(&wh.ID, &wh.CreatedAt)
+	if err == pgx.ErrNoRows {
+		web.RespondWithError(w, http.StatusNotFound, "Warehouse not found")
+		return
+	}
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if !*req.Active {
+		var stocked bool
+		err = tx.QueryRow(r.Context(),
+			"SELECT EXISTS (SELECT 1 FROM stock_levels WHERE warehouse_id = $1 AND on_hand > 0)", id).Scan(&stocked)
+		if err != nil {
+			web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if stocked {
+			web.RespondWithError(w, http.StatusConflict, "The warehouse still holds stock")
+			return
+		}
+	}
+
+	wh.Code, wh.Name, wh.Priority, wh.Active, wh.UpdatedAt = req.Code, req.Name, req.Priority, *req.Active, time.Now()
+	_, err = tx.Exec(r.Context(),
+		"UPDATE warehouses SET code = $1, name = $2, priority = $3, active = $4, updated_at = $5 WHERE id = $6",
+		wh.Code, wh.Name, wh.Priority, wh.Active, wh.UpdatedAt, id)
+	if isUniqueViolation(err) {
+		web.RespondWithError(w, http.StatusConflict, "Warehouse code is already in use")
+		return
+	}
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := tx.Commit(r.Context()); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, wh)
+}
+
+// getProductStock returns the stock of a product at each warehouse holding any of it,
+// broken down by variant
+func (a *App) getProductStock(w http.ResponseWriter, r *http.Request) {
+	productID := web.ParseInt(mux.Vars(r)["id"])
+
+	stock := ProductStock{ProductID: productID, Locations: []LocationStock{}}
+	err := a.DB.QueryRow(r.Context(), "SELECT reorder_threshold FROM products WHERE id = $1", productID).Scan(&stock.ReorderThreshold)
+	if err == pgx.ErrNoRows {
+		web.RespondWithError(w, http.StatusNotFound, "Product not found")
+		return
+	}
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	rows, err := a.DB.Query(r.Context(), `
+        SELECT w.id, w.code, w.name, s.variant_id, v.sku, s.on_hand, s.reserved
+        FROM stock_levels s
+        JOIN warehouses w ON w.id = s.warehouse_id
+        JOIN product_variants v ON v.id = s.variant_id
+        WHERE s.product_id = $1
+        ORDER BY w.priority, w.id, s.variant_id`,
+		productID)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var loc LocationStock
+		var level StockLevel
+		if err := rows.Scan(&loc.WarehouseID, &loc.Code, &loc.Name, &level.VariantID, &level.SKU,
+			&level.OnHand, &level.Reserved); err != nil {
+			web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		level.Available = level.OnHand - level.Reserved
+
+		// Rows come grouped by warehouse
+		if n := len(stock.Locations); n == 0 || stock.Locations[n-1].WarehouseID != loc.WarehouseID {
+			loc.Variants = []StockLevel{}
+			stock.Locations = append(stock.Locations, loc)
+		}
+		current := &stock.Locations[len(stock.Locations)-1]
+		current.Variants = append(current.Variants, level)
+		current.OnHand += level.OnHand
+		current.Reserved += level.Reserved
+		current.Available += level.Available
+
+		stock.OnHand += level.OnHand
+		stock.Reserved += level.Reserved
+		stock.Available += level.Available
+	}
+	if err := rows.Err(); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, stock)
+}
+
+// transferStock moves unreserved units of a variant from one warehouse to another
+func (a *App) transferStock(w http.ResponseWriter, r *http.Request) {
+	var transfer StockTransfer
+	if err := json.NewDecoder(r.Body).Decode(&transfer); err != nil {
+		web.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	errs := web.FieldErrors{}
+	if transfer.ProductID <= 0 {
+		errs.Add("product_id", "is required")
+	}
+	if transfer.FromWarehouseID <= 0 {
+		errs.Add("from_warehouse_id", "is required")
+	}
+	if transfer.ToWarehouseID <= 0 {
+		errs.Add("to_warehouse_id", "is required")
+	} else if transfer.ToWarehouseID == transfer.FromWarehouseID {
+		errs.Add("to_warehouse_id", "must differ from from_warehouse_id")
+	}
+	if transfer.Quantity <= 0 {
+		errs.Add("quantity", "must be positive")
+	}
+	if len(errs) > 0 {
+		web.RespondWithFieldErrors(w, "Invalid stock transfer", errs)
+		return
+	}
+
+	tx, err := a.DB.Begin(r.Context())
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	transfer.VariantID, err = resolveVariant(tx.QueryRow, transfer.ProductID, transfer.VariantID)
+	switch {
+	case errors.Is(err, errProductNotFound):
+		web.RespondWithError(w, http.StatusNotFound, "Product not found")
+		return
+	case errors.Is(err, errVariantNotFound):
+		web.RespondWithError(w, http.StatusNotFound, "Variant not found")
+		return
+	case errors.Is(err, errVariantRequired):
+		web.RespondWithFieldErrors(w, "Invalid stock transfer", web.FieldErrors{"variant_id": "is required for products with several variants"})
+		return
+	case err != nil:
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	for _, warehouseID := range []int{transfer.FromWarehouseID, transfer.ToWarehouseID} {
+		if _, err := resolveWarehouse(tx.QueryRow, warehouseID); errors.Is(err, errWarehouseNotFound) {
+			web.RespondWithError(w, http.StatusNotFound, "Warehouse not found")
+			return
+		} else if err != nil {
+			web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	// Lock both locations in warehouse order, as reservations do
+	_, err = tx.Exec(r.Context(),
+		"SELECT 1 FROM stock_levels WHERE variant_id = $1 AND warehouse_id IN ($2, $3) ORDER BY warehouse_id FOR UPDATE",
+		transfer.VariantID, transfer.FromWarehouseID, transfer.ToWarehouseID)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	movement := movementBy(r, models.MOVEMENT_TRANSFER)
+	err = adjustStock(r.Context(), tx, transfer.VariantID, transfer.FromWarehouseID, -transfer.Quantity, movement)
+	if isCheckViolation(err) {
+		web.RespondWithError(w, http.StatusConflict, "Not enough unreserved stock at the source warehouse")
+		return
+	}
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := adjustStock(r.Context(), tx, transfer.VariantID, transfer.ToWarehouseID, transfer.Quantity, movement); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	transfer.CreatedAt = time.Now()
+	err = tx.QueryRow(r.Context(), `
+        INSERT INTO stock_transfers (product_id, variant_id, from_warehouse_id, to_warehouse_id, quantity, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        RETURNING id`,
+		transfer.ProductID, transfer.VariantID, transfer.FromWarehouseID, transfer.ToWarehouseID, transfer.Quantity,
+		transfer.CreatedAt).Scan(&transfer.ID)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := tx.Commit(r.Context()); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusCreated, transfer)
+}
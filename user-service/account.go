@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"pkg-iae/auth"
+	pkgmail "pkg-iae/mail"
+	"pkg-iae/web"
+	"strings"
+	"time"
+)
+
+const (
+	PURPOSE_VERIFY_EMAIL   = "verify_email"
+	PURPOSE_RESET_PASSWORD = "reset_password"
+	ACCOUNT_TOKEN_BYTES    = 32
+	// MAIL_SEND_TIMEOUT bounds the delivery of one account email
+	MAIL_SEND_TIMEOUT = 1 * time.Minute
+)
+
+// errInvalidAccountToken is returned for account tokens that are unknown, used or expired
+var errInvalidAccountToken = errors.New("invalid or expired token")
+
+// VerifyEmailRequest is the body of POST /auth/verify-email
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+// PasswordResetRequest is the body of POST /auth/password-reset
+type PasswordResetRequest struct {
+	Email string `json:"email"`
+}
+
+// PasswordResetConfirmRequest is the body of POST /auth/password-reset/confirm
+type PasswordResetConfirmRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// normalizeEmail checks that s is a bare email address and lowercases it
+func normalizeEmail(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	addr, err := mail.ParseAddress(s)
+	if err != nil || addr.Address != s {
+		return "", false
+	}
+	return strings.ToLower(s), true
+}
+
+// validateUsername checks a username. Usernames cannot contain "@", so a login
+// with one is always by email address and can never match someone's username.
+func validateUsername(username string, errs web.FieldErrors) {
+	if strings.TrimSpace(username) == "" {
+		errs.Add("username", "is required")
+	} else if strings.Contains(username, "@") {
+		errs.Add("username", "cannot contain @")
+	}
+}
+
+// createAccountToken stores a new single-use token for a user, replacing any
+// unused token they had for the same purpose
+func (a *App) createAccountToken(ctx context.Context, userID int, purpose, email string, ttl time.Duration) (string, error) {
+	token, err := randomToken(ACCOUNT_TOKEN_BYTES)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := a.DB.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(context.Background())
+
+	_, err = tx.Exec(ctx,
+		"DELETE FROM account_tokens WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL",
+		userID, purpose)
+	if err != nil {
+		return "", fmt.Errorf("unable to replace account token: %v", err)
+	}
+
+	_, err = tx.Exec(ctx, `
+        INSERT INTO account_tokens (user_id, purpose, token_hash, email, expires_at, created_at)
+        VALUES ($1, $2, $3, $4, $5, NOW())`,
+		userID, purpose, hashToken(token), email, time.Now().Add(ttl))
+	if err != nil {
+		return "", fmt.Errorf("unable to store account token: %v", err)
+	}
+
+	return token, tx.Commit(ctx)
+}
+
+// consumeAccountToken marks a token used and returns the user and email address it was issued for
+func consumeAccountToken(ctx context.Context, tx pgx.Tx, token, purpose string) (int, string, error) {
+	var userID int
+	var email string
+	err := tx.QueryRow(ctx, `
+        UPDATE account_tokens SET used_at = NOW()
+        WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > NOW()
+        RETURNING user_id, email`,
+		hashToken(token), purpose).Scan(&userID, &email)
+	if err == pgx.ErrNoRows {
+		return 0, "", errInvalidAccountToken
+	}
+	return userID, email, err
+}
+
+// accountLink returns the link of an account email
+func (a *App) accountLink(path, token string) string {
+	return strings.TrimRight(a.Config.AppURL, "/") + path + "?token=" + url.QueryEscape(token)
+}
+
+// sendMail delivers an account email in the background, so a slow or failing
+// mail server does not fail the request. Users can ask for another email.
+func (a *App) sendMail(msg pkgmail.Message) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), MAIL_SEND_TIMEOUT)
+		defer cancel()
+
+		if err := a.Mailer.Send(ctx, msg); err != nil {
+			log.Printf("Error sending %q to %s: %v", msg.Subject, msg.To, err)
+		}
+	}()
+}
+
+// sendVerificationEmail mails a user a link that verifies their email address
+func (a *App) sendVerificationEmail(ctx context.Context, u User) error {
+	token, err := a.createAccountToken(ctx, u.ID, PURPOSE_VERIFY_EMAIL, u.Email, a.Config.VerifyTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	a.sendMail(pkgmail.Message{
+		To:      u.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease verify your email address by opening this link:\n\n%s\n\n"+
+			"The link expires in %s. If you did not create an account, you can ignore this email.\n",
+			u.Username, a.accountLink("/verify-email", token), a.Config.VerifyTokenTTL),
+	})
+	return nil
+}
+
+// verifyEmail marks the email address a verification token was sent to as verified
+func (a *App) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req VerifyEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		web.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	tx, err := a.DB.Begin(r.Context())
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	userID, email, err := consumeAccountToken(r.Context(), tx, req.Token, PURPOSE_VERIFY_EMAIL)
+	if err == errInvalidAccountToken {
+		web.RespondWithError(w, http.StatusBadRequest, "Invalid or expired verification token")
+		return
+	}
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// The user may have changed their address since the token was sent
+	result, err := tx.Exec(r.Context(),
+		"UPDATE users SET verified_at = COALESCE(verified_at, NOW()) WHERE id = $1 AND email = $2",
+		userID, email)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if result.RowsAffected() == 0 {
+		web.RespondWithError(w, http.StatusBadRequest, "Invalid or expired verification token")
+		return
+	}
+
+	if err := tx.Commit(r.Context()); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// resendVerification mails the caller a new verification link
+func (a *App) resendVerification(w http.ResponseWriter, r *http.Request) {
+	principal := auth.PrincipalFrom(r.Context())
+
+	var u User
+	err := a.DB.QueryRow(r.Context(),
+		"SELECT id, username, email, verified_at, created_at, updated_at FROM users WHERE id = $1",
+		principal.UserID).Scan(&u.ID, &u.Username, &u.Email, &u.VerifiedAt, &u.CreatedAt, &u.UpdatedAt)
+	if err == pgx.ErrNoRows {
+		web.RespondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if u.VerifiedAt != nil {
+		web.RespondWithError(w, http.StatusConflict, "Email address already verified")
+		return
+	}
+
+	if err := a.sendVerificationEmail(r.Context(), u); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusAccepted, map[string]string{"result": "Verification email sent"})
+}
+
+// requestPasswordReset mails a password reset link. The response is the same
+// whether or not the address is registered, so it cannot be used to find accounts.
+func (a *App) requestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req PasswordResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		web.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	email, ok := normalizeEmail(req.Email)
+	if !ok {
+		errs := web.FieldErrors{}
+		errs.Add("email", "must be an email address")
+		web.RespondWithFieldErrors(w, "Invalid password reset request", errs)
+		return
+	}
+
+	var u User
+	err := a.DB.QueryRow(r.Context(),
+		"SELECT id, username, email FROM users WHERE email = $1",
+		email).Scan(&u.ID, &u.Username, &u.Email)
+	if err != nil && err != pgx.ErrNoRows {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err == nil {
+		token, err := a.createAccountToken(r.Context(), u.ID, PURPOSE_RESET_PASSWORD, u.Email, a.Config.ResetTokenTTL)
+		if err != nil {
+			web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		a.sendMail(pkgmail.Message{
+			To:      u.Email,
+			Subject: "Reset your password",
+			Body: fmt.Sprintf("Hi %s,\n\nYou can choose a new password by opening this link:\n\n%s\n\n"+
+				"The link expires in %s and works once. If you did not ask to reset your password, you can ignore this email.\n",
+				u.Username, a.accountLink("/reset-password", token), a.Config.ResetTokenTTL),
+		})
+	}
+
+	web.RespondWithJSON(w, http.StatusAccepted, map[string]string{
+		"result": "If the email address is registered, a password reset link has been sent",
+	})
+}
+
+// confirmPasswordReset sets a new password with a reset token and logs the user
+// out everywhere. Receiving the token also proves the user owns the address.
+func (a *App) confirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req PasswordResetConfirmRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		web.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	passwordHash, err := a.hashPassword(req.Password)
+	if err != nil {
+		errs := web.FieldErrors{}
+		errs.Add("password", err.Error())
+		web.RespondWithFieldErrors(w, "Invalid password", errs)
+		return
+	}
+
+	tx, err := a.DB.Begin(r.Context())
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	userID, email, err := consumeAccountToken(r.Context(), tx, req.Token, PURPOSE_RESET_PASSWORD)
+	if err == errInvalidAccountToken {
+		web.RespondWithError(w, http.StatusBadRequest, "Invalid or expired password reset token")
+		return
+	}
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	_, err = tx.Exec(r.Context(), `
+        UPDATE users
+        SET password_hash = $1,
+            verified_at = CASE WHEN email = $2 THEN COALESCE(verified_at, NOW()) ELSE verified_at END,
+            updated_at = NOW()
+        WHERE id = $3`,
+		passwordHash, email, userID)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	_, err = tx.Exec(r.Context(),
+		"UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL",
+		userID)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := tx.Commit(r.Context()); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
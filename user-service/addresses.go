@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+	"net/http"
+	"pkg-iae/auth"
+	"pkg-iae/models"
+	"pkg-iae/web"
+)
+
+// MAX_ADDRESSES_PER_USER caps the size of an address book
+const MAX_ADDRESSES_PER_USER = 20
+
+// ADDRESS_COLUMNS are the columns scanAddress reads
+const ADDRESS_COLUMNS = "id, user_id, type, is_default, name, line1, line2, city, region, postal_code, country, phone, created_at, updated_at"
+
+// UserAddress is an entry in a user's address book
+type UserAddress = models.UserAddress
+
+// AddressRequest is the body of POST /users/{id}/addresses and PUT /users/{id}/addresses/{address_id}.
+// The first address of a type becomes the default one.
+type AddressRequest struct {
+	Type      string `json:"type"`
+	IsDefault bool   `json:"is_default"`
+	models.Address
+}
+
+// validate normalizes the request and returns its problems
+func (req *AddressRequest) validate() web.FieldErrors {
+	errs := web.FieldErrors{}
+	if req.Type != models.ADDRESS_SHIPPING && req.Type != models.ADDRESS_BILLING {
+		errs.Add("type", fmt.Sprintf("must be %s or %s", models.ADDRESS_SHIPPING, models.ADDRESS_BILLING))
+	}
+	req.Address.Normalize()
+	req.Address.Validate("", errs)
+	return errs
+}
+
+// scanAddress reads a row of ADDRESS_COLUMNS
+func scanAddress(row pgx.Row) (UserAddress, error) {
+	var a UserAddress
+	err := row.Scan(&a.ID, &a.UserID, &a.Type, &a.IsDefault, &a.Name, &a.Line1, &a.Line2, &a.City,
+		&a.Region, &a.PostalCode, &a.Country, &a.Phone, &a.CreatedAt, &a.UpdatedAt)
+	return a, err
+}
+
+// getAddresses lists a user's address book, defaults first
+func (a *App) getAddresses(w http.ResponseWriter, r *http.Request) {
+	userID := web.ParseInt(mux.Vars(r)["id"])
+
+	if !auth.AuthorizeUser(w, r, userID, auth.PERM_USERS_READ) {
+		return
+	}
+
+	rows, err := a.DB.Query(r.Context(),
+		"SELECT "+ADDRESS_COLUMNS+" FROM user_addresses WHERE user_id = $1 ORDER BY type, is_default DESC, id",
+		userID)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	addresses := []UserAddress{}
+	for rows.Next() {
+		address, err := scanAddress(rows)
+		if err != nil {
+			web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		addresses = append(addresses, address)
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, addresses)
+}
+
+// getAddress returns an entry of a user's address book
+func (a *App) getAddress(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := web.ParseInt(vars["id"])
+
+	if !auth.AuthorizeUser(w, r, userID, auth.PERM_USERS_READ) {
+		return
+	}
+
+	address, err := scanAddress(a.DB.QueryRow(r.Context(),
+		"SELECT "+ADDRESS_COLUMNS+" FROM user_addresses WHERE id = $1 AND user_id = $2",
+		web.ParseInt(vars["address_id"]), userID))
+	if err == pgx.ErrNoRows {
+		web.RespondWithError(w, http.StatusNotFound, "Address not found")
+		return
+	}
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, address)
+}
+
+// createAddress adds an address to a user's address book
+func (a *App) createAddress(w http.ResponseWriter, r *http.Request) {
+	userID := web.ParseInt(mux.Vars(r)["id"])
+
+	if !auth.AuthorizeUser(w, r, userID, auth.PERM_USERS_WRITE) {
+		return
+	}
+
+	var req AddressRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		web.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if errs := req.validate(); len(errs) > 0 {
+		web.RespondWithFieldErrors(w, "Invalid address", errs)
+		return
+	}
+
+	tx, err := a.DB.Begin(r.Context())
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	// Locking the user serializes changes to their address book
+	var count int
+	var hasDefault bool
+	err = tx.QueryRow(r.Context(), `
+        SELECT
+            (SELECT COUNT(*) FROM user_addresses WHERE user_id = u.id),
+            EXISTS (SELECT 1 FROM user_addresses WHERE user_id = u.id AND type = $2 AND is_default)
+        FROM users u WHERE u.id = $1 FOR UPDATE`,
+		userID, req.Type).Scan(&count, &hasDefault)
+	if err == pgx.ErrNoRows {
+		web.RespondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if count >= MAX_ADDRESSES_PER_USER {
+		web.RespondWithError(w, http.StatusConflict, fmt.Sprintf("An address book holds at most %d addresses", MAX_ADDRESSES_PER_USER))
+		return
+	}
+
+	isDefault := req.IsDefault || !hasDefault
+	if err := clearDefaultAddress(r.Context(), tx, userID, req.Type, isDefault); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	address, err := scanAddress(tx.QueryRow(r.Context(), `
+        INSERT INTO user_addresses (user_id, type, is_default, name, line1, line2, city, region, postal_code, country, phone, created_at, updated_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, NOW(), NOW())
+        RETURNING `+ADDRESS_COLUMNS,
+		userID, req.Type, isDefault, req.Name, req.Line1, req.Line2, req.City, req.Region, req.PostalCode, req.Country, req.Phone))
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := tx.Commit(r.Context()); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusCreated, address)
+}
+
+// updateAddress replaces an entry of a user's address book
+func (a *App) updateAddress(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := web.ParseInt(vars["id"])
+	addressID := web.ParseInt(vars["address_id"])
+
+	if !auth.AuthorizeUser(w, r, userID, auth.PERM_USERS_WRITE) {
+		return
+	}
+
+	var req AddressRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		web.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if errs := req.validate(); len(errs) > 0 {
+		web.RespondWithFieldErrors(w, "Invalid address", errs)
+		return
+	}
+
+	tx, err := a.DB.Begin(r.Context())
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	current, err := scanAddress(tx.QueryRow(r.Context(),
+		"SELECT "+ADDRESS_COLUMNS+" FROM user_addresses WHERE id = $1 AND user_id = $2 FOR UPDATE",
+		addressID, userID))
+	if err == pgx.ErrNoRows {
+		web.RespondWithError(w, http.StatusNotFound, "Address not found")
+		return
+	}
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// The default of a type stays the default unless it moves to the other type
+	isDefault := req.IsDefault || (current.IsDefault && current.Type == req.Type)
+	if err := clearDefaultAddress(r.Context(), tx, userID, req.Type, isDefault); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	address, err := scanAddress(tx.QueryRow(r.Context(), `
+        UPDATE user_addresses
+        SET type = $1, is_default = $2, name = $3, line1 = $4, line2 = $5, city = $6, region = $7,
+            postal_code = $8, country = $9, phone = $10, updated_at = NOW()
+        WHERE id = $11
+        RETURNING `+ADDRESS_COLUMNS,
+		req.Type, isDefault, req.Name, req.Line1, req.Line2, req.City, req.Region, req.PostalCode, req.Country, req.Phone, addressID))
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if current.IsDefault && current.Type != req.Type {
+		if err := promoteDefaultAddress(r.Context(), tx, userID, current.Type); err != nil {
+			web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	if err := tx.Commit(r.Context()); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, address)
+}
+
+// deleteAddress removes an entry of a user's address book. Orders placed with
+// it keep their copy.
+func (a *App) deleteAddress(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := web.ParseInt(vars["id"])
+
+	if !auth.AuthorizeUser(w, r, userID, auth.PERM_USERS_WRITE) {
+		return
+	}
+
+	tx, err := a.DB.Begin(r.Context())
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	var addressType string
+	var wasDefault bool
+	err = tx.QueryRow(r.Context(),
+		"DELETE FROM user_addresses WHERE id = $1 AND user_id = $2 RETURNING type, is_default",
+		web.ParseInt(vars["address_id"]), userID).Scan(&addressType, &wasDefault)
+	if err == pgx.ErrNoRows {
+		web.RespondWithError(w, http.StatusNotFound, "Address not found")
+		return
+	}
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if wasDefault {
+		if err := promoteDefaultAddress(r.Context(), tx, userID, addressType); err != nil {
+			web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	if err := tx.Commit(r.Context()); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// clearDefaultAddress unsets the user's default address of a type when another is about to become it
+func clearDefaultAddress(ctx context.Context, tx pgx.Tx, userID int, addressType string, isDefault bool) error {
+	if !isDefault {
+		return nil
+	}
+	_, err := tx.Exec(ctx,
+		"UPDATE user_addresses SET is_default = FALSE, updated_at = NOW() WHERE user_id = $1 AND type = $2 AND is_default",
+		userID, addressType)
+	return err
+}
+
+// promoteDefaultAddress makes the newest remaining address of a type the default
+// after the default one was removed or changed type
+func promoteDefaultAddress(ctx context.Context, tx pgx.Tx, userID int, addressType string) error {
+	_, err := tx.Exec(ctx, `
+        UPDATE user_addresses SET is_default = TRUE, updated_at = NOW()
+        WHERE id = (
+            SELECT id FROM user_addresses
+            WHERE user_id = $1 AND type = $2
+            ORDER BY created_at DESC, id DESC
+            LIMIT 1
+        )`,
+		userID, addressType)
+	return err
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v4"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+	"net/http"
+	"pkg-iae/auth"
+	"pkg-iae/messages"
+	"pkg-iae/web"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MIN_PASSWORD_LENGTH = 8
+	// MAX_PASSWORD_LENGTH is the most bytes bcrypt takes into account
+	MAX_PASSWORD_LENGTH  = 72
+	REFRESH_TOKEN_BYTES  = 32
+	TOKEN_SWEEP_INTERVAL = 1 * time.Hour
+)
+
+// LoginRequest is the body of POST /auth/login. Username may also be the user's email.
+// Users may log in before verifying their email address.
+type LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// RefreshRequest is the body of POST /auth/refresh and POST /auth/logout
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// TokenResponse is returned by a successful login or refresh
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"` // Seconds until the access token expires
+	RefreshToken string `json:"refresh_token"`
+}
+
+// tokenIssuer signs access tokens and publishes the keys that verify them
+type tokenIssuer struct {
+	key    *rsa.PrivateKey
+	keyID  string
+	issuer string
+	ttl    time.Duration
+	jwks   auth.JWKS
+}
+
+// newTokenIssuer loads the signing key, generating it on first start, and the retired public keys
+func newTokenIssuer(cfg Config) (*tokenIssuer, error) {
+	key, generated, err := auth.LoadOrCreatePrivateKey(cfg.PrivateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load signing key: %v", err)
+	}
+	if generated {
+		log.Printf("Generated a new signing key in %s", cfg.PrivateKeyFile)
+	}
+
+	t := &tokenIssuer{
+		key:    key,
+		keyID:  auth.KeyID(&key.PublicKey),
+		issuer: cfg.Issuer,
+		ttl:    cfg.AccessTokenTTL,
+		jwks:   auth.JWKS{Keys: []auth.JWK{auth.NewJWK(&key.PublicKey)}},
+	}
+
+	for _, path := range cfg.PublicKeyFiles {
+		public, err := auth.LoadPublicKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load public key: %v", err)
+		}
+		t.jwks.Keys = append(t.jwks.Keys, auth.NewJWK(public))
+	}
+
+	return t, nil
+}
+
+// Issue signs an access token for a user with the roles and permissions they hold
+func (t *tokenIssuer) Issue(user User, g grants) (string, error) {
+	return t.sign(strconv.Itoa(user.ID), user.Username, g)
+}
+
+// IssueService signs an access token for another service calling on its own behalf
+func (t *tokenIssuer) IssueService(clientID string, permissions []string) (string, error) {
+	return t.sign(clientID, "", grants{Roles: []string{auth.ROLE_SERVICE}, Permissions: permissions})
+}
+
+func (t *tokenIssuer) sign(subject, username string, g grants) (string, error) {
+	now := time.Now()
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, auth.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    t.issuer,
+			Subject:   subject,
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(t.ttl)),
+			ID:        jti,
+		},
+		Username:    username,
+		Roles:       g.Roles,
+		Permissions: g.Permissions,
+	})
+	token.Header["kid"] = t.keyID
+
+	return token.SignedString(t.key)
+}
+
+// hashPassword validates and hashes a new password
+func (a *App) hashPassword(password string) (string, error) {
+	if len(password) < MIN_PASSWORD_LENGTH || len(password) > MAX_PASSWORD_LENGTH {
+		return "", fmt.Errorf("must be from %d to %d characters", MIN_PASSWORD_LENGTH, MAX_PASSWORD_LENGTH)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), a.Config.BcryptCost)
+	if err != nil {
+		return "", fmt.Errorf("unable to hash password: %v", err)
+	}
+	return string(hash), nil
+}
+
+// dummyPasswordHash is compared against when a login names an unknown user, so
+// the response time does not reveal which usernames exist
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// login checks a username and password and issues an access token and a refresh token
+func (a *App) login(w http.ResponseWriter, r *http.Request) {
+	var req LoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		web.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	// Usernames cannot contain "@", so an identifier with one is an email address
+	query := "SELECT id, username, email, created_at, updated_at, password_hash FROM users WHERE username = $1"
+	if strings.Contains(req.Username, "@") {
+		query = "SELECT id, username, email, created_at, updated_at, password_hash FROM users WHERE email = LOWER(TRIM($1))"
+	}
+
+	var u User
+	var passwordHash *string
+	err := a.DB.QueryRow(r.Context(), query,
+		req.Username).Scan(&u.ID, &u.Username, &u.Email, &u.CreatedAt, &u.UpdatedAt, &passwordHash)
+	if err != nil && err != pgx.ErrNoRows {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err == pgx.ErrNoRows || passwordHash == nil {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(req.Password))
+		web.RespondWithError(w, http.StatusUnauthorized, "Invalid username or password")
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(*passwordHash), []byte(req.Password)) != nil {
+		web.RespondWithError(w, http.StatusUnauthorized, "Invalid username or password")
+		return
+	}
+
+	tx, err := a.DB.Begin(r.Context())
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	familyID, err := randomToken(16)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	tokens, _, err := a.issueTokens(r.Context(), tx, u, familyID)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := tx.Commit(r.Context()); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, tokens)
+}
+
+// refresh exchanges a refresh token for a new access token and a new refresh token.
+// The presented token is revoked; presenting it again revokes its whole family,
+// since it means the token was stolen or replayed.
+func (a *App) refresh(w http.ResponseWriter, r *http.Request) {
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		web.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	tx, err := a.DB.Begin(r.Context())
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	var tokenID int
+	var familyID string
+	var expiresAt time.Time
+	var revokedAt *time.Time
+	var u User
+	err = tx.QueryRow(r.Context(), `
+        SELECT t.id, t.family_id, t.expires_at, t.revoked_at, u.id, u.username, u.email, u.created_at, u.updated_at
+        FROM refresh_tokens t
+        JOIN users u ON u.id = t.user_id
+        WHERE t.token_hash = $1
+        FOR UPDATE OF t`,
+		hashToken(req.RefreshToken)).Scan(&tokenID, &familyID, &expiresAt, &revokedAt,
+		&u.ID, &u.Username, &u.Email, &u.CreatedAt, &u.UpdatedAt)
+	if err == pgx.ErrNoRows {
+		web.RespondWithError(w, http.StatusUnauthorized, "Invalid refresh token")
+		return
+	}
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if revokedAt != nil {
+		if _, err := revokeFamily(r.Context(), tx, familyID); err != nil {
+			web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := tx.Commit(r.Context()); err != nil {
+			web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		log.Printf("Revoked refresh token family %s of user %d after a revoked token was reused", familyID, u.ID)
+		web.RespondWithError(w, http.StatusUnauthorized, "Invalid refresh token")
+		return
+	}
+	if time.Now().After(expiresAt) {
+		web.RespondWithError(w, http.StatusUnauthorized, "Refresh token expired")
+		return
+	}
+
+	tokens, newTokenID, err := a.issueTokens(r.Context(), tx, u, familyID)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	_, err = tx.Exec(r.Context(),
+		"UPDATE refresh_tokens SET revoked_at = NOW(), replaced_by = $1 WHERE id = $2",
+		newTokenID, tokenID)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := tx.Commit(r.Context()); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, tokens)
+}
+
+// logout revokes the refresh token and every token rotated from the same login.
+// Access tokens already issued stay valid until they expire.
+func (a *App) logout(w http.ResponseWriter, r *http.Request) {
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		web.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	// Unknown tokens are not reported, so logout cannot be used to probe for valid ones
+	_, err := a.DB.Exec(r.Context(), `
+        UPDATE refresh_tokens SET revoked_at = NOW()
+        WHERE revoked_at IS NULL
+          AND family_id = (SELECT family_id FROM refresh_tokens WHERE token_hash = $1)`,
+		hashToken(req.RefreshToken))
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// issueServiceToken exchanges a service's client ID and secret for an access
+// token with the service role and its permissions. Services get no refresh
+// token; they ask again.
+func (a *App) issueServiceToken(w http.ResponseWriter, r *http.Request) {
+	var req auth.ServiceTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		web.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	secret, ok := a.Config.serviceClients()[req.ClientID]
+	if !ok || subtle.ConstantTimeCompare([]byte(secret), []byte(req.ClientSecret)) != 1 {
+		web.RespondWithError(w, http.StatusUnauthorized, "Invalid client credentials")
+		return
+	}
+
+	permissions, err := a.rolePermissions(r.Context(), auth.ROLE_SERVICE)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	token, err := a.Tokens.IssueService(req.ClientID, permissions)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, auth.ServiceTokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(a.Config.AccessTokenTTL.Seconds()),
+	})
+}
+
+// serviceTokens is the TokenSource of the User Service's own calls to other
+// services. It signs service tokens itself instead of asking POST /auth/token.
+type serviceTokens struct {
+	app *App
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+// Token returns a valid service token, signing a new one when needed
+func (s *serviceTokens) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && time.Until(s.expiresAt) > auth.TOKEN_RENEW_BEFORE {
+		return s.token, nil
+	}
+
+	permissions, err := s.app.rolePermissions(ctx, auth.ROLE_SERVICE)
+	if err != nil {
+		return "", err
+	}
+	token, err := s.app.Tokens.IssueService(messages.SERVICE_USER, permissions)
+	if err != nil {
+		return "", err
+	}
+
+	s.token, s.expiresAt = token, time.Now().Add(s.app.Config.AccessTokenTTL)
+	return s.token, nil
+}
+
+// getJWKS returns the public keys that verify access tokens
+func (a *App) getJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	web.RespondWithJSON(w, http.StatusOK, a.Tokens.jwks)
+}
+
+// issueTokens signs an access token with the user's current roles and stores a
+// new refresh token in the family, returning the refresh token's ID. Role
+// changes therefore reach a user's tokens on their next refresh.
+func (a *App) issueTokens(ctx context.Context, tx pgx.Tx, u User, familyID string) (TokenResponse, int, error) {
+	g, err := loadGrants(ctx, tx, u.ID)
+	if err != nil {
+		return TokenResponse{}, 0, err
+	}
+
+	accessToken, err := a.Tokens.Issue(u, g)
+	if err != nil {
+		return TokenResponse{}, 0, fmt.Errorf("unable to sign access token: %v", err)
+	}
+
+	refreshToken, err := randomToken(REFRESH_TOKEN_BYTES)
+	if err != nil {
+		return TokenResponse{}, 0, err
+	}
+
+	var id int
+	err = tx.QueryRow(ctx, `
+        INSERT INTO refresh_tokens (user_id, token_hash, family_id, expires_at, created_at)
+        VALUES ($1, $2, $3, $4, NOW())
+        RETURNING id`,
+		u.ID, hashToken(refreshToken), familyID, time.Now().Add(a.Config.RefreshTokenTTL)).Scan(&id)
+	if err != nil {
+		return TokenResponse{}, 0, fmt.Errorf("unable to store refresh token: %v", err)
+	}
+
+	return TokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(a.Config.AccessTokenTTL.Seconds()),
+		RefreshToken: refreshToken,
+	}, id, nil
+}
+
+// revokeFamily revokes every active refresh token of a family
+func revokeFamily(ctx context.Context, tx pgx.Tx, familyID string) (int64, error) {
+	result, err := tx.Exec(ctx,
+		"UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = $1 AND revoked_at IS NULL",
+		familyID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+// deleteExpiredTokens periodically removes refresh and account tokens that can no longer be used
+func (a *App) deleteExpiredTokens() {
+	ticker := time.NewTicker(TOKEN_SWEEP_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			result, err := a.DB.Exec(context.Background(), "DELETE FROM refresh_tokens WHERE expires_at < NOW()")
+			if err != nil {
+				log.Printf("Error deleting expired refresh tokens: %v", err)
+				continue
+			}
+
+			if rowsAffected := result.RowsAffected(); rowsAffected > 0 {
+				log.Printf("Deleted %d expired refresh tokens", rowsAffected)
+			}
+
+			result, err = a.DB.Exec(context.Background(), "DELETE FROM account_tokens WHERE expires_at < NOW()")
+			if err != nil {
+				log.Printf("Error deleting expired account tokens: %v", err)
+				continue
+			}
+
+			if rowsAffected := result.RowsAffected(); rowsAffected > 0 {
+				log.Printf("Deleted %d expired account tokens", rowsAffected)
+			}
+		}
+	}
+}
+
+// randomToken returns n random bytes, URL-safe base64 encoded
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("unable to generate token: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the hex SHA-256 of a refresh token, which is what is stored
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
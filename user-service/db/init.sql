@@ -17,9 +17,213 @@ CREATE TABLE IF NOT EXISTS order_history (
     FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
     );
 
--- Insert sample data
-INSERT INTO users (username, email, created_at, updated_at)
+-- Outbox event ID of the order update a row was recorded from, so redelivered and
+-- replayed updates are recorded once
+ALTER TABLE order_history ADD COLUMN IF NOT EXISTS event_id VARCHAR(64);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_order_history_event_id ON order_history(event_id);
+
+-- bcrypt hash of the user's password; users without one cannot log in
+ALTER TABLE users ADD COLUMN IF NOT EXISTS password_hash VARCHAR(100);
+
+-- Refresh tokens, stored as SHA-256 hashes. Each refresh rotates the token within its
+-- family; presenting a rotated token again revokes the whole family.
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    family_id VARCHAR(32) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP,
+    replaced_by INTEGER REFERENCES refresh_tokens(id) ON DELETE SET NULL,
+    created_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family_id ON refresh_tokens(family_id);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_expires_at ON refresh_tokens(expires_at);
+
+-- Set when the user follows the link mailed to their current email address. Emails are
+-- stored lowercased; the index also keeps rows from before that unique case-insensitively.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS verified_at TIMESTAMP;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_lower ON users(LOWER(email));
+
+-- Single-use tokens mailed to users to verify their email address or reset their
+-- password, stored as SHA-256 hashes. Verification tokens are tied to the address
+-- they were sent to, so they stop working when the user changes it.
+CREATE TABLE IF NOT EXISTS account_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    purpose VARCHAR(20) NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    email VARCHAR(255) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_account_tokens_user_id ON account_tokens(user_id, purpose);
+CREATE INDEX IF NOT EXISTS idx_account_tokens_expires_at ON account_tokens(expires_at);
+
+-- Address book. Orders keep their own copy of the addresses they were placed with.
+-- A user has at most one default address of each type.
+CREATE TABLE IF NOT EXISTS user_addresses (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    type VARCHAR(20) NOT NULL CHECK (type IN ('shipping', 'billing')),
+    is_default BOOLEAN NOT NULL DEFAULT FALSE,
+    name VARCHAR(100) NOT NULL,
+    line1 VARCHAR(200) NOT NULL,
+    line2 VARCHAR(200) NOT NULL DEFAULT '',
+    city VARCHAR(100) NOT NULL,
+    region VARCHAR(100) NOT NULL DEFAULT '',
+    postal_code VARCHAR(20) NOT NULL,
+    country CHAR(2) NOT NULL,
+    phone VARCHAR(30) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_addresses_user_id ON user_addresses(user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_user_addresses_default ON user_addresses(user_id, type) WHERE is_default;
+
+-- Deleting a user erases their data in every service. The user is deleted here right
+-- away and the other services are told with a user.deleted event; each reports back
+-- when it has erased or anonymized what it holds. The request outlives the user.
+CREATE TABLE IF NOT EXISTS erasure_requests (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL, -- No foreign key: the user is gone
+    requested_by VARCHAR(100) NOT NULL,
+    published_at TIMESTAMP, -- Last time the user.deleted event was published
+    created_at TIMESTAMP NOT NULL,
+    completed_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS erasure_services (
+    request_id INTEGER NOT NULL REFERENCES erasure_requests(id) ON DELETE CASCADE,
+    service VARCHAR(50) NOT NULL,
+    completed_at TIMESTAMP,
+    PRIMARY KEY (request_id, service)
+);
+
+CREATE INDEX IF NOT EXISTS idx_erasure_requests_pending ON erasure_requests(id) WHERE completed_at IS NULL;
+
+-- Users asking to be told when a product is back in stock or its price falls to
+-- a target. A subscription is notified once, then kept as history.
+CREATE TABLE IF NOT EXISTS product_subscriptions (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    product_id INTEGER NOT NULL, -- Owned by the Product Service
+    kind VARCHAR(20) NOT NULL CHECK (kind IN ('back_in_stock', 'price_below')),
+    target_price DECIMAL(10, 2) CHECK (target_price > 0),
+    created_at TIMESTAMP NOT NULL,
+    notified_at TIMESTAMP,
+    CHECK ((kind = 'price_below') = (target_price IS NOT NULL))
+);
+
+-- Notifications waiting to be sent, and sent ones. Delivery is retried with
+-- growing delays until it succeeds or runs out of attempts.
+CREATE TABLE IF NOT EXISTS notifications (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    subscription_id INTEGER REFERENCES product_subscriptions(id) ON DELETE SET NULL,
+    kind VARCHAR(20) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    body TEXT NOT NULL,
+    data JSONB,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_attempt_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    sent_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_product_subscriptions_user_id ON product_subscriptions(user_id);
+CREATE INDEX IF NOT EXISTS idx_product_subscriptions_open ON product_subscriptions(product_id, kind) WHERE notified_at IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_product_subscriptions_open_kind ON product_subscriptions(user_id, product_id, kind) WHERE notified_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_notifications_user_id ON notifications(user_id);
+CREATE INDEX IF NOT EXISTS idx_notifications_pending ON notifications(next_attempt_at) WHERE sent_at IS NULL;
+
+-- Role-based access control. Permissions are fixed by the services that check them;
+-- roles bundle permissions and are granted to users. Access tokens carry the
+-- roles and permissions a user held when the token was issued.
+CREATE TABLE IF NOT EXISTS permissions (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL UNIQUE,
+    description VARCHAR(255) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS roles (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL UNIQUE,
+    description VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+    role_id INTEGER NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+    permission_id INTEGER NOT NULL REFERENCES permissions(id) ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS user_roles (
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role_id INTEGER NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+    granted_by VARCHAR(100),
+    granted_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, role_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_roles_role_id ON user_roles(role_id);
+
+INSERT INTO permissions (name, description)
+VALUES
+    ('users:read', 'Read any user and their order history'),
+    ('users:write', 'Change or delete any user'),
+    ('roles:manage', 'Create roles and grant them to users'),
+    ('products:write', 'Create, change and delete products and their images'),
+    ('categories:write', 'Create, change and delete categories'),
+    ('inventory:write', 'Change product stock'),
+    ('reviews:moderate', 'Change or delete any review'),
+    ('reservations:manage', 'Reserve and release stock for checkouts'),
+    ('orders:read', 'Read any order'),
+    ('orders:write', 'Place orders for any user'),
+    ('orders:manage', 'Change the status of any order and manage order events'),
+    ('carts:manage', 'Read and change any cart and its checkouts'),
+    ('analytics:read', 'Read order analytics'),
+    ('privacy:manage', 'Export any user''s data from every service')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO roles (name, description)
 VALUES
-    ('john_doe', 'john@example.com', NOW(), NOW()),
-    ('jane_smith', 'jane@example.com', NOW(), NOW()),
-    ('bob_johnson', 'bob@example.com', NOW(), NOW());
\ No newline at end of file
+    ('admin', 'Every permission'),
+    ('catalog_manager', 'Maintains products, categories, stock and reviews'),
+    ('support', 'Helps customers with their accounts, carts and orders'),
+    ('service', 'Held by services calling each other')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO role_permissions (role_id, permission_id)
+SELECT r.id, p.id
+FROM roles r
+JOIN permissions p ON r.name = 'admin'
+    OR (r.name = 'catalog_manager' AND p.name IN ('products:write', 'categories:write', 'inventory:write', 'reviews:moderate'))
+    OR (r.name = 'support' AND p.name IN ('users:read', 'orders:read', 'orders:manage', 'carts:manage'))
+    OR (r.name = 'service' AND p.name IN ('users:read', 'orders:write', 'reservations:manage', 'privacy:manage', 'analytics:read'))
+ON CONFLICT DO NOTHING;
+
+-- Insert sample data (the password of every sample user is "password123", and their
+-- email addresses are verified).
+-- The first administrator is created from AUTH_ADMIN_* on first start.
+INSERT INTO users (username, email, password_hash, verified_at, created_at, updated_at)
+VALUES
+    ('john_doe', 'john@example.com', '$2a$12$PWJ9fzKE9kkP3YIIC4S/n.ZoAwOJXJYBym41aUsTNoCbbl17uCZbO', NOW(), NOW(), NOW()),
+    ('jane_smith', 'jane@example.com', '$2a$12$PWJ9fzKE9kkP3YIIC4S/n.ZoAwOJXJYBym41aUsTNoCbbl17uCZbO', NOW(), NOW(), NOW()),
+    ('bob_johnson', 'bob@example.com', '$2a$12$PWJ9fzKE9kkP3YIIC4S/n.ZoAwOJXJYBym41aUsTNoCbbl17uCZbO', NOW(), NOW(), NOW());
+
+INSERT INTO user_addresses (user_id, type, is_default, name, line1, city, region, postal_code, country, created_at, updated_at)
+SELECT id, 'shipping', TRUE, a.name, a.line1, a.city, a.region, a.postal_code, 'US', NOW(), NOW()
+FROM users
+JOIN (VALUES
+    ('john_doe', 'John Doe', '123 Main St', 'Springfield', 'IL', '62701'),
+    ('jane_smith', 'Jane Smith', '456 Oak Ave', 'Portland', 'OR', '97201'),
+    ('bob_johnson', 'Bob Johnson', '789 Pine Rd', 'Austin', 'TX', '73301')
+) AS a (username, name, line1, city, region, postal_code) USING (username);
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"net/http"
+	"pkg-iae/auth"
+	"pkg-iae/messages"
+	"pkg-iae/service"
+	"pkg-iae/web"
+	"time"
+)
+
+const (
+	ERASURE_PENDING   = "pending"
+	ERASURE_COMPLETED = "completed"
+	// ERASURE_CHECK_INTERVAL is how often deletions are checked for services that have not reported
+	ERASURE_CHECK_INTERVAL = 1 * time.Minute
+)
+
+// UserErasure is received on the user_erasures queue
+type UserErasure = messages.UserErasure
+
+// Erasure tracks the erasure of a deleted user's data across the services
+type Erasure struct {
+	ID          int              `json:"id"`
+	UserID      int              `json:"user_id"`
+	Status      string           `json:"status"` // pending, completed
+	RequestedBy string           `json:"requested_by"`
+	Services    []ErasureService `json:"services"`
+	CreatedAt   time.Time        `json:"created_at"`
+	CompletedAt *time.Time       `json:"completed_at"`
+}
+
+// ErasureService is the progress of one service in an erasure
+type ErasureService struct {
+	Service     string     `json:"service"`
+	Status      string     `json:"status"` // pending, completed
+	CompletedAt *time.Time `json:"completed_at"`
+}
+
+// UserExport is the archive returned by GET /users/{id}/export, with the
+// part each service holds under its name
+type UserExport struct {
+	UserID     int                    `json:"user_id"`
+	ExportedAt time.Time              `json:"exported_at"`
+	Services   map[string]interface{} `json:"services"`
+}
+
+// UserData is the part of a user's data export held by the User Service
+type UserData struct {
+	User          User           `json:"user"`
+	Addresses     []UserAddress  `json:"addresses"`
+	Roles         []UserRole     `json:"roles"`
+	OrderHistory  []OrderHistory `json:"order_history"`
+	Subscriptions []Subscription `json:"subscriptions"`
+}
+
+// userExporter is implemented by the clients of the other services
+type userExporter interface {
+	ExportUserData(ctx context.Context, userID int) (json.RawMessage, error)
+}
+
+// exportUserData gathers everything the services hold about a user into one archive
+func (a *App) exportUserData(w http.ResponseWriter, r *http.Request) {
+	userID := web.ParseInt(mux.Vars(r)["id"])
+
+	if !auth.AuthorizeUser(w, r, userID, auth.PERM_PRIVACY_MANAGE) {
+		return
+	}
+
+	data, err := a.fetchUserData(r.Context(), userID)
+	if err == pgx.ErrNoRows {
+		web.RespondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	export := UserExport{
+		UserID:     userID,
+		ExportedAt: time.Now().UTC(),
+		Services:   map[string]interface{}{messages.SERVICE_USER: data},
+	}
+
+	// An incomplete archive is worse than none, so every service must answer
+	services := []struct {
+		name   string
+		client userExporter
+	}{
+		{messages.SERVICE_PRODUCT, a.Products},
+		{messages.SERVICE_ORDER, a.Orders},
+		{messages.SERVICE_CART, a.Carts},
+	}
+	for _, s := range services {
+		part, err := s.client.ExportUserData(r.Context(), userID)
+		if err != nil {
+			log.Printf("Error exporting data of user %d from %s: %v", userID, s.name, err)
+			web.RespondWithError(w, http.StatusServiceUnavailable, fmt.Sprintf("Unable to export data from %s", s.name))
+			return
+		}
+		export.Services[s.name] = part
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="user-%d-export.json"`, userID))
+	web.RespondWithJSON(w, http.StatusOK, export)
+}
+
+// fetchUserData loads what the User Service holds about a user
+func (a *App) fetchUserData(ctx context.Context, userID int) (UserData, error) {
+	data := UserData{Addresses: []UserAddress{}, OrderHistory: []OrderHistory{}}
+
+	err := a.DB.QueryRow(ctx,
+		"SELECT id, username, email, verified_at, created_at, updated_at FROM users WHERE id = $1",
+		userID).Scan(&data.User.ID, &data.User.Username, &data.User.Email, &data.User.VerifiedAt,
+		&data.User.CreatedAt, &data.User.UpdatedAt)
+	if err != nil {
+		return data, err
+	}
+
+	rows, err := a.DB.Query(ctx,
+		"SELECT "+ADDRESS_COLUMNS+" FROM user_addresses WHERE user_id = $1 ORDER BY id",
+		userID)
+	if err != nil {
+		return data, err
+	}
+	for rows.Next() {
+		address, err := scanAddress(rows)
+		if err != nil {
+			rows.Close()
+			return data, err
+		}
+		data.Addresses = append(data.Addresses, address)
+	}
+	rows.Close()
+
+	rows, err = a.DB.Query(ctx,
+		"SELECT user_id, order_id, total, status, created_at FROM order_history WHERE user_id = $1 ORDER BY created_at",
+		userID)
+	if err != nil {
+		return data, err
+	}
+	for rows.Next() {
+		var h OrderHistory
+		if err := rows.Scan(&h.UserID, &h.OrderID, &h.Total, &h.Status, &h.CreatedAt); err != nil {
+			rows.Close()
+			return data, err
+		}
+		data.OrderHistory = append(data.OrderHistory, h)
+	}
+	rows.Close()
+
+	data.Subscriptions, err = a.userSubscriptions(ctx, userID)
+	if err != nil {
+		return data, err
+	}
+
+	data.Roles, err = a.userRoles(ctx, userID)
+	return data, err
+}
+
+// deleteUser deletes a user and starts erasing their data in the other
+// services, which is tracked as an erasure
+func (a *App) deleteUser(w http.ResponseWriter, r *http.Request) {
+	id := web.ParseInt(mux.Vars(r)["id"])
+
+	if !auth.AuthorizeUser(w, r, id, auth.PERM_USERS_WRITE) {
+		return
+	}
+
+	tx, err := a.DB.Begin(r.Context())
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	last, err := isLastAdmin(r.Context(), tx, id)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if last {
+		web.RespondWithError(w, http.StatusConflict, "Cannot delete the last administrator")
+		return
+	}
+
+	// Addresses, roles, tokens, order history, subscriptions and notifications go with the user
+	var erasureID int
+	err = tx.QueryRow(r.Context(), `
+        WITH deleted AS (DELETE FROM users WHERE id = $1 RETURNING id)
+        INSERT INTO erasure_requests (user_id, requested_by, created_at)
+        SELECT id, $2, NOW() FROM deleted
+        RETURNING id`,
+		id, auth.PrincipalFrom(r.Context()).Subject()).Scan(&erasureID)
+	if err == pgx.ErrNoRows {
+		web.RespondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	_, err = tx.Exec(r.Context(), `
+        INSERT INTO erasure_services (request_id, service, completed_at)
+        SELECT $1, service, CASE WHEN service = $2 THEN NOW() END
+        FROM UNNEST($3::text[]) AS service`,
+		erasureID, messages.SERVICE_USER, messages.ERASURE_SERVICES)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := tx.Commit(r.Context()); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	erasure, err := a.fetchErasure(r.Context(), erasureID)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// republishErasures retries if this fails
+	if err := a.publishErasure(r.Context(), erasure); err != nil {
+		log.Printf("Error publishing deletion of user %d: %v", id, err)
+	}
+
+	web.RespondWithJSON(w, http.StatusAccepted, erasure)
+}
+
+// getErasure returns the progress of a user's erasure
+func (a *App) getErasure(w http.ResponseWriter, r *http.Request) {
+	erasure, err := a.fetchErasure(r.Context(), web.ParseInt(mux.Vars(r)["id"]))
+	if err == pgx.ErrNoRows {
+		web.RespondWithError(w, http.StatusNotFound, "Erasure not found")
+		return
+	}
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if !auth.AuthorizeUser(w, r, erasure.UserID, auth.PERM_USERS_WRITE) {
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, erasure)
+}
+
+// fetchErasure loads an erasure with the progress of each service
+func (a *App) fetchErasure(ctx context.Context, id int) (Erasure, error) {
+	var e Erasure
+	err := a.DB.QueryRow(ctx,
+		"SELECT id, user_id, requested_by, created_at, completed_at FROM erasure_requests WHERE id = $1",
+		id).Scan(&e.ID, &e.UserID, &e.RequestedBy, &e.CreatedAt, &e.CompletedAt)
+	if err != nil {
+		return e, err
+	}
+
+	e.Status = ERASURE_PENDING
+	if e.CompletedAt != nil {
+		e.Status = ERASURE_COMPLETED
+	}
+
+	rows, err := a.DB.Query(ctx,
+		"SELECT service, completed_at FROM erasure_services WHERE request_id = $1 ORDER BY service",
+		id)
+	if err != nil {
+		return e, err
+	}
+	defer rows.Close()
+
+	e.Services = []ErasureService{}
+	for rows.Next() {
+		s := ErasureService{Status: ERASURE_PENDING}
+		if err := rows.Scan(&s.Service, &s.CompletedAt); err != nil {
+			return e, err
+		}
+		if s.CompletedAt != nil {
+			s.Status = ERASURE_COMPLETED
+		}
+		e.Services = append(e.Services, s)
+	}
+	return e, rows.Err()
+}
+
+// publishErasure publishes the user.deleted event of an erasure
+func (a *App) publishErasure(ctx context.Context, e Erasure) error {
+	err := messages.UserDeleted.Publish(ctx, a.RabbitCh, messages.UserDeletion{
+		RequestID: e.ID,
+		UserID:    e.UserID,
+		DeletedAt: e.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = a.DB.Exec(ctx, "UPDATE erasure_requests SET published_at = NOW() WHERE id = $1", e.ID)
+	return err
+}
+
+// republishErasures periodically publishes again the deletions that some
+// service has not reported within ERASURE_RETRY_INTERVAL, for example because
+// it was down or had not subscribed yet. Erasing is repeatable, so services
+// that already reported do no harm by erasing again.
+func (a *App) republishErasures() {
+	ticker := time.NewTicker(ERASURE_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		rows, err := a.DB.Query(context.Background(), `
+            SELECT id FROM erasure_requests
+            WHERE completed_at IS NULL AND (published_at IS NULL OR published_at < $1)
+            ORDER BY id`,
+			time.Now().Add(-a.Config.ErasureRetryInterval))
+		if err != nil {
+			log.Printf("Error finding unfinished erasures: %v", err)
+			continue
+		}
+		ids := []int{}
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err == nil {
+				ids = append(ids, id)
+			}
+		}
+		rows.Close()
+
+		for _, id := range ids {
+			erasure, err := a.fetchErasure(context.Background(), id)
+			if err == nil {
+				err = a.publishErasure(context.Background(), erasure)
+			}
+			if err != nil {
+				log.Printf("Error republishing erasure %d: %v", id, err)
+			}
+		}
+	}
+}
+
+// consumeErasureReports records the erasures other services report
+func (a *App) consumeErasureReports() error {
+	return a.Consume(messages.UserErasures.Name, service.Decoded(messages.UserErasures, func(ctx context.Context, report UserErasure) error {
+		if err := a.recordErasure(report); err != nil {
+			return fmt.Errorf("unable to record erasure %d by %s: %v", report.RequestID, report.Service, err)
+		}
+		return nil
+	}))
+}
+
+// recordErasure marks a service's part of an erasure done, and the erasure once every service is
+func (a *App) recordErasure(report UserErasure) error {
+	ctx := context.Background()
+
+	tx, err := a.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	// Locking the request keeps concurrent reports from each missing the other
+	var id int
+	err = tx.QueryRow(ctx, "SELECT id FROM erasure_requests WHERE id = $1 AND user_id = $2 FOR UPDATE",
+		report.RequestID, report.UserID).Scan(&id)
+	if err == pgx.ErrNoRows {
+		log.Printf("Ignoring erasure report of %s for unknown request %d", report.Service, report.RequestID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx,
+		"UPDATE erasure_services SET completed_at = $1 WHERE request_id = $2 AND service = $3 AND completed_at IS NULL",
+		report.ErasedAt, id, report.Service)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(ctx, `
+        UPDATE erasure_requests SET completed_at = NOW()
+        WHERE id = $1 AND completed_at IS NULL
+          AND NOT EXISTS (SELECT 1 FROM erasure_services WHERE request_id = $1 AND completed_at IS NULL)`,
+		id)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	if result.RowsAffected() > 0 {
+		log.Printf("Erasure %d of user %d completed", id, report.UserID)
+	}
+	return nil
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"net/http"
+	"pkg-iae/auth"
+	"pkg-iae/web"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SEED_ADMIN_LOCK is the advisory lock that keeps instances starting together
+// from seeding the administrator twice
+const SEED_ADMIN_LOCK = 81001
+
+// ROLE_NAME is what role names look like, e.g. "catalog_manager"
+var ROLE_NAME = regexp.MustCompile(`^[a-z][a-z0-9_]{1,49}$`)
+
+// Role is a named bundle of permissions
+type Role struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Permissions []string  `json:"permissions"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Permission is an action roles can allow
+type Permission struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// CreateRoleRequest is the body of POST /roles
+type CreateRoleRequest struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+// UserRole is a role granted to a user
+type UserRole struct {
+	Role      string    `json:"role"`
+	GrantedBy *string   `json:"granted_by,omitempty"`
+	GrantedAt time.Time `json:"granted_at"`
+}
+
+// grants are the roles a user holds and the permissions they give, as put in access tokens
+type grants struct {
+	Roles       []string
+	Permissions []string
+}
+
+// querier is satisfied by both the pool and a transaction
+type querier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+}
+
+// loadGrants returns the roles of a user and the union of their permissions
+func loadGrants(ctx context.Context, q querier, userID int) (grants, error) {
+	rows, err := q.Query(ctx, `
+        SELECT r.name, COALESCE(array_agg(p.name) FILTER (WHERE p.name IS NOT NULL), '{}')
+        FROM user_roles ur
+        JOIN roles r ON r.id = ur.role_id
+        LEFT JOIN role_permissions rp ON rp.role_id = r.id
+        LEFT JOIN permissions p ON p.id = rp.permission_id
+        WHERE ur.user_id = $1
+        GROUP BY r.name
+        ORDER BY r.name`,
+		userID)
+	if err != nil {
+		return grants{}, fmt.Errorf("unable to load roles: %v", err)
+	}
+	defer rows.Close()
+
+	var g grants
+	seen := map[string]bool{}
+	for rows.Next() {
+		var role string
+		var permissions []string
+		if err := rows.Scan(&role, &permissions); err != nil {
+			return grants{}, fmt.Errorf("unable to load roles: %v", err)
+		}
+		g.Roles = append(g.Roles, role)
+		for _, p := range permissions {
+			if !seen[p] {
+				seen[p] = true
+				g.Permissions = append(g.Permissions, p)
+			}
+		}
+	}
+	sort.Strings(g.Permissions)
+	return g, rows.Err()
+}
+
+// rolePermissions returns the permissions of a role
+func (a *App) rolePermissions(ctx context.Context, role string) ([]string, error) {
+	rows, err := a.DB.Query(ctx, `
+        SELECT p.name
+        FROM roles r
+        JOIN role_permissions rp ON rp.role_id = r.id
+        JOIN permissions p ON p.id = rp.permission_id
+        WHERE r.name = $1
+        ORDER BY p.name`,
+		role)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load permissions of role %s: %v", role, err)
+	}
+	defer rows.Close()
+
+	permissions := []string{}
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, p)
+	}
+	return permissions, rows.Err()
+}
+
+// seedAdmin creates the configured administrator while no user holds the admin
+// role, which is the case on first start. Afterwards it does nothing, so the
+// account can be renamed or its password changed without it coming back.
+func (a *App) seedAdmin(ctx context.Context) error {
+	admin := a.Config.Admin
+	if admin.Password == "" {
+		return nil
+	}
+
+	tx, err := a.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", SEED_ADMIN_LOCK); err != nil {
+		return fmt.Errorf("unable to seed administrator: %v", err)
+	}
+
+	var exists bool
+	err = tx.QueryRow(ctx, `
+        SELECT EXISTS (
+            SELECT 1 FROM user_roles ur JOIN roles r ON r.id = ur.role_id WHERE r.name = $1
+        )`,
+		auth.ROLE_ADMIN).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("unable to seed administrator: %v", err)
+	}
+	if exists {
+		return nil
+	}
+
+	passwordHash, err := a.hashPassword(admin.Password)
+	if err != nil {
+		return fmt.Errorf("unable to seed administrator: %v", err)
+	}
+
+	// An existing account is never promoted, since anyone could have registered the name
+	var id int
+	err = tx.QueryRow(ctx, `
+        INSERT INTO users (username, email, password_hash, verified_at, created_at, updated_at)
+        VALUES ($1, $2, $3, NOW(), NOW(), NOW())
+        ON CONFLICT DO NOTHING
+        RETURNING id`,
+		admin.Username, strings.ToLower(admin.Email), passwordHash).Scan(&id)
+	if err == pgx.ErrNoRows {
+		log.Printf("Not seeding administrator: user %s or email %s already exists", admin.Username, admin.Email)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to seed administrator: %v", err)
+	}
+
+	_, err = tx.Exec(ctx, `
+        INSERT INTO user_roles (user_id, role_id, granted_by)
+        SELECT $1, id, 'seed' FROM roles WHERE name = $2`,
+		id, auth.ROLE_ADMIN)
+	if err != nil {
+		return fmt.Errorf("unable to seed administrator: %v", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("unable to seed administrator: %v", err)
+	}
+
+	log.Printf("Seeded administrator %s (user %d)", admin.Username, id)
+	return nil
+}
+
+// getRoles lists the roles with their permissions
+func (a *App) getRoles(w http.ResponseWriter, r *http.Request) {
+	rows, err := a.DB.Query(r.Context(), `
+        SELECT r.id, r.name, r.description, r.created_at,
+               COALESCE(array_agg(p.name ORDER BY p.name) FILTER (WHERE p.name IS NOT NULL), '{}')
+        FROM roles r
+        LEFT JOIN role_permissions rp ON rp.role_id = r.id
+        LEFT JOIN permissions p ON p.id = rp.permission_id
+        GROUP BY r.id
+        ORDER BY r.name`)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	roles := []Role{}
+	for rows.Next() {
+		var role Role
+		if err := rows.Scan(&role.ID, &role.Name, &role.Description, &role.CreatedAt, &role.Permissions); err != nil {
+			web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		roles = append(roles, role)
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, roles)
+}
+
+// getPermissions lists the permissions roles can grant
+func (a *App) getPermissions(w http.ResponseWriter, r *http.Request) {
+	rows, err := a.DB.Query(r.Context(), "SELECT name, description FROM permissions ORDER BY name")
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	permissions := []Permission{}
+	for rows.Next() {
+		var p Permission
+		if err := rows.Scan(&p.Name, &p.Description); err != nil {
+			web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		permissions = append(permissions, p)
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, permissions)
+}
+
+// createRole creates a role bundling existing permissions
+func (a *App) createRole(w http.ResponseWriter, r *http.Request) {
+	var req CreateRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		web.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	errs := web.FieldErrors{}
+	if !ROLE_NAME.MatchString(req.Name) {
+		errs.Add("name", "must be 2 to 50 lowercase letters, digits or underscores, starting with a letter")
+	}
+
+	known := map[string]bool{}
+	rows, err := a.DB.Query(r.Context(), "SELECT name FROM permissions WHERE name = ANY($1)", req.Permissions)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		known[name] = true
+	}
+	rows.Close()
+	for _, p := range req.Permissions {
+		if !known[p] {
+			errs.Add("permissions", fmt.Sprintf("unknown permission %q", p))
+		}
+	}
+	if len(errs) > 0 {
+		web.RespondWithFieldErrors(w, "Invalid role", errs)
+		return
+	}
+
+	tx, err := a.DB.Begin(r.Context())
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	role := Role{Name: req.Name, Description: req.Description, Permissions: []string{}}
+	err = tx.QueryRow(r.Context(),
+		"INSERT INTO roles (name, description, created_at) VALUES ($1, $2, NOW()) RETURNING id, created_at",
+		role.Name, role.Description).Scan(&role.ID, &role.CreatedAt)
+	if isUniqueViolation(err) {
+		web.RespondWithError(w, http.StatusConflict, "Role already exists")
+		return
+	}
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	_, err = tx.Exec(r.Context(), `
+        INSERT INTO role_permissions (role_id, permission_id)
+        SELECT $1, id FROM permissions WHERE name = ANY($2)`,
+		role.ID, req.Permissions)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := tx.Commit(r.Context()); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	for p := range known {
+		role.Permissions = append(role.Permissions, p)
+	}
+	sort.Strings(role.Permissions)
+
+	web.RespondWithJSON(w, http.StatusCreated, role)
+}
+
+// userRoles returns the roles granted to a user
+func (a *App) userRoles(ctx context.Context, userID int) ([]UserRole, error) {
+	rows, err := a.DB.Query(ctx, `
+        SELECT r.name, ur.granted_by, ur.granted_at
+        FROM user_roles ur
+        JOIN roles r ON r.id = ur.role_id
+        WHERE ur.user_id = $1
+        ORDER BY r.name`,
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []UserRole{}
+	for rows.Next() {
+		var role UserRole
+		if err := rows.Scan(&role.Role, &role.GrantedBy, &role.GrantedAt); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+// getUserRoles lists the roles granted to a user
+func (a *App) getUserRoles(w http.ResponseWriter, r *http.Request) {
+	id := web.ParseInt(mux.Vars(r)["id"])
+
+	if !auth.AuthorizeUser(w, r, id, auth.PERM_USERS_READ) {
+		return
+	}
+
+	roles, err := a.userRoles(r.Context(), id)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, roles)
+}
+
+// grantUserRole grants a role to a user. Granting a role the user already holds
+// is not an error. The user's access tokens pick it up on their next refresh.
+func (a *App) grantUserRole(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := web.ParseInt(vars["id"])
+
+	var userExists bool
+	var roleID *int
+	err := a.DB.QueryRow(r.Context(),
+		"SELECT EXISTS (SELECT 1 FROM users WHERE id = $1), (SELECT id FROM roles WHERE name = $2)",
+		id, vars["role"]).Scan(&userExists, &roleID)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !userExists {
+		web.RespondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if roleID == nil {
+		web.RespondWithError(w, http.StatusNotFound, "Role not found")
+		return
+	}
+
+	_, err = a.DB.Exec(r.Context(), `
+        INSERT INTO user_roles (user_id, role_id, granted_by, granted_at)
+        VALUES ($1, $2, $3, NOW())
+        ON CONFLICT DO NOTHING`,
+		id, *roleID, auth.PrincipalFrom(r.Context()).Subject())
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	roles, err := a.userRoles(r.Context(), id)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, roles)
+}
+
+// revokeUserRole takes a role away from a user. The last administrator cannot
+// lose the admin role, so the system always has someone able to grant roles.
+func (a *App) revokeUserRole(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := web.ParseInt(vars["id"])
+	role := vars["role"]
+
+	tx, err := a.DB.Begin(r.Context())
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	if role == auth.ROLE_ADMIN {
+		last, err := isLastAdmin(r.Context(), tx, id)
+		if err != nil {
+			web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if last {
+			web.RespondWithError(w, http.StatusConflict, "Cannot revoke the admin role from the last administrator")
+			return
+		}
+	}
+
+	result, err := tx.Exec(r.Context(),
+		"DELETE FROM user_roles WHERE user_id = $1 AND role_id = (SELECT id FROM roles WHERE name = $2)",
+		id, role)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if result.RowsAffected() == 0 {
+		web.RespondWithError(w, http.StatusNotFound, "User does not have the role")
+		return
+	}
+
+	if err := tx.Commit(r.Context()); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// isLastAdmin reports whether a user is the only one holding the admin role.
+// It locks the admin grants until tx ends, so two requests cannot remove the
+// last two administrators at once.
+func isLastAdmin(ctx context.Context, tx pgx.Tx, userID int) (bool, error) {
+	rows, err := tx.Query(ctx, `
+        SELECT ur.user_id
+        FROM user_roles ur
+        JOIN roles r ON r.id = ur.role_id
+        WHERE r.name = $1
+        FOR UPDATE OF ur`,
+		auth.ROLE_ADMIN)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	admins, isAdmin := 0, false
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return false, err
+		}
+		admins++
+		isAdmin = isAdmin || id == userID
+	}
+	return isAdmin && admins == 1, rows.Err()
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"net/http"
+	"pkg-iae/auth"
+	"pkg-iae/clients"
+	"pkg-iae/messages"
+	"pkg-iae/notify"
+	"pkg-iae/service"
+	"pkg-iae/web"
+	"time"
+)
+
+const (
+	SUBSCRIPTION_BACK_IN_STOCK = "back_in_stock"
+	SUBSCRIPTION_PRICE_BELOW   = "price_below"
+	// MAX_SUBSCRIPTIONS_PER_USER caps the subscriptions of a user that have not been notified yet
+	MAX_SUBSCRIPTIONS_PER_USER = 50
+
+	NOTIFICATION_POLL_INTERVAL = 5 * time.Second
+	NOTIFICATION_BATCH_SIZE    = 50
+	NOTIFICATION_MAX_ATTEMPTS  = 5
+	// NOTIFICATION_RETRY_DELAY is doubled after every failed attempt
+	NOTIFICATION_RETRY_DELAY = 1 * time.Minute
+	// NOTIFICATION_LEASE is how long a claimed batch is left to one sender; it outlasts
+	// a batch of webhook calls that all time out
+	NOTIFICATION_LEASE = 10 * time.Minute
+)
+
+// SUBSCRIPTION_COLUMNS are the columns scanSubscription reads
+const SUBSCRIPTION_COLUMNS = "id, user_id, product_id, kind, target_price, created_at, notified_at"
+
+// Subscription asks for a notification when a product is back in stock or its price falls to a target
+type Subscription struct {
+	ID          int        `json:"id"`
+	UserID      int        `json:"user_id"`
+	ProductID   int        `json:"product_id"`
+	Kind        string     `json:"kind"`                   // back_in_stock or price_below
+	TargetPrice *float64   `json:"target_price,omitempty"` // Only for price_below
+	CreatedAt   time.Time  `json:"created_at"`
+	NotifiedAt  *time.Time `json:"notified_at"`
+}
+
+// SubscriptionRequest is the body of POST /products/{id}/subscriptions. UserID defaults
+// to the caller; subscribing someone else needs users:write.
+type SubscriptionRequest struct {
+	UserID      int      `json:"user_id"`
+	Kind        string   `json:"kind"`
+	TargetPrice *float64 `json:"target_price"`
+}
+
+// validate returns the problems of the request
+func (req SubscriptionRequest) validate() web.FieldErrors {
+	errs := web.FieldErrors{}
+	switch req.Kind {
+	case SUBSCRIPTION_BACK_IN_STOCK:
+		if req.TargetPrice != nil {
+			errs.Add("target_price", "is only allowed for price_below")
+		}
+	case SUBSCRIPTION_PRICE_BELOW:
+		if req.TargetPrice == nil || *req.TargetPrice <= 0 {
+			errs.Add("target_price", "must be positive")
+		}
+	default:
+		errs.Add("kind", fmt.Sprintf("must be %s or %s", SUBSCRIPTION_BACK_IN_STOCK, SUBSCRIPTION_PRICE_BELOW))
+	}
+	return errs
+}
+
+// scanSubscription reads a row of SUBSCRIPTION_COLUMNS
+func scanSubscription(row pgx.Row) (Subscription, error) {
+	var s Subscription
+	err := row.Scan(&s.ID, &s.UserID, &s.ProductID, &s.Kind, &s.TargetPrice, &s.CreatedAt, &s.NotifiedAt)
+	return s, err
+}
+
+// createSubscription subscribes a user to a product being back in stock or its price falling
+func (a *App) createSubscription(w http.ResponseWriter, r *http.Request) {
+	productID := web.ParseInt(mux.Vars(r)["id"])
+
+	var req SubscriptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		web.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if req.UserID == 0 {
+		req.UserID = auth.PrincipalFrom(r.Context()).UserID
+	}
+	if !auth.AuthorizeUser(w, r, req.UserID, auth.PERM_USERS_WRITE) {
+		return
+	}
+
+	if errs := req.validate(); len(errs) > 0 {
+		web.RespondWithFieldErrors(w, "Invalid subscription", errs)
+		return
+	}
+
+	product, err := a.Products.GetProduct(r.Context(), productID)
+	if errors.Is(err, clients.ErrNotFound) {
+		web.RespondWithError(w, http.StatusNotFound, "Product not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching product %d: %v", productID, err)
+		web.RespondWithError(w, http.StatusServiceUnavailable, "Unable to contact Product Service")
+		return
+	}
+	// Only a price change can notify, so a target the price already meets would never fire
+	if req.Kind == SUBSCRIPTION_PRICE_BELOW && *req.TargetPrice >= product.Price {
+		web.RespondWithFieldErrors(w, "Invalid subscription",
+			web.FieldErrors{"target_price": fmt.Sprintf("must be below the current price of %.2f", product.Price)})
+		return
+	}
+
+	tx, err := a.DB.Begin(r.Context())
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	// Locking the user serializes their subscribing
+	var count int
+	err = tx.QueryRow(r.Context(), `
+        SELECT (SELECT COUNT(*) FROM product_subscriptions WHERE user_id = u.id AND notified_at IS NULL)
+        FROM users u WHERE u.id = $1 FOR UPDATE`,
+		req.UserID).Scan(&count)
+	if err == pgx.ErrNoRows {
+		web.RespondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if count >= MAX_SUBSCRIPTIONS_PER_USER {
+		web.RespondWithError(w, http.StatusConflict, fmt.Sprintf("A user can have at most %d open subscriptions", MAX_SUBSCRIPTIONS_PER_USER))
+		return
+	}
+
+	subscription, err := scanSubscription(tx.QueryRow(r.Context(), `
+        INSERT INTO product_subscriptions (user_id, product_id, kind, target_price, created_at)
+        VALUES ($1, $2, $3, $4, NOW())
+        RETURNING `+SUBSCRIPTION_COLUMNS,
+		req.UserID, productID, req.Kind, req.TargetPrice))
+	if isUniqueViolation(err) {
+		web.RespondWithError(w, http.StatusConflict, "Already subscribed to this product")
+		return
+	}
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := tx.Commit(r.Context()); err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusCreated, subscription)
+}
+
+// getSubscriptions lists a user's subscriptions, newest first
+func (a *App) getSubscriptions(w http.ResponseWriter, r *http.Request) {
+	userID := web.ParseInt(mux.Vars(r)["id"])
+
+	if !auth.AuthorizeUser(w, r, userID, auth.PERM_USERS_READ) {
+		return
+	}
+
+	subscriptions, err := a.userSubscriptions(r.Context(), userID)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, subscriptions)
+}
+
+// userSubscriptions loads a user's subscriptions, newest first
+func (a *App) userSubscriptions(ctx context.Context, userID int) ([]Subscription, error) {
+	rows, err := a.DB.Query(ctx,
+		"SELECT "+SUBSCRIPTION_COLUMNS+" FROM product_subscriptions WHERE user_id = $1 ORDER BY id DESC",
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subscriptions := []Subscription{}
+	for rows.Next() {
+		s, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, s)
+	}
+	return subscriptions, rows.Err()
+}
+
+// deleteSubscription removes one of a user's subscriptions
+func (a *App) deleteSubscription(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := web.ParseInt(vars["id"])
+
+	if !auth.AuthorizeUser(w, r, userID, auth.PERM_USERS_WRITE) {
+		return
+	}
+
+	result, err := a.DB.Exec(r.Context(),
+		"DELETE FROM product_subscriptions WHERE id = $1 AND user_id = $2",
+		web.ParseInt(vars["subscription_id"]), userID)
+	if err != nil {
+		web.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if result.RowsAffected() == 0 {
+		web.RespondWithError(w, http.StatusNotFound, "Subscription not found")
+		return
+	}
+
+	web.RespondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// consumeProductEvents subscribes to the Product Service's back in stock and price
+// change events and queues a notification for each subscription they satisfy
+func (a *App) consumeProductEvents() error {
+	backInStock, err := messages.ProductBackInStock.Subscribe(a.RabbitCh, messages.SERVICE_USER)
+	if err != nil {
+		return err
+	}
+	if err := a.Consume(backInStock.Name, service.Decoded(backInStock, a.notifyBackInStock)); err != nil {
+		return err
+	}
+
+	priceChanges, err := messages.ProductPriceChanged.Subscribe(a.RabbitCh, messages.SERVICE_USER)
+	if err != nil {
+		return err
+	}
+	return a.Consume(priceChanges.Name, service.Decoded(priceChanges, a.notifyPriceDrop))
+}
+
+// notifyBackInStock queues a notification for every open back in stock subscription
+// to the product. Subscriptions are closed as they are matched, so a redelivered
+// event matches nothing.
+func (a *App) notifyBackInStock(ctx context.Context, e messages.StockEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	result, err := a.DB.Exec(ctx, `
+        WITH matched AS (
+            UPDATE product_subscriptions SET notified_at = NOW()
+            WHERE product_id = $1 AND kind = $2 AND notified_at IS NULL
+            RETURNING id, user_id
+        )
+        INSERT INTO notifications (user_id, subscription_id, kind, subject, body, data, next_attempt_at, created_at)
+        SELECT user_id, id, $2, $3, $4, $5, NOW(), NOW() FROM matched`,
+		e.ProductID, SUBSCRIPTION_BACK_IN_STOCK,
+		fmt.Sprintf("%s is back in stock", e.Name),
+		fmt.Sprintf("Good news: %s is available again, with %d in stock.", e.Name, e.Available),
+		data)
+	if err != nil {
+		return err
+	}
+	if n := result.RowsAffected(); n > 0 {
+		log.Printf("Queued %d back in stock notifications for product %d", n, e.ProductID)
+	}
+	return nil
+}
+
+// notifyPriceDrop queues a notification for every open price_below subscription to the
+// product whose target the new price meets
+func (a *App) notifyPriceDrop(ctx context.Context, e messages.PriceChange) error {
+	if e.Price >= e.OldPrice {
+		return nil
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("The price of %s dropped from %.2f to %.2f.", e.Name, e.OldPrice, e.Price)
+	if e.VariantID != 0 {
+		body = fmt.Sprintf("A version of %s dropped in price from %.2f to %.2f.", e.Name, e.OldPrice, e.Price)
+	}
+
+	result, err := a.DB.Exec(ctx, `
+        WITH matched AS (
+            UPDATE product_subscriptions SET notified_at = NOW()
+            WHERE product_id = $1 AND kind = $2 AND notified_at IS NULL AND target_price >= $3
+            RETURNING id, user_id
+        )
+        INSERT INTO notifications (user_id, subscription_id, kind, subject, body, data, next_attempt_at, created_at)
+        SELECT user_id, id, $2, $4, $5, $6, NOW(), NOW() FROM matched`,
+		e.ProductID, SUBSCRIPTION_PRICE_BELOW, e.Price,
+		fmt.Sprintf("Price drop: %s now %.2f", e.Name, e.Price), body, data)
+	if err != nil {
+		return err
+	}
+	if n := result.RowsAffected(); n > 0 {
+		log.Printf("Queued %d price drop notifications for product %d", n, e.ProductID)
+	}
+	return nil
+}
+
+// deliverNotifications periodically sends the notifications that are due
+func (a *App) deliverNotifications() {
+	ticker := time.NewTicker(NOTIFICATION_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for {
+			attempted, err := a.sendDueNotifications()
+			if err != nil {
+				log.Printf("Error sending notifications: %v", err)
+				break
+			}
+			if attempted < NOTIFICATION_BATCH_SIZE {
+				break
+			}
+		}
+	}
+}
+
+// sendDueNotifications sends one batch of due notifications through the notifier.
+// The batch is claimed by moving it NOTIFICATION_LEASE into the future, so no
+// transaction stays open while the notifier runs and other instances skip it.
+// Failed ones are tried again later, each time waiting twice as long, until
+// NOTIFICATION_MAX_ATTEMPTS is reached. Notifications whose result could not be
+// recorded are sent again once the lease runs out.
+func (a *App) sendDueNotifications() (int, error) {
+	ctx := context.Background()
+
+	rows, err := a.DB.Query(ctx, `
+        WITH claimed AS (
+            UPDATE notifications SET next_attempt_at = $1
+            WHERE id IN (
+                SELECT id FROM notifications
+                WHERE sent_at IS NULL AND attempts < $2 AND next_attempt_at <= NOW()
+                ORDER BY id
+                LIMIT $3
+                FOR UPDATE SKIP LOCKED
+            )
+            RETURNING id, user_id, kind, subject, body, data, created_at, attempts
+        )
+        SELECT c.id, c.user_id, u.email, c.kind, c.subject, c.body, c.data, c.created_at, c.attempts
+        FROM claimed c
+        JOIN users u ON u.id = c.user_id
+        ORDER BY c.id`,
+		time.Now().Add(NOTIFICATION_LEASE), NOTIFICATION_MAX_ATTEMPTS, NOTIFICATION_BATCH_SIZE)
+	if err != nil {
+		return 0, err
+	}
+
+	type dueNotification struct {
+		notify.Notification
+		attempts int
+	}
+	due := []dueNotification{}
+	for rows.Next() {
+		var n dueNotification
+		if err := rows.Scan(&n.ID, &n.UserID, &n.Email, &n.Kind, &n.Subject, &n.Body, &n.Data,
+			&n.CreatedAt, &n.attempts); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		due = append(due, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, n := range due {
+		if err := a.Notifier.Notify(ctx, n.Notification); err != nil {
+			log.Printf("Error sending notification %d to user %d (attempt %d): %v", n.ID, n.UserID, n.attempts+1, err)
+			_, err = a.DB.Exec(ctx,
+				"UPDATE notifications SET attempts = attempts + 1, last_error = $1, next_attempt_at = $2 WHERE id = $3",
+				err.Error(), time.Now().Add(NOTIFICATION_RETRY_DELAY<<n.attempts), n.ID)
+			if err != nil {
+				log.Printf("Error recording failed notification %d: %v", n.ID, err)
+			}
+			continue
+		}
+
+		_, err = a.DB.Exec(ctx,
+			"UPDATE notifications SET attempts = attempts + 1, last_error = NULL, sent_at = NOW() WHERE id = $1",
+			n.ID)
+		if err != nil {
+			log.Printf("Error recording sent notification %d: %v", n.ID, err)
+			continue
+		}
+		sent++
+	}
+
+	if sent > 0 {
+		log.Printf("Sent %d notifications", sent)
+	}
+
+	return len(due), nil
+}